@@ -1,3 +1,6 @@
+//go:build integration
+// +build integration
+
 /* Copyright (C) 2021 Pankaj Kargirwar <kargirwar@protonmail.com>
 
    This file is part of prosql-agent
@@ -29,6 +32,7 @@ import (
 	"time"
 
 	"github.com/dchest/uniuri"
+	"github.com/kargirwar/prosql-agent/utils"
 )
 
 const BASE_URL = "http://localhost:23890"
@@ -44,8 +48,6 @@ var creds = map[string]string{
 
 var ctx = context.Background()
 
-const N = 1000
-
 func TestSid(t *testing.T) {
 	sid := "VPtBxUGvRy9Eg3M3"
 	setdb_test(t, sid, "test-generico")
@@ -107,9 +109,9 @@ func TestClientLogin(t *testing.T) {
 }
 
 func login_test(t *testing.T) string {
-	defer TimeTrack(ctx, time.Now())
+	defer utils.TimeTrack(ctx, time.Now())
 
-	r := &Response{}
+	r := &utils.Response{}
 
 	err := getJson(getQuery(t, "login", creds), r)
 	if err != nil {
@@ -121,9 +123,9 @@ func login_test(t *testing.T) string {
 }
 
 func setdb_test(t *testing.T, sid, db string) {
-	defer TimeTrack(ctx, time.Now())
+	defer utils.TimeTrack(ctx, time.Now())
 
-	r := &Response{}
+	r := &utils.Response{}
 	params := map[string]string{
 		"session-id": sid,
 		"db":         db,
@@ -140,9 +142,9 @@ func setdb_test(t *testing.T, sid, db string) {
 }
 
 func execute_test(t *testing.T, sid, query string) string {
-	defer TimeTrack(ctx, time.Now())
+	defer utils.TimeTrack(ctx, time.Now())
 
-	r := &Response{}
+	r := &utils.Response{}
 	params := map[string]string{
 		"session-id": sid,
 		"query":      query,
@@ -161,9 +163,9 @@ func execute_test(t *testing.T, sid, query string) string {
 }
 
 func fetch_test(t *testing.T, sid, cid string) interface{} {
-	defer TimeTrack(ctx, time.Now())
+	defer utils.TimeTrack(ctx, time.Now())
 
-	r := &Response{}
+	r := &utils.Response{}
 	params := map[string]string{
 		"session-id":  sid,
 		"cursor-id":   cid,
@@ -183,7 +185,7 @@ func fetch_test(t *testing.T, sid, cid string) interface{} {
 	return r.Data
 }
 
-func getValue(t *testing.T, r *Response, k string) string {
+func getValue(t *testing.T, r *utils.Response, k string) string {
 	m, ok := r.Data.(map[string]interface{})
 	if !ok {
 		t.Fatalf("Unable to parse JSON")
@@ -218,6 +220,9 @@ func getJson(url string, target interface{}) error {
 
 	r.Header.Add("X-Request-Id", uniuri.New())
 	res, err := client.Do(r)
+	if err != nil {
+		return err
+	}
 	defer res.Body.Close()
 
 	//body, err := ioutil.ReadAll(res.Body)
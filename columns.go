@@ -0,0 +1,149 @@
+/* Copyright (C) 2021 Pankaj Kargirwar <kargirwar@protonmail.com>
+
+   This file is part of prosql-agent
+
+   prosql-agent is free software: you can redistribute it and/or modify
+   it under the terms of the GNU General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   prosql-agent is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU General Public License for more details.
+
+   You should have received a copy of the GNU General Public License
+   along with prosql-agent.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"strconv"
+	"strings"
+	"time"
+)
+
+//how a value of a column is represented in JSON
+const KIND_NUMBER = "number"
+const KIND_STRING = "string"
+const KIND_BINARY = "binary" //base64
+const KIND_JSON = "json"
+
+type ColumnMeta struct {
+	Name      string `json:"name"`
+	Type      string `json:"type"`
+	ScanType  string `json:"scan-type"`
+	Kind      string `json:"kind"`
+	Nullable  *bool  `json:"nullable,omitempty"`
+	Length    *int64 `json:"length,omitempty"`
+	Precision *int64 `json:"precision,omitempty"`
+	Scale     *int64 `json:"scale,omitempty"`
+}
+
+//metadata is only sent when asked for, so the plain format is unchanged
+type columnsRes struct {
+	Columns []*ColumnMeta `json:"columns"`
+}
+
+//result of an ajax fetch with typed values. Columns are sent with the
+//first batch only
+type TypedRows struct {
+	Columns []*ColumnMeta   `json:"columns,omitempty"`
+	Rows    [][]interface{} `json:"rows"`
+}
+
+func getColumnMeta(rows *sql.Rows) ([]*ColumnMeta, error) {
+	types, err := rows.ColumnTypes()
+	if err != nil {
+		return nil, err
+	}
+
+	cols := make([]*ColumnMeta, len(types))
+	for i, t := range types {
+		m := &ColumnMeta{
+			Name: t.Name(),
+			Type: t.DatabaseTypeName(),
+			Kind: kindOf(t.DatabaseTypeName()),
+		}
+
+		if st := t.ScanType(); st != nil {
+			m.ScanType = st.String()
+		}
+
+		if nullable, ok := t.Nullable(); ok {
+			m.Nullable = &nullable
+		}
+
+		if length, ok := t.Length(); ok {
+			m.Length = &length
+		}
+
+		if precision, scale, ok := t.DecimalSize(); ok {
+			m.Precision = &precision
+			m.Scale = &scale
+		}
+
+		cols[i] = m
+	}
+
+	return cols, nil
+}
+
+func kindOf(dbType string) string {
+	//the driver reports unsigned integers as UNSIGNED INT and so on
+	switch strings.TrimPrefix(dbType, "UNSIGNED ") {
+	case "TINYINT", "SMALLINT", "MEDIUMINT", "INT", "BIGINT", "YEAR", "FLOAT", "DOUBLE":
+		return KIND_NUMBER
+
+	case "BIT", "BINARY", "VARBINARY", "TINYBLOB", "BLOB", "MEDIUMBLOB", "LONGBLOB", "GEOMETRY":
+		return KIND_BINARY
+
+	case "JSON":
+		return KIND_JSON
+	}
+
+	//DECIMAL stays a string so that no precision is lost in the browser
+	return KIND_STRING
+}
+
+//encode a scanned value according to the kind of its column. NULL is nil
+func typedValue(m *ColumnMeta, v interface{}) interface{} {
+	if v == nil {
+		return nil
+	}
+
+	switch t := v.(type) {
+	case int64, float64, bool:
+		return t
+
+	case time.Time:
+		return t.Format("2006-01-02 15:04:05.999999")
+
+	case []byte:
+		switch m.Kind {
+		case KIND_NUMBER:
+			//json.Number keeps every digit of BIGINT UNSIGNED
+			if _, err := strconv.ParseFloat(string(t), 64); err == nil {
+				return json.Number(t)
+			}
+
+		case KIND_BINARY:
+			//copy, the driver reuses its buffer on the next scan
+			b := make([]byte, len(t))
+			copy(b, t)
+			return b
+
+		case KIND_JSON:
+			if json.Valid(t) {
+				return json.RawMessage(string(t))
+			}
+		}
+
+		return string(t)
+	}
+
+	return v
+}
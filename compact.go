@@ -0,0 +1,120 @@
+/* Copyright (C) 2021 Pankaj Kargirwar <kargirwar@protonmail.com>
+
+   This file is part of prosql-agent
+
+   prosql-agent is free software: you can redistribute it and/or modify
+   it under the terms of the GNU General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   prosql-agent is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU General Public License for more details.
+
+   You should have received a copy of the GNU General Public License
+   along with prosql-agent.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+/* The compact format sends column names once and rows as plain value
+arrays, several rows per websocket message:
+
+{"names": ["id", "name"]}
+{"rows": [[1, "a"], [2, null]]}
+{"rows": [[3, "c"]]}
+{"k": ["eos"]}
+
+With typed the names message is replaced by the column metadata message */
+
+package main
+
+import (
+	"errors"
+)
+
+type namesRes struct {
+	Names []string `json:"names"`
+}
+
+//result of an ajax fetch in compact format. Names are sent with the first
+//batch only
+type CompactRows struct {
+	Names []string        `json:"names,omitempty"`
+	Rows  [][]interface{} `json:"rows"`
+}
+
+func checkFormat(opts *FetchOptions) error {
+	switch opts.Format {
+	case "":
+		opts.Format = FORMAT_PAIRS
+	case FORMAT_PAIRS, FORMAT_COMPACT:
+	default:
+		return errors.New(ERR_INVALID_FORMAT)
+	}
+
+	if opts.BatchRows == 0 {
+		opts.BatchRows = getConfig().Fetch.BatchRows
+	}
+
+	if opts.BatchBytes == 0 {
+		opts.BatchBytes = getConfig().Fetch.BatchBytes
+	}
+
+	if opts.BatchRows < 0 || opts.BatchBytes < 0 {
+		return errors.New(ERR_INVALID_BATCH_SIZE)
+	}
+
+	return nil
+}
+
+//collects rows into {"rows": [...]} frames. A frame is sent once it holds
+//maxRows rows or maxBytes encoded bytes, whichever comes first
+type rowBatcher struct {
+	ws       wsWriter
+	cd       codec
+	maxRows  int
+	maxBytes int
+	rows     [][]byte
+	size     int
+}
+
+func newRowBatcher(ws wsWriter, opts FetchOptions) *rowBatcher {
+	return &rowBatcher{
+		ws:       ws,
+		cd:       codecFor(opts.Encoding),
+		maxRows:  opts.BatchRows,
+		maxBytes: opts.BatchBytes,
+	}
+}
+
+func (b *rowBatcher) add(row []interface{}) error {
+	str, err := b.cd.marshal(row)
+	if err != nil {
+		return err
+	}
+
+	b.rows = append(b.rows, str)
+	b.size += len(str)
+
+	if len(b.rows) >= b.maxRows || b.size >= b.maxBytes {
+		return b.flush()
+	}
+
+	return nil
+}
+
+func (b *rowBatcher) flush() error {
+	if len(b.rows) == 0 {
+		return nil
+	}
+
+	str, err := b.cd.rowsFrame(b.rows)
+	b.rows = b.rows[:0]
+	b.size = 0
+
+	if err != nil {
+		return err
+	}
+
+	return b.ws.WriteMessage(b.cd.msgType(), str)
+}
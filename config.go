@@ -0,0 +1,463 @@
+/* Copyright (C) 2021 Pankaj Kargirwar <kargirwar@protonmail.com>
+
+   This file is part of prosql-agent
+
+   prosql-agent is free software: you can redistribute it and/or modify
+   it under the terms of the GNU General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   prosql-agent is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU General Public License for more details.
+
+   You should have received a copy of the GNU General Public License
+   along with prosql-agent.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+/* Agent settings come from config.toml in the agent's config directory
+(~/.config/prosql-agent on Linux, ~/Library/Application Support/prosql-agent
+on macOS, %AppData%\prosql-agent on Windows), or from the file named by
+-config or PROSQL_CONFIG. Every setting is optional:
+
+[listen]
+address = "127.0.0.1"
+port = 23890
+port-range = "23891-23899"       # tried when port is taken, or "none"
+tls = false                      # see tlscert.go
+
+[origins]
+allowed = ["https://prosql.io"]  # see origins.go
+
+[pool]
+max-open-conns = 500             # per session, 0 for no limit
+max-idle-conns = 100
+
+[timeouts]
+session-idle = "20m"             # idle sessions are closed
+cursor-idle = "1m"               # idle cursors are cancelled
+download-ttl = "30m"
+export-job-retention = "30m"
+
+[fetch]
+batch-rows = 500                 # compact batches, unless a request says
+batch-bytes = 65536
+
+[log]
+level = "debug"
+
+[export]
+dir = ""                         # ~/Downloads when empty, see exportfile.go
+allowed-dirs = []
+template = "query-results-{timestamp}"
+on-collision = "suffix"
+
+Environment variables override the file and flags override both, see
+overrides below. Invalid settings stop the agent from starting.
+
+SIGHUP reloads the file. Everything except [listen] takes effect without
+dropping sessions: pool limits apply to sessions created from then on,
+timeouts from the next cleanup on. A file which doesn't load leaves the
+running configuration alone */
+
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/BurntSushi/toml"
+	log "github.com/sirupsen/logrus"
+)
+
+const CONFIG_DIR = "prosql-agent"
+const CONFIG_FILE = "config.toml"
+
+type duration struct {
+	time.Duration
+}
+
+func (d *duration) UnmarshalText(text []byte) error {
+	v, err := time.ParseDuration(string(text))
+	if err != nil {
+		return err
+	}
+
+	d.Duration = v
+	return nil
+}
+
+type agentConfig struct {
+	Listen struct {
+		Address   string `toml:"address"`
+		Port      int    `toml:"port"`
+		PortRange string `toml:"port-range"`
+		Tls       bool   `toml:"tls"`
+	} `toml:"listen"`
+
+	Origins struct {
+		Allowed []string `toml:"allowed"`
+	} `toml:"origins"`
+
+	Pool struct {
+		MaxOpenConns int `toml:"max-open-conns"`
+		MaxIdleConns int `toml:"max-idle-conns"`
+	} `toml:"pool"`
+
+	Timeouts struct {
+		SessionIdle        duration `toml:"session-idle"`
+		CursorIdle         duration `toml:"cursor-idle"`
+		DownloadTtl        duration `toml:"download-ttl"`
+		ExportJobRetention duration `toml:"export-job-retention"`
+	} `toml:"timeouts"`
+
+	Fetch struct {
+		BatchRows  int `toml:"batch-rows"`
+		BatchBytes int `toml:"batch-bytes"`
+	} `toml:"fetch"`
+
+	Log struct {
+		Level string `toml:"level"`
+	} `toml:"log"`
+
+	Export struct {
+		Dir         string   `toml:"dir"`
+		AllowedDirs []string `toml:"allowed-dirs"`
+		Template    string   `toml:"template"`
+		OnCollision string   `toml:"on-collision"`
+	} `toml:"export"`
+
+	//worked out from the settings by prepare
+	listen  *listenConfig
+	origins []*originPattern
+	export  *exportConfig
+	level   log.Level
+}
+
+//a setting which the environment and flags may override
+type override struct {
+	key   string //in the file
+	env   string
+	flag  string
+	field func(cfg *agentConfig) interface{}
+	split func(s string) []string //for lists
+}
+
+func splitComma(s string) []string {
+	return strings.Split(s, ",")
+}
+
+var overrides = []*override{
+	{"listen.address", "PROSQL_LISTEN_ADDRESS", "address", func(cfg *agentConfig) interface{} { return &cfg.Listen.Address }, nil},
+	{"listen.port", "PROSQL_PORT", "port", func(cfg *agentConfig) interface{} { return &cfg.Listen.Port }, nil},
+	{"listen.port-range", "PROSQL_PORT_RANGE", "port-range", func(cfg *agentConfig) interface{} { return &cfg.Listen.PortRange }, nil},
+	{"listen.tls", "PROSQL_TLS", "tls", func(cfg *agentConfig) interface{} { return &cfg.Listen.Tls }, nil},
+	{"origins.allowed", "PROSQL_ALLOWED_ORIGINS", "allowed-origins", func(cfg *agentConfig) interface{} { return &cfg.Origins.Allowed }, splitComma},
+	{"pool.max-open-conns", "PROSQL_MAX_OPEN_CONNS", "max-open-conns", func(cfg *agentConfig) interface{} { return &cfg.Pool.MaxOpenConns }, nil},
+	{"pool.max-idle-conns", "PROSQL_MAX_IDLE_CONNS", "max-idle-conns", func(cfg *agentConfig) interface{} { return &cfg.Pool.MaxIdleConns }, nil},
+	{"timeouts.session-idle", "PROSQL_SESSION_IDLE", "session-idle", func(cfg *agentConfig) interface{} { return &cfg.Timeouts.SessionIdle }, nil},
+	{"timeouts.cursor-idle", "PROSQL_CURSOR_IDLE", "cursor-idle", func(cfg *agentConfig) interface{} { return &cfg.Timeouts.CursorIdle }, nil},
+	{"timeouts.download-ttl", "PROSQL_DOWNLOAD_TTL", "download-ttl", func(cfg *agentConfig) interface{} { return &cfg.Timeouts.DownloadTtl }, nil},
+	{"timeouts.export-job-retention", "PROSQL_EXPORT_JOB_RETENTION", "export-job-retention", func(cfg *agentConfig) interface{} { return &cfg.Timeouts.ExportJobRetention }, nil},
+	{"fetch.batch-rows", "PROSQL_BATCH_ROWS", "batch-rows", func(cfg *agentConfig) interface{} { return &cfg.Fetch.BatchRows }, nil},
+	{"fetch.batch-bytes", "PROSQL_BATCH_BYTES", "batch-bytes", func(cfg *agentConfig) interface{} { return &cfg.Fetch.BatchBytes }, nil},
+	{"log.level", "PROSQL_LOG_LEVEL", "log-level", func(cfg *agentConfig) interface{} { return &cfg.Log.Level }, nil},
+	{"export.dir", "PROSQL_EXPORT_DIR", "export-dir", func(cfg *agentConfig) interface{} { return &cfg.Export.Dir }, nil},
+	{"export.allowed-dirs", "PROSQL_EXPORT_ALLOWED_DIRS", "export-allowed-dirs", func(cfg *agentConfig) interface{} { return &cfg.Export.AllowedDirs }, filepath.SplitList},
+	{"export.template", "PROSQL_EXPORT_TEMPLATE", "export-template", func(cfg *agentConfig) interface{} { return &cfg.Export.Template }, nil},
+	{"export.on-collision", "PROSQL_EXPORT_ON_COLLISION", "export-on-collision", func(cfg *agentConfig) interface{} { return &cfg.Export.OnCollision }, nil},
+}
+
+//where the configuration is loaded from, kept for reloads
+type configSource struct {
+	path     string
+	required bool              //named explicitly, so it must exist
+	flags    map[string]string //flags given on the command line
+}
+
+var currentConfig = struct {
+	sync.RWMutex
+	cfg *agentConfig
+}{cfg: startupConfig()}
+
+var source = &configSource{}
+
+func getConfig() *agentConfig {
+	currentConfig.RLock()
+	defer currentConfig.RUnlock()
+	return currentConfig.cfg
+}
+
+func setConfig(cfg *agentConfig) {
+	currentConfig.Lock()
+	defer currentConfig.Unlock()
+	currentConfig.cfg = cfg
+}
+
+func defaultConfig() *agentConfig {
+	cfg := &agentConfig{}
+
+	cfg.Listen.Address = DEFAULT_LISTEN_ADDRESS
+	cfg.Listen.Port = PORT
+	cfg.Listen.PortRange = DEFAULT_PORT_RANGE
+	cfg.Origins.Allowed = splitComma(ALLOW)
+	cfg.Pool.MaxOpenConns = MAX_OPEN_CONNS
+	cfg.Pool.MaxIdleConns = MAX_IDLE_CONNS
+	cfg.Timeouts.SessionIdle.Duration = SESSION_CLEANUP_INTERVAL
+	cfg.Timeouts.CursorIdle.Duration = CURSOR_CLEANUP_INTERVAL
+	cfg.Timeouts.DownloadTtl.Duration = DOWNLOAD_TTL
+	cfg.Timeouts.ExportJobRetention.Duration = EXPORT_JOB_RETENTION
+	cfg.Fetch.BatchRows = DEFAULT_BATCH_ROWS
+	cfg.Fetch.BatchBytes = DEFAULT_BATCH_BYTES
+	cfg.Log.Level = DEFAULT_LOG_LEVEL
+	cfg.Export.Template = DEFAULT_EXPORT_TEMPLATE
+	cfg.Export.OnCollision = COLLISION_SUFFIX
+
+	return cfg
+}
+
+//what the agent runs with until main has read the file: defaults and the
+//environment. main reports anything invalid
+func startupConfig() *agentConfig {
+	cfg := defaultConfig()
+	if err := cfg.applyEnv(); err == nil && cfg.prepare() == nil {
+		return cfg
+	}
+
+	cfg = defaultConfig()
+	cfg.prepare()
+	return cfg
+}
+
+func defaultConfigPath() string {
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		return ""
+	}
+
+	return filepath.Join(dir, CONFIG_DIR, CONFIG_FILE)
+}
+
+//-config and the override flags
+func parseFlags(args []string) (*configSource, error) {
+	fs := flag.NewFlagSet(APP_NAME, flag.ContinueOnError)
+
+	path := fs.String("config", "", "configuration file, "+defaultConfigPath()+" by default")
+	for _, o := range overrides {
+		fs.String(o.flag, "", "overrides "+o.key)
+	}
+
+	if err := fs.Parse(args); err != nil {
+		return nil, err
+	}
+
+	src := &configSource{
+		path:  *path,
+		flags: make(map[string]string),
+	}
+
+	fs.Visit(func(f *flag.Flag) {
+		src.flags[f.Name] = f.Value.String()
+	})
+
+	if src.path == "" {
+		src.path = os.Getenv("PROSQL_CONFIG")
+	}
+
+	if src.path != "" {
+		src.required = true
+	} else {
+		src.path = defaultConfigPath()
+	}
+
+	return src, nil
+}
+
+func loadConfig(src *configSource) (*agentConfig, error) {
+	cfg := defaultConfig()
+
+	if err := cfg.decodeFile(src); err != nil {
+		return nil, err
+	}
+
+	if err := cfg.applyEnv(); err != nil {
+		return nil, err
+	}
+
+	for _, o := range overrides {
+		if v, present := src.flags[o.flag]; present {
+			if err := o.set(cfg, v); err != nil {
+				return nil, fmt.Errorf("-%s: %s", o.flag, err.Error())
+			}
+		}
+	}
+
+	if err := cfg.prepare(); err != nil {
+		return nil, err
+	}
+
+	return cfg, nil
+}
+
+func (cfg *agentConfig) decodeFile(src *configSource) error {
+	if src.path == "" {
+		return nil
+	}
+
+	if _, err := os.Stat(src.path); os.IsNotExist(err) && !src.required {
+		return nil
+	}
+
+	md, err := toml.DecodeFile(src.path, cfg)
+	if err != nil {
+		return fmt.Errorf("%s: %s", src.path, err.Error())
+	}
+
+	//most likely a typo, which would otherwise go unnoticed
+	if keys := md.Undecoded(); len(keys) > 0 {
+		return fmt.Errorf("%s: unknown setting %s", src.path, keys[0].String())
+	}
+
+	return nil
+}
+
+func (cfg *agentConfig) applyEnv() error {
+	for _, o := range overrides {
+		v := os.Getenv(o.env)
+		if v == "" {
+			continue
+		}
+
+		if err := o.set(cfg, v); err != nil {
+			return fmt.Errorf("%s: %s", o.env, err.Error())
+		}
+	}
+
+	return nil
+}
+
+func (o *override) set(cfg *agentConfig, v string) error {
+	switch field := o.field(cfg).(type) {
+	case *string:
+		*field = v
+
+	case *int:
+		n, err := strconv.Atoi(strings.TrimSpace(v))
+		if err != nil {
+			return err
+		}
+		*field = n
+
+	case *bool:
+		b, err := strconv.ParseBool(v)
+		if err != nil {
+			return err
+		}
+		*field = b
+
+	case *duration:
+		return field.UnmarshalText([]byte(v))
+
+	case *[]string:
+		*field = o.split(v)
+	}
+
+	return nil
+}
+
+//check the settings and work out what the rest of the agent uses
+func (cfg *agentConfig) prepare() error {
+	var err error
+
+	cfg.listen, err = newListenConfig(cfg.Listen.Address, cfg.Listen.Port, cfg.Listen.PortRange, cfg.Listen.Tls)
+	if err != nil {
+		return err
+	}
+
+	cfg.origins = parseOrigins(cfg.Origins.Allowed)
+
+	if cfg.Pool.MaxOpenConns < 0 || cfg.Pool.MaxIdleConns < 0 {
+		return errors.New("pool: connection limits can't be negative")
+	}
+
+	timeouts := map[string]duration{
+		"session-idle":         cfg.Timeouts.SessionIdle,
+		"cursor-idle":          cfg.Timeouts.CursorIdle,
+		"download-ttl":         cfg.Timeouts.DownloadTtl,
+		"export-job-retention": cfg.Timeouts.ExportJobRetention,
+	}
+	for k, d := range timeouts {
+		if d.Duration <= 0 {
+			return fmt.Errorf("timeouts.%s: must be positive", k)
+		}
+	}
+
+	if cfg.Fetch.BatchRows <= 0 || cfg.Fetch.BatchBytes <= 0 {
+		return errors.New("fetch: batch sizes must be positive")
+	}
+
+	cfg.level, err = log.ParseLevel(cfg.Log.Level)
+	if err != nil {
+		return fmt.Errorf("log.level: %s", err.Error())
+	}
+
+	cfg.export, err = newExportConfig(cfg.Export.Dir, cfg.Export.AllowedDirs, cfg.Export.Template, cfg.Export.OnCollision)
+	if err != nil {
+		return fmt.Errorf("export.on-collision: %s", err.Error())
+	}
+
+	return nil
+}
+
+//load the file given on startup, called by main
+func initConfig(args []string) (*agentConfig, error) {
+	src, err := parseFlags(args)
+	if err != nil {
+		return nil, err
+	}
+
+	cfg, err := loadConfig(src)
+	if err != nil {
+		return nil, err
+	}
+
+	source = src
+	setConfig(cfg)
+	log.SetLevel(cfg.level)
+
+	return cfg, nil
+}
+
+//on SIGHUP. The agent keeps listening where it is
+func reloadConfig() {
+	cfg, err := loadConfig(source)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"error": err.Error(),
+		}).Info("Unable to reload configuration")
+		return
+	}
+
+	old := getConfig()
+	if !reflect.DeepEqual(cfg.Listen, old.Listen) {
+		log.Info("Listen settings take effect on restart")
+		cfg.Listen = old.Listen
+		cfg.listen = old.listen
+	}
+
+	setConfig(cfg)
+	log.SetLevel(cfg.level)
+
+	log.WithFields(log.Fields{
+		"file": source.path,
+	}).Info("Configuration reloaded")
+}
@@ -0,0 +1,477 @@
+/* Copyright (C) 2021 Pankaj Kargirwar <kargirwar@protonmail.com>
+
+   This file is part of prosql-agent
+
+   prosql-agent is free software: you can redistribute it and/or modify
+   it under the terms of the GNU General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   prosql-agent is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU General Public License for more details.
+
+   You should have received a copy of the GNU General Public License
+   along with prosql-agent.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+/* A pinned session reserves one connection from the pool and runs every
+cursor on it, so that USE, session variables, temporary tables and locks
+behave as they do in a console. A connection can serve only one cursor at a
+time, so the primary connection is held from the moment a cursor starts
+until its rows are closed. Optional read connections let read only queries
+run in parallel while the primary is busy. They follow the default database
+of the primary, but once a statement gives the primary state they can't
+share (SET, temporary tables, locks ...) every cursor runs on the primary.
+A connection the driver dropped is replaced on its next use. The statement
+fails with ERR_SESSION_STATE_LOST so the client knows its state is gone */
+
+package main
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"strings"
+	"sync"
+
+	"github.com/go-sql-driver/mysql"
+	"github.com/kargirwar/prosql-agent/utils"
+)
+
+//anything a cursor can run statements on: *sql.DB, *sql.Conn or *sql.Tx
+type dbConn interface {
+	QueryContext(ctx context.Context, query string, args ...interface{}) (*sql.Rows, error)
+	ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error)
+}
+
+type connSet struct {
+	pool        *sql.DB
+	mutex       sync.Mutex
+	primary     *sql.Conn
+	primaryLock chan struct{}
+	reads       []*sql.Conn
+	readDbs     []string //database each read connection is on
+	free        chan int //indexes into reads
+	db          string   //database of the primary
+	private     bool     //primary has state the read connections don't share
+}
+
+func newConnSet(ctx context.Context, pool *sql.DB, readConns int, db string) (*connSet, error) {
+	if readConns < 0 || readConns > MAX_READ_CONNS {
+		return nil, errors.New(ERR_INVALID_READ_CONNS)
+	}
+
+	primary, err := pool.Conn(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	cs := &connSet{
+		pool:        pool,
+		primary:     primary,
+		primaryLock: make(chan struct{}, 1),
+		free:        make(chan int, readConns),
+		db:          db,
+	}
+
+	for i := 0; i < readConns; i++ {
+		conn, err := pool.Conn(ctx)
+		if err != nil {
+			cs.close()
+			return nil, err
+		}
+
+		cs.reads = append(cs.reads, conn)
+		cs.readDbs = append(cs.readDbs, db)
+		cs.free <- i
+	}
+
+	return cs, nil
+}
+
+//wait for a connection. Read only queries may use a read connection if the
+//primary is busy, everything else needs the primary
+func (cs *connSet) acquire(ctx context.Context, cctx context.Context, read bool) (*sql.Conn, func(), error) {
+	//prefer the primary if it is free right now
+	select {
+	case cs.primaryLock <- struct{}{}:
+		return cs.getPrimary(), cs.releasePrimary, nil
+	default:
+	}
+
+	var free chan int
+	if read && cs.canShare() {
+		//nil channel blocks forever, so this is skipped if there are no read conns
+		free = cs.free
+		if len(cs.reads) == 0 {
+			free = nil
+		}
+	}
+
+	select {
+	case cs.primaryLock <- struct{}{}:
+		return cs.getPrimary(), cs.releasePrimary, nil
+
+	case i := <-free:
+		conn, err := cs.getRead(ctx, i)
+		if err != nil {
+			cs.free <- i
+			return nil, nil, err
+		}
+		return conn, func() { cs.free <- i }, nil
+
+	case <-ctx.Done():
+		return nil, nil, ctx.Err()
+
+	case <-cctx.Done():
+		return nil, nil, cctx.Err()
+	}
+}
+
+//must be called with primaryLock held
+func (cs *connSet) getPrimary() *sql.Conn {
+	cs.mutex.Lock()
+	defer cs.mutex.Unlock()
+
+	return cs.primary
+}
+
+func (cs *connSet) isPrimary(conn *sql.Conn) bool {
+	return conn == cs.getPrimary()
+}
+
+//read connection i, switched to the database of the primary if that has
+//changed since it was last used
+func (cs *connSet) getRead(ctx context.Context, i int) (*sql.Conn, error) {
+	cs.mutex.Lock()
+	conn, db, current := cs.reads[i], cs.readDbs[i], cs.db
+	cs.mutex.Unlock()
+
+	if db == current {
+		return conn, nil
+	}
+
+	if _, err := conn.ExecContext(ctx, "use "+quoteIdentifier(current)); err != nil {
+		return nil, cs.check(ctx, conn, err)
+	}
+
+	cs.mutex.Lock()
+	cs.readDbs[i] = current
+	cs.mutex.Unlock()
+
+	return conn, nil
+}
+
+func (cs *connSet) releasePrimary() {
+	<-cs.primaryLock
+}
+
+func (cs *connSet) canShare() bool {
+	cs.mutex.Lock()
+	defer cs.mutex.Unlock()
+
+	return !cs.private
+}
+
+//the primary now has state the read connections can't have. It stays
+//that way until the primary is replaced
+func (cs *connSet) setPrivate() {
+	cs.mutex.Lock()
+	defer cs.mutex.Unlock()
+
+	cs.private = true
+}
+
+//the primary switched to db. Read connections follow when next used. There
+//is no USE which leaves a connection without a database, so if db is empty
+//they can't
+func (cs *connSet) setDb(db string) {
+	cs.mutex.Lock()
+	defer cs.mutex.Unlock()
+
+	cs.db = db
+	if db == "" {
+		cs.private = true
+	}
+}
+
+//err is what a statement on conn returned. A connection the driver has
+//dropped is replaced. Losing the primary loses the session state, which
+//is reported as ERR_SESSION_STATE_LOST. Read connections only carry the
+//database, so for them the original error is good enough
+func (cs *connSet) check(ctx context.Context, conn *sql.Conn, err error) error {
+	if !isBadConn(err) {
+		return err
+	}
+
+	primary, rerr := cs.replace(ctx, conn)
+	if rerr != nil {
+		utils.Dbg(ctx, "could not replace dead connection: "+rerr.Error())
+		return err
+	}
+
+	if primary {
+		return errors.New(ERR_SESSION_STATE_LOST)
+	}
+
+	return err
+}
+
+//swap conn for a fresh connection on the database of the primary. Must be
+//called by whoever holds conn
+func (cs *connSet) replace(ctx context.Context, conn *sql.Conn) (bool, error) {
+	cs.mutex.Lock()
+	db := cs.db
+	cs.mutex.Unlock()
+
+	fresh, err := cs.pool.Conn(ctx)
+	if err != nil {
+		return false, err
+	}
+
+	if db != "" {
+		if _, err := fresh.ExecContext(ctx, "use "+quoteIdentifier(db)); err != nil {
+			fresh.Close()
+			return false, err
+		}
+	}
+
+	utils.Dbg(ctx, "replacing dead connection")
+	conn.Close()
+
+	cs.mutex.Lock()
+	defer cs.mutex.Unlock()
+
+	if conn == cs.primary {
+		cs.primary = fresh
+		cs.private = db == ""
+		return true, nil
+	}
+
+	for i, c := range cs.reads {
+		if c == conn {
+			cs.reads[i] = fresh
+			cs.readDbs[i] = db
+		}
+	}
+
+	return false, nil
+}
+
+//wait until every connection is free and lock all of them. Used for
+//statements which must apply to the whole session like USE
+func (cs *connSet) acquireAll(ctx context.Context) ([]*sql.Conn, func(), error) {
+	select {
+	case cs.primaryLock <- struct{}{}:
+	case <-ctx.Done():
+		return nil, nil, ctx.Err()
+	}
+
+	var held []int
+	release := func() {
+		for _, i := range held {
+			cs.free <- i
+		}
+		cs.releasePrimary()
+	}
+
+	for range cs.reads {
+		select {
+		case i := <-cs.free:
+			held = append(held, i)
+		case <-ctx.Done():
+			release()
+			return nil, nil, ctx.Err()
+		}
+	}
+
+	cs.mutex.Lock()
+	defer cs.mutex.Unlock()
+
+	conns := append([]*sql.Conn{cs.primary}, cs.reads...)
+	return conns, release, nil
+}
+
+//every connection switched to db. Must be called with all of them held
+func (cs *connSet) setAllDb(db string) {
+	cs.mutex.Lock()
+	defer cs.mutex.Unlock()
+
+	cs.db = db
+	for i := range cs.readDbs {
+		cs.readDbs[i] = db
+	}
+}
+
+func (cs *connSet) close() {
+	cs.mutex.Lock()
+	defer cs.mutex.Unlock()
+
+	for _, c := range cs.reads {
+		c.Close()
+	}
+
+	if cs.primary != nil {
+		cs.primary.Close()
+	}
+}
+
+//close conn without giving it back to the pool. Whatever state it has must
+//not turn up in statements which happen to get it next
+func discardConn(conn *sql.Conn) {
+	conn.Raw(func(interface{}) error {
+		return driver.ErrBadConn
+	})
+}
+
+func isBadConn(err error) bool {
+	return errors.Is(err, driver.ErrBadConn) || errors.Is(err, sql.ErrConnDone) ||
+		errors.Is(err, mysql.ErrInvalidConn)
+}
+
+//==============================================================//
+//         Statement classification
+//==============================================================//
+
+//statements which can run on a read connection: they read, and they don't
+//depend on anything but the default database. Anything unsure goes to
+//the primary
+func isReadOnly(query string) bool {
+	words := leadingWords(query, 1)
+	if len(words) == 0 || isMultiStatement(query) || readsSessionState(query) {
+		return false
+	}
+
+	switch words[0] {
+	case "SELECT", "WITH", "SHOW", "DESC", "DESCRIBE", "EXPLAIN", "TABLE", "VALUES":
+		return true
+	}
+
+	return false
+}
+
+//statements which leave state on their connection that read connections
+//would not see. That includes a USE which usedDb can't make sense of
+func keepsPrivateState(query string) bool {
+	words := leadingWords(query, 2)
+	if len(words) == 0 || isMultiStatement(query) {
+		return true
+	}
+
+	switch words[0] {
+	case "USE", "SET", "LOCK", "PREPARE", "EXECUTE", "CALL", "HANDLER", "BEGIN", "START", "XA", "DO":
+		return true
+
+	case "CREATE":
+		return len(words) > 1 && words[1] == "TEMPORARY"
+
+	case "SELECT", "WITH", "VALUES", "TABLE":
+		return writesSessionState(query)
+	}
+
+	return false
+}
+
+//the database a USE statement switches to
+func usedDb(query string) (string, bool) {
+	word, end := nextWord(query, 0)
+	if !strings.EqualFold(word, "USE") || isMultiStatement(query) {
+		return "", false
+	}
+
+	db := strings.TrimSpace(strings.TrimRight(query[end:], "; \t\r\n"))
+
+	switch {
+	case len(db) >= 2 && db[0] == '`' && db[len(db)-1] == '`':
+		return strings.ReplaceAll(db[1:len(db)-1], "``", "`"), true
+
+	case db == "" || strings.ContainsAny(db, "`'\" \t\r\n/*#"):
+		return "", false
+	}
+
+	return db, true
+}
+
+//variables and functions whose result depends on the connection
+func readsSessionState(query string) bool {
+	return writesSessionState(query) ||
+		containsAny(strings.ToUpper(query), "@", "LAST_INSERT_ID", "FOUND_ROWS", "ROW_COUNT", "CONNECTION_ID")
+}
+
+//queries which assign variables or take locks
+func writesSessionState(query string) bool {
+	return containsAny(strings.ToUpper(query), ":=", "INTO", "GET_LOCK", "FOR UPDATE", "FOR SHARE",
+		"LOCK IN SHARE MODE")
+}
+
+func containsAny(s string, subs ...string) bool {
+	for _, sub := range subs {
+		if strings.Contains(s, sub) {
+			return true
+		}
+	}
+
+	return false
+}
+
+//another statement follows a ; . May be a ; in a string, which errs on the
+//safe side
+func isMultiStatement(query string) bool {
+	return strings.Contains(strings.TrimRight(query, "; \t\r\n"), ";")
+}
+
+//first n keywords of query in upper case
+func leadingWords(query string, n int) []string {
+	var words []string
+
+	for i := 0; len(words) < n; {
+		word, end := nextWord(query, i)
+		if word == "" {
+			break
+		}
+
+		words = append(words, strings.ToUpper(word))
+		i = end
+	}
+
+	return words
+}
+
+//the word starting at or after i, skipping comments and opening
+//parentheses, and the index just past it. Empty if something else comes
+//first
+func nextWord(query string, i int) (string, int) {
+	line := 0
+
+	for i < len(query) {
+		c := query[i]
+
+		switch {
+		case c == ' ' || c == '\t' || c == '\r' || c == '\n' || c == '(':
+			i++
+
+		case c == '#' || isDashComment(query[i:]):
+			i = skipLine(query, i)
+
+		case strings.HasPrefix(query[i:], "/*") && !strings.HasPrefix(query[i:], "/*!"):
+			i = skipBlockComment(query, i, &line)
+
+		default:
+			j := i
+			for j < len(query) && isWordByte(query[j]) {
+				j++
+			}
+
+			return query[i:j], j
+		}
+	}
+
+	return "", i
+}
+
+func isWordByte(c byte) bool {
+	return c == '_' || (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') || (c >= '0' && c <= '9')
+}
@@ -0,0 +1,84 @@
+/* Copyright (C) 2021 Pankaj Kargirwar <kargirwar@protonmail.com>
+
+   This file is part of prosql-agent
+
+   prosql-agent is free software: you can redistribute it and/or modify
+   it under the terms of the GNU General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   prosql-agent is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU General Public License for more details.
+
+   You should have received a copy of the GNU General Public License
+   along with prosql-agent.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import "testing"
+
+func TestStatementClassification(t *testing.T) {
+	tests := []struct {
+		query    string
+		readOnly bool
+		private  bool
+	}{
+		{"select * from t", true, false},
+		{"  /* hint */ (SELECT 1) union (select 2)", true, false},
+		{"-- note\nshow tables", true, false},
+		{"with x as (select 1) select * from x", true, false},
+		{"select @a", false, false},
+		{"select last_insert_id()", false, false},
+		{"select 1 into @a", false, true},
+		{"select @a := 1", false, true},
+		{"select get_lock('x', 1)", false, true},
+		{"select * from t for update", false, true},
+		{"select 1; set @a = 1", false, true},
+		{"insert into t values (1)", false, false},
+		{"create table t (id int)", false, false},
+		{"create temporary table t (id int)", false, true},
+		{"set names utf8mb4", false, true},
+		{"lock tables t read", false, true},
+		{"call p()", false, true},
+		{"use test -- where the tables are", false, true},
+		{"", false, true},
+	}
+
+	for _, tt := range tests {
+		if got := isReadOnly(tt.query); got != tt.readOnly {
+			t.Errorf("isReadOnly(%q) = %t want %t\n", tt.query, got, tt.readOnly)
+		}
+
+		if got := keepsPrivateState(tt.query); got != tt.private {
+			t.Errorf("keepsPrivateState(%q) = %t want %t\n", tt.query, got, tt.private)
+		}
+	}
+}
+
+func TestUsedDb(t *testing.T) {
+	tests := []struct {
+		query string
+		db    string
+		ok    bool
+	}{
+		{"use test", "test", true},
+		{"USE test;", "test", true},
+		{"use `my db`", "my db", true},
+		{"use `a``b`", "a`b", true},
+		{"/* because */ use test", "test", true},
+		{"user", "", false},
+		{"use test; select 1", "", false},
+		{"use 'test'", "", false},
+		{"select 1", "", false},
+	}
+
+	for _, tt := range tests {
+		db, ok := usedDb(tt.query)
+		if db != tt.db || ok != tt.ok {
+			t.Errorf("usedDb(%q) = %q, %t want %q, %t\n", tt.query, db, ok, tt.db, tt.ok)
+		}
+	}
+}
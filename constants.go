@@ -22,22 +22,98 @@ import "time"
 
 //build options
 var VERSION = "0.6.3"
-var ALLOW = "https://prosql.io"
+var ALLOW = "https://prosql.io" //allowed origins unless configured
 var OS = "OS"
 
 const APP_NAME = "prosql-agent"
 const PORT = 23890
 
+//defaults of what config.toml may set, see config.go
+
 //pool
 const MAX_OPEN_CONNS = 500
 const MAX_IDLE_CONNS = 100
 const MAX_IDLE_CONNS_AT_START = 10
 
+//extra connections a pinned session may reserve for parallel reads
+const MAX_READ_CONNS = 8
+
 const BATCH_SIZE = 5000
 
+//NULL in exported files unless the client asks for something else
+const DEFAULT_NULL_TOKEN = "NULL"
+
+//row formats for fetch. pairs is the original [name, value, ...] row,
+//compact sends names once and rows as plain value arrays
+const FORMAT_PAIRS = "pairs"
+const FORMAT_COMPACT = "compact"
+
+//a compact batch is sent when either limit is reached
+const DEFAULT_BATCH_ROWS = 500
+const DEFAULT_BATCH_BYTES = 64 << 10
+
+//encodings of the fetch_ws stream. json is text, the others are binary
+const ENCODING_JSON = "json"
+const ENCODING_MSGPACK = "msgpack"
+const ENCODING_CBOR = "cbor"
+
+//export file formats
+const EXPORT_CSV = "csv"
+const EXPORT_TSV = "tsv"
+const EXPORT_JSON = "json"
+const EXPORT_NDJSON = "ndjson"
+const EXPORT_SQL = "sql"
+const EXPORT_MARKDOWN = "markdown"
+const EXPORT_XLSX = "xlsx"
+
+//what to do when an export file already exists
+const COLLISION_SUFFIX = "suffix"
+const COLLISION_OVERWRITE = "overwrite"
+const COLLISION_FAIL = "fail"
+
+//compression of export files
+const COMPRESS_GZIP = "gzip"
+const COMPRESS_ZIP = "zip"
+
+//POST bodies carry full scripts, so allow a lot more than a URL would
+const MAX_REQUEST_BODY_SIZE = 32 << 20
+
+//idle sessions and cursors are cleaned up after these
 const SESSION_CLEANUP_INTERVAL = 20 * time.Minute
 const CURSOR_CLEANUP_INTERVAL = 1 * time.Minute
 
+const DEFAULT_LOG_LEVEL = "debug"
+
+//how long an export stays available on /download
+const DOWNLOAD_TTL = 30 * time.Minute
+const DOWNLOAD_CLEANUP_INTERVAL = 1 * time.Minute
+
+//pairing codes, see pairing.go. After PAIRING_MAX_FAILURES wrong codes
+//pairing is refused for PAIRING_LOCKOUT
+const PAIRING_CODE_LEN = 6
+const PAIRING_CODE_TTL = 5 * time.Minute
+const PAIRING_MAX_FAILURES = 5
+const PAIRING_LOCKOUT = 1 * time.Minute
+
+//how long a ticket for a websocket or download stays valid
+const PAIRING_TICKET_TTL = 30 * time.Second
+
+//master passphrase of saved profiles, see profiles.go. Argon2id takes
+//ARGON2_MEMORY KiB
+const MIN_PASSPHRASE_LEN = 8
+const ARGON2_TIME = 3
+const ARGON2_MEMORY = 64 << 10
+const ARGON2_THREADS = 4
+
+//finished export jobs are listed this long
+const EXPORT_JOB_RETENTION = 30 * time.Minute
+
+//export job states
+const JOB_RUNNING = "running"
+const JOB_DONE = "done"
+const JOB_FAILED = "failed"
+const JOB_CANCELLED = "cancelled"
+
 //error codes
 const ERR_INVALID_USER_INPUT = "invalid-user-input"
 const ERR_INVALID_SESSION_ID = "invalid-session-id"
@@ -46,16 +122,63 @@ const ERR_UNRECOVERABLE = "unrecoverable-error"
 const ERR_INVALID_CURSOR_ID = "invalid-cursor-id"
 const ERR_NO_DATA = "no-data"
 const ERR_INVALID_CURSOR_CMD = "invalid-cursor-cmd"
+const ERR_INVALID_READ_CONNS = "invalid-read-conns"
+const ERR_SESSION_STATE_LOST = "session-state-lost"
+const ERR_TX_OPEN = "transaction-already-open"
+const ERR_NO_TX = "no-open-transaction"
+const ERR_TX_CLOSED = "transaction-closed"
+const ERR_INVALID_SAVEPOINT = "invalid-savepoint"
+const ERR_INVALID_CMD = "invalid-cmd"
+const ERR_INVALID_FORMAT = "invalid-format"
+const ERR_INVALID_BATCH_SIZE = "invalid-batch-size"
+const ERR_INVALID_ENCODING = "invalid-encoding"
+const ERR_INVALID_EXPORT_FORMAT = "invalid-export-format"
+const ERR_INVALID_EXPORT_PATH = "invalid-export-path"
+const ERR_INVALID_COLLISION = "invalid-collision-policy"
+const ERR_EXPORT_FILE_EXISTS = "export-file-exists"
+const ERR_INVALID_CSV_OPTION = "invalid-csv-option"
+const ERR_INVALID_COMPRESSION = "invalid-compression"
+const ERR_INVALID_SPLIT = "invalid-split"
+const ERR_INVALID_DOWNLOAD_TOKEN = "invalid-download-token"
+const ERR_DOWNLOAD_NOT_READY = "download-not-ready"
+const ERR_INVALID_JOB_ID = "invalid-job-id"
+const ERR_JOB_NOT_RUNNING = "job-not-running"
+const ERR_JOB_CANCELLED = "job-cancelled"
+const ERR_JOB_DETACHED = "job-detached"
+const ERR_INVALID_ON_ERROR = "invalid-on-error"
+const ERR_UNEXPECTED_RESPONSE = "unexpected-response"
+const ERR_UNAUTHORIZED = "unauthorized"
+const ERR_INVALID_PAIRING_CODE = "invalid-pairing-code"
+const ERR_PAIRING_LOCKED = "pairing-locked"
+const ERR_INVALID_TOKEN_ID = "invalid-token-id"
+const ERR_INVALID_ORIGIN = "invalid-origin"
+const ERR_ORIGIN_NOT_ALLOWED = "origin-not-allowed"
+const ERR_INVALID_PROFILE_ID = "invalid-profile-id"
+const ERR_PROFILES_LOCKED = "profiles-locked"
+const ERR_WRONG_PASSPHRASE = "wrong-passphrase"
+const ERR_WEAK_PASSPHRASE = "weak-passphrase"
+const ERR_TUNNEL_HOST_KEY = "tunnel-host-key-mismatch"
 const EOF = "eof"
 
 //commands
 const CMD_QUERY = "query"
 const CMD_EXECUTE = "execute"
+const CMD_SCRIPT = "script"
 const CMD_FETCH = "fetch"
 const CMD_FETCH_WS = "fetch-ws"
 const CMD_CANCEL = "cancel"
 const CMD_CLEANUP = "cleanup"
 const CMD_SET_DB = "set-db"
+const CMD_TX_BEGIN = "tx-begin"
+const CMD_TX_COMMIT = "tx-commit"
+const CMD_TX_ROLLBACK = "tx-rollback"
+const CMD_TX_SAVEPOINT = "tx-savepoint"
+const CMD_TX_ROLLBACK_TO = "tx-rollback-to"
+const CMD_TX_RELEASE = "tx-release"
+const CMD_TX_STATUS = "tx-status"
+const CMD_EXPORT_JOBS = "export-jobs"
+const CMD_EXPORT_CANCEL = "export-cancel"
+const CMD_EXPORT_ATTACH = "export-attach"
 
 //statuses
 const SUCCESS = "success"
@@ -0,0 +1,249 @@
+/* Copyright (C) 2021 Pankaj Kargirwar <kargirwar@protonmail.com>
+
+   This file is part of prosql-agent
+
+   prosql-agent is free software: you can redistribute it and/or modify
+   it under the terms of the GNU General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   prosql-agent is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU General Public License for more details.
+
+   You should have received a copy of the GNU General Public License
+   along with prosql-agent.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+/* Dialect of csv and tsv exports:
+
+delimiter        one character, "," for csv and tab for tsv by default
+quote-all        quote every value. NULL stays unquoted so that it can be
+                 told apart from a string
+line-ending      lf (default) or crlf
+bom              start the file with a UTF-8 byte order mark
+no-header        leave out the row of column names
+null             text written for NULL, "NULL" by default
+date-format      strftime style format of DATE values
+datetime-format  strftime style format of DATETIME and TIMESTAMP values
+
+Formats understand %Y %y %m %d %H %I %M %S %f %p %b %B %a %A %j and %%.
+Values which don't parse as dates, like 0000-00-00, are written as is */
+
+package main
+
+import (
+	"bufio"
+	"errors"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+	"unicode/utf8"
+)
+
+const LINE_ENDING_LF = "lf"
+const LINE_ENDING_CRLF = "crlf"
+
+const utf8Bom = "\xef\xbb\xbf"
+
+//how MySQL sends dates and times as text
+const mysqlDate = "2006-01-02"
+const mysqlDateTime = "2006-01-02 15:04:05.999999"
+
+func checkCsvDialect(opts *FetchOptions) error {
+	if opts.Delimiter != "" {
+		r, size := utf8.DecodeRuneInString(opts.Delimiter)
+		if size != len(opts.Delimiter) || r == utf8.RuneError ||
+			r == '"' || r == '\r' || r == '\n' {
+			return errors.New(ERR_INVALID_CSV_OPTION)
+		}
+	}
+
+	switch opts.LineEnding {
+	case "", LINE_ENDING_LF, LINE_ENDING_CRLF:
+	default:
+		return errors.New(ERR_INVALID_CSV_OPTION)
+	}
+
+	for _, f := range []string{opts.DateFormat, opts.DateTimeFormat} {
+		if err := checkTimeFormat(f); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+//delimited text writer. encoding/csv can't quote every field
+type csvWriter struct {
+	w        *bufio.Writer
+	comma    rune
+	quoteAll bool
+	eol      string
+}
+
+func newCsvWriter(w io.Writer, comma rune, opts FetchOptions) *csvWriter {
+	cw := &csvWriter{
+		w:        bufio.NewWriter(w),
+		comma:    comma,
+		quoteAll: opts.QuoteAll,
+		eol:      "\n",
+	}
+
+	if opts.Delimiter != "" {
+		cw.comma, _ = utf8.DecodeRuneInString(opts.Delimiter)
+	}
+
+	if opts.LineEnding == LINE_ENDING_CRLF {
+		cw.eol = "\r\n"
+	}
+
+	if opts.Bom {
+		cw.w.WriteString(utf8Bom)
+	}
+
+	return cw
+}
+
+//write one record. Fields whose null is set are never quoted
+func (cw *csvWriter) write(fields []string, null []bool) error {
+	for i, f := range fields {
+		if i > 0 {
+			cw.w.WriteRune(cw.comma)
+		}
+
+		isNull := null != nil && null[i]
+		if isNull || !(cw.quoteAll || cw.needsQuotes(f)) {
+			cw.w.WriteString(f)
+			continue
+		}
+
+		cw.w.WriteByte('"')
+		cw.w.WriteString(strings.ReplaceAll(f, `"`, `""`))
+		cw.w.WriteByte('"')
+	}
+
+	_, err := cw.w.WriteString(cw.eol)
+	return err
+}
+
+//same rules as encoding/csv
+func (cw *csvWriter) needsQuotes(f string) bool {
+	if f == "" {
+		return false
+	}
+
+	if f == `\.` || strings.ContainsRune(f, cw.comma) || strings.ContainsAny(f, "\"\r\n") {
+		return true
+	}
+
+	r, _ := utf8.DecodeRuneInString(f)
+	return unicode.IsSpace(r)
+}
+
+func (cw *csvWriter) flush() error {
+	return cw.w.Flush()
+}
+
+//format of the values of a column, empty if they are written as is
+func timeFormatOf(m *ColumnMeta, opts FetchOptions) (layout string, format string) {
+	switch m.Type {
+	case "DATE":
+		return mysqlDate, opts.DateFormat
+	case "DATETIME", "TIMESTAMP":
+		return mysqlDateTime, opts.DateTimeFormat
+	}
+
+	return "", ""
+}
+
+//reformat a date sent by MySQL
+func reformatTime(s string, layout string, format string) string {
+	t, err := time.Parse(layout, s)
+	if err != nil {
+		return s
+	}
+
+	return formatTime(t, format)
+}
+
+func checkTimeFormat(format string) error {
+	for i := 0; i < len(format); i++ {
+		if format[i] != '%' {
+			continue
+		}
+
+		i++
+		if i == len(format) || !strings.ContainsRune("YymdHIMSfpbBaAj%", rune(format[i])) {
+			return errors.New(ERR_INVALID_CSV_OPTION)
+		}
+	}
+
+	return nil
+}
+
+//strftime, for the directives checkTimeFormat lets through
+func formatTime(t time.Time, format string) string {
+	var b strings.Builder
+
+	pad := func(n int, width int) {
+		s := strconv.Itoa(n)
+		for i := len(s); i < width; i++ {
+			b.WriteByte('0')
+		}
+		b.WriteString(s)
+	}
+
+	for i := 0; i < len(format); i++ {
+		c := format[i]
+		if c != '%' || i+1 == len(format) {
+			b.WriteByte(c)
+			continue
+		}
+
+		i++
+		switch format[i] {
+		case 'Y':
+			pad(t.Year(), 4)
+		case 'y':
+			pad(t.Year()%100, 2)
+		case 'm':
+			pad(int(t.Month()), 2)
+		case 'd':
+			pad(t.Day(), 2)
+		case 'H':
+			pad(t.Hour(), 2)
+		case 'I':
+			h := t.Hour() % 12
+			if h == 0 {
+				h = 12
+			}
+			pad(h, 2)
+		case 'M':
+			pad(t.Minute(), 2)
+		case 'S':
+			pad(t.Second(), 2)
+		case 'f':
+			pad(t.Nanosecond()/1000, 6)
+		case 'p':
+			b.WriteString(t.Format("PM"))
+		case 'b':
+			b.WriteString(t.Format("Jan"))
+		case 'B':
+			b.WriteString(t.Month().String())
+		case 'a':
+			b.WriteString(t.Format("Mon"))
+		case 'A':
+			b.WriteString(t.Weekday().String())
+		case 'j':
+			pad(t.YearDay(), 3)
+		default:
+			b.WriteByte(format[i])
+		}
+	}
+
+	return b.String()
+}
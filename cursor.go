@@ -19,12 +19,8 @@
 package main
 
 import (
-	"encoding/csv"
 	"encoding/json"
 	"fmt"
-	"os"
-	"path/filepath"
-	"runtime"
 	"strconv"
 	"time"
 
@@ -54,9 +50,16 @@ type cursor struct {
 	err        error
 	query      string
 	execute    bool
+	release    func()       //gives back the connection the cursor is running on
+	keepConn   bool         //the connection must outlive the cursor, see discard
+	tx         *transaction //transaction open when the cursor was created
+	conn       *sql.Conn    //of the script the cursor belongs to, if set
+	columns    []*ColumnMeta
+	headerSent bool //column metadata has been sent to the client
+	resultSet  int  //index of the current result set
 }
 
-func (pc *cursor) start(ctx context.Context, db *sql.DB) error {
+func (pc *cursor) start(ctx context.Context, s *session) error {
 	defer utils.TimeTrack(ctx, time.Now())
 
 	pc.mutex.Lock()
@@ -67,43 +70,158 @@ func (pc *cursor) start(ctx context.Context, db *sql.DB) error {
 		return nil
 	}
 
+	db, release, err := s.acquire(ctx, pc)
+	if err != nil {
+		pc.err = err
+		return err
+	}
+
 	utils.Dbg(ctx, "Starting query: "+pc.query)
 
 	rows, err := db.QueryContext(pc.ctx, pc.query)
 	if err != nil {
+		err = s.checkConn(ctx, pc, db, err)
+		release()
 		pc.err = err
 		return err
 	}
 
 	utils.Dbg(ctx, "Done query: "+pc.query)
 
+	s.track(pc, db)
+
 	pc.rows = rows
+	pc.release = release
+	pc.keepConn = s.isPinned() || pc.tx != nil || pc.conn != nil
+
+	//the connection stays with this cursor until the rows are closed
+	//either by clearing the cursor or by cancelling it
+	go func() {
+		<-pc.ctx.Done()
+		pc.close()
+	}()
+
 	return nil
 }
 
-func (pc *cursor) exec(ctx context.Context, db *sql.DB) (int64, error) {
+//close and cancel. Cancelling a cursor with open rows makes the driver drop
+//the connection, which a pinned session or a transaction cannot afford.
+//Their rows are closed first, which reads whatever is left of them
+func (pc *cursor) discard() {
+	pc.mutex.Lock()
+	keep := pc.keepConn
+	pc.mutex.Unlock()
+
+	if keep {
+		pc.close()
+	}
+	pc.cancel()
+}
+
+//close rows if open and give back the connection. Safe to call more than once
+func (pc *cursor) close() {
+	pc.mutex.Lock()
+	defer pc.mutex.Unlock()
+
+	if pc.rows != nil {
+		pc.rows.Close()
+	}
+
+	if pc.release != nil {
+		pc.release()
+		pc.release = nil
+	}
+}
+
+func (pc *cursor) exec(ctx context.Context, s *session) (*ExecuteResult, error) {
 	defer utils.TimeTrack(ctx, time.Now())
 
 	pc.mutex.Lock()
 	defer pc.mutex.Unlock()
 
+	db, release, err := s.acquire(ctx, pc)
+	if err != nil {
+		pc.err = err
+		return nil, err
+	}
+	defer release()
+
+	//warnings must be read on the connection the statement ran on
+	if pool, ok := db.(*sql.DB); ok {
+		conn, err := pool.Conn(pc.ctx)
+		if err != nil {
+			pc.err = err
+			return nil, err
+		}
+		defer conn.Close()
+		db = conn
+	}
+
 	utils.Dbg(ctx, "Starting query: "+pc.query)
 
 	result, err := db.ExecContext(pc.ctx, pc.query)
 	if err != nil {
+		err = s.checkConn(ctx, pc, db, err)
 		pc.err = err
-		return -1, err
+		return nil, err
 	}
 
 	utils.Dbg(ctx, "Done query: "+pc.query)
 
-	rows, err := result.RowsAffected()
+	s.track(pc, db)
+
+	r, err := newExecuteResult(result, s.foundRows)
 	if err != nil {
 		pc.err = err
-		return -1, err
+		return nil, err
+	}
+
+	r.readWarnings(pc.ctx, db)
+
+	return r, nil
+}
+
+//column metadata of the current result, read once
+func (pc *cursor) columnMeta() ([]*ColumnMeta, error) {
+	if pc.columns != nil {
+		return pc.columns, nil
+	}
+
+	cols, err := getColumnMeta(pc.rows)
+	if err != nil {
+		return nil, err
+	}
+
+	pc.columns = cols
+	return cols, nil
+}
+
+//move on to the next result set, if any. Column metadata is read and
+//sent again for it
+func (pc *cursor) nextResultSet() bool {
+	if !pc.rows.NextResultSet() {
+		return false
+	}
+
+	pc.resultSet++
+	pc.columns = nil
+	pc.headerSent = false
+	return true
+}
+
+//called after reading a batch of read rows out of the n asked for. A short
+//batch means the result set is done: setEnd if another one follows, eof
+//if not
+func (pc *cursor) endOfBatch(read int, n int) (setEnd bool, eof bool) {
+	if n > 0 && read == n {
+		return false, false
+	}
+
+	if pc.nextResultSet() {
+		return true, false
 	}
 
-	return rows, nil
+	return false, true
 }
 
 func (pc *cursor) isExecute() bool {
@@ -158,14 +276,13 @@ func (pc *cursors) getKeys() []string {
 
 func (pc *cursors) clear(k string) {
 	pc.mutex.Lock()
-	defer pc.mutex.Unlock()
-
 	c, present := pc.store[k]
+	delete(pc.store, k)
+	pc.mutex.Unlock()
+
+	//outside the lock, closing may have to read the rest of the rows
 	if present {
-		if c.rows != nil {
-			c.rows.Close()
-		}
-		delete(pc.store, k)
+		c.discard()
 	}
 }
 
@@ -242,23 +359,17 @@ func handleCursorRequest(c *cursor, req *Req) *Res {
 
 	default:
 		utils.Dbg(req.ctx, fmt.Sprintf("%s: Invalid Command\n", c.id))
-		return &Res{
-			code: ERROR,
-			data: errors.New(ERR_INVALID_CURSOR_CMD),
-		}
+		return errorRes(errors.New(ERR_INVALID_CURSOR_CMD))
 	}
 }
 
 func handle_ws(c *cursor, req *Req) *Res {
 	utils.Dbg(req.ctx, fmt.Sprintf("%s: Handling CMD_FETCH_WS\n", c.id))
-	fetchReq, _ := req.data.(FetchReq)
+	fetchReq := req.fetch
 	err := fetchRows_ws(req.ctx, c, fetchReq)
 	if err != nil {
 		utils.Dbg(req.ctx, fmt.Sprintf("%s: %s\n", c.id, err.Error()))
-		return &Res{
-			code: ERROR,
-			data: err,
-		}
+		return errorRes(err)
 	}
 
 	utils.Dbg(req.ctx, fmt.Sprintf("%s: Done CMD_FETCH\n", c.id))
@@ -270,61 +381,83 @@ func handle_ws(c *cursor, req *Req) *Res {
 
 func handle_ajax(c *cursor, req *Req) *Res {
 	utils.Dbg(req.ctx, fmt.Sprintf("%s: Handling CMD_FETCH\n", c.id))
-	fetchReq, _ := req.data.(FetchReq)
+	fetchReq := req.fetch
+
+	if fetchReq.Typed || fetchReq.Format == FORMAT_COMPACT {
+		return handle_ajax_values(c, req, fetchReq)
+	}
+
+	set := c.resultSet
 	rows, err := fetchRows(req.ctx, c, fetchReq)
 	if err != nil {
 		utils.Dbg(req.ctx, fmt.Sprintf("%s: %s\n", c.id, err.Error()))
-		return &Res{
-			code: ERROR,
-			data: err,
-		}
+		return errorRes(err)
 	}
 
 	utils.Dbg(req.ctx, fmt.Sprintf("%s: Done CMD_FETCH\n", c.id))
 
-	var code string
-	if len(*rows) < fetchReq.n {
+	return fetchRes(c, &FetchResult{Rows: rows, ResultSet: set}, len(*rows), fetchReq.n)
+}
+
+//see where a batch leaves the cursor. The handler goes away on EOF
+func fetchRes(c *cursor, r *FetchResult, read int, n int) *Res {
+	r.SetEnd, r.Eof = c.endOfBatch(read, n)
+
+	code := SUCCESS
+	if r.Eof {
 		code = EOF
-	} else {
-		code = SUCCESS
 	}
 
 	return &Res{
-		code: code,
-		data: rows,
+		code:  code,
+		fetch: r,
 	}
 }
 
-type res struct {
-	K []string `json:"k"`
-}
+//typed rows and compact rows are both value arrays. Typed wins if both
+//are asked for
+func handle_ajax_values(c *cursor, req *Req, fetchReq FetchReq) *Res {
+	var data interface{}
+	var n int
+	var err error
 
-func getExportFile(ctx context.Context) (string, *os.File, error) {
-	home, err := getHomeDir()
-	if err != nil {
-		home = ""
-	}
-	t := time.Now()
-	now := fmt.Sprintf("%d-%02d-%02dT%02d-%02d-%02d",
-		t.Year(), t.Month(), t.Day(),
-		t.Hour(), t.Minute(), t.Second())
+	set := c.resultSet
 
-	f := filepath.FromSlash(home + "/Downloads/" + "query-results-" + now + ".csv")
-	csvFile, err := os.Create(f)
+	if fetchReq.Typed {
+		var rows *TypedRows
+		rows, err = fetchTypedRows(req.ctx, c, fetchReq)
+		if err == nil {
+			data, n = rows, len(rows.Rows)
+		}
+	} else {
+		var rows *CompactRows
+		rows, err = fetchCompactRows(req.ctx, c, fetchReq)
+		if err == nil {
+			data, n = rows, len(rows.Rows)
+		}
+	}
 
 	if err != nil {
-		utils.Dbg(ctx, fmt.Sprintf("failed creating file: %s", err))
-		return "", nil, err
+		utils.Dbg(req.ctx, fmt.Sprintf("%s: %s\n", c.id, err.Error()))
+		return errorRes(err)
 	}
 
-	return f, csvFile, nil
+	utils.Dbg(req.ctx, fmt.Sprintf("%s: Done CMD_FETCH\n", c.id))
+
+	return fetchRes(c, &FetchResult{Rows: data, ResultSet: set}, n, fetchReq.n)
 }
 
-func getHomeDir() (string, error) {
-	if runtime.GOOS == "windows" {
-		return os.Getenv("USER_HOME_DIR"), nil
-	}
-	return os.UserHomeDir()
+//control messages of the stream: header, current-row, set-end and eos.
+//set-end carries the index of the result set which ended and of the one
+//the next fetch reads
+type res struct {
+	K []string `json:"k"`
+}
+
+//one row as name, value pairs. A NULL value is nil so that it can be told
+//apart from the string "NULL"
+type rowRes struct {
+	K []interface{} `json:"k"`
 }
 
 func fetchRows_ws(ctx context.Context, c *cursor, fetchReq FetchReq) error {
@@ -338,35 +471,80 @@ func fetchRows_ws(ctx context.Context, c *cursor, fetchReq FetchReq) error {
 	}
 
 	//if results are to be exported, create the output file
-	var csvWriter *csv.Writer
-	var fileName string
-	var csvFile *os.File
-
-	if fetchReq.export {
-		fileName, csvFile, err = getExportFile(ctx)
+	var ef *exportFile
 
+	if fetchReq.Export {
+		ef, err = newExportFile(ctx, c, fetchReq)
 		if err != nil {
-			utils.Dbg(ctx, fmt.Sprintf("failed creating file: %s", err))
 			return err
 		}
 
-		csvWriter = csv.NewWriter(csvFile)
+		//closes the file early on errors, see below for the normal case
+		defer ef.close(ctx, false)
 
-		if err := csvWriter.Write(cols); err != nil {
-			utils.Dbg(ctx, fmt.Sprintf("error writing record to csv: %s", err))
+		//before any row, so that an export without rows names its file too
+		k := []string{"header", c.id, ef.name}
+		if ef.token != "" {
+			k = append(k, ef.token)
 		}
 
-		defer func() {
-			csvWriter.Flush()
-			csvFile.Close()
-		}()
+		if err := sendMsg(fetchReq.ws, codecFor(fetchReq.Encoding), &res{K: k}); err != nil {
+			return err
+		}
 	}
 
 	n := 0
 	ws := fetchReq.ws
 	vals := make([]interface{}, len(cols))
 
+	//exports only send progress, the format applies to rows on the socket
+	typed := fetchReq.Typed && !fetchReq.Export
+	compact := fetchReq.Format == FORMAT_COMPACT && !fetchReq.Export
+
+	cd := codecFor(fetchReq.Encoding)
+	binary := isBinary(cd) && !fetchReq.Export
+
+	value := plainValue
+	if typed {
+		value = typedValue
+	}
+	if binary {
+		value = nativeValue
+	}
+
+	var metas []*ColumnMeta
+	if typed || binary {
+		metas, err = c.columnMeta()
+		if err != nil {
+			return err
+		}
+	}
+
+	//typed and compact rows are preceded by a header, once per cursor
+	if (typed || compact) && !c.headerSent {
+		if typed {
+			err = sendMsg(ws, cd, &columnsRes{Columns: metas})
+		} else {
+			err = sendMsg(ws, cd, &namesRes{Names: cols})
+		}
+
+		if err != nil {
+			return err
+		}
+		c.headerSent = true
+	}
+
+	var batcher *rowBatcher
+	if compact {
+		batcher = newRowBatcher(ws, fetchReq.FetchOptions)
+	}
+
 	for c.rows.Next() {
+		//export jobs can be cancelled while running
+		if fetchReq.Export && ctx.Err() != nil {
+			return ctx.Err()
+		}
+
 		for i := range cols {
 			vals[i] = &vals[i]
 		}
@@ -377,22 +555,20 @@ func fetchRows_ws(ctx context.Context, c *cursor, fetchReq FetchReq) error {
 			return err
 		}
 
-		var r []string
-		for i, c := range cols {
-			r = append(r, c)
-			var v string
+		switch {
+		case fetchReq.Export:
+			err = processRow(ctx, vals, (n + 1), ws, ef, fetchReq)
 
-			if vals[i] == nil {
-				v = "NULL"
-			} else {
-				b, _ := vals[i].([]byte)
-				v = string(b)
-			}
+		case compact:
+			err = batcher.add(valueRow(metas, vals, value))
 
-			r = append(r, v)
+		case typed || binary:
+			err = sendMsg(ws, cd, &rowRes{K: typedRow(metas, vals, value)})
+
+		default:
+			err = sendMsg(ws, cd, &rowRes{K: plainRow(cols, vals)})
 		}
 
-		err = processRow(ctx, c.id, r, (n + 1), ws, fileName, csvWriter, fetchReq.export)
 		if err != nil {
 			return err
 		}
@@ -409,58 +585,43 @@ func fetchRows_ws(ctx context.Context, c *cursor, fetchReq FetchReq) error {
 		return c.rows.Err()
 	}
 
-	if n < 1000 && fetchReq.export {
-		str, _ := json.Marshal(&res{K: []string{"current-row", strconv.Itoa(n)}})
-		err := ws.WriteMessage(websocket.TextMessage, []byte(str))
-		if err != nil {
+	set := c.resultSet
+
+	if compact {
+		if err := batcher.flush(); err != nil {
 			return err
 		}
 	}
 
-	str, _ := json.Marshal(&res{K: []string{"eos"}})
-	err = ws.WriteMessage(websocket.TextMessage, []byte(str))
-	if err != nil {
-		return err
-	}
-
-	return nil
-}
-
-func processRow(ctx context.Context, cursorId string, row []string, currRow int,
-	ws *websocket.Conn, fileName string, csvWriter *csv.Writer, export bool) error {
-
-	if export {
-		var r []string
-		for i := 1; i <= len(row); i += 2 {
-			r = append(r, row[i])
+	//the file must be complete before the client hears eos, it may go
+	//straight to /download
+	if fetchReq.Export {
+		//rows closed under us by a cancel look like the end of the results
+		if c.ctx.Err() != nil {
+			return c.ctx.Err()
 		}
 
-		if err := csvWriter.Write(r); err != nil {
-			utils.Dbg(ctx, fmt.Sprintf("error writing record to csv: %s", err))
+		if err := ef.close(ctx, true); err != nil {
 			return err
 		}
+	}
 
-		if currRow == 1 {
-			str, _ := json.Marshal(&res{K: []string{"header", cursorId, fileName}})
-			err := ws.WriteMessage(websocket.TextMessage, []byte(str))
-			if err != nil {
-				return err
-			}
+	if n < 1000 && fetchReq.Export {
+		err := sendMsg(ws, cd, &res{K: []string{"current-row", strconv.Itoa(n)}})
+		if err != nil {
+			return err
 		}
+	}
 
-		if currRow%1000 == 0 {
-			str, _ := json.Marshal(&res{K: []string{"current-row", strconv.Itoa(currRow)}})
-			err := ws.WriteMessage(websocket.TextMessage, []byte(str))
-			if err != nil {
-				return err
-			}
+	//the next fetch reads the next result set, starting with its header
+	if setEnd, _ := c.endOfBatch(n, fetchReq.n); setEnd {
+		err := sendMsg(ws, cd, &res{K: []string{"set-end", strconv.Itoa(set), strconv.Itoa(c.resultSet)}})
+		if err != nil {
+			return err
 		}
-
-		return nil
 	}
 
-	str, _ := json.Marshal(&res{K: row})
-	err := ws.WriteMessage(websocket.TextMessage, []byte(str))
+	err = sendMsg(ws, cd, &res{K: []string{"eos"}})
 	if err != nil {
 		return err
 	}
@@ -468,7 +629,28 @@ func processRow(ctx context.Context, cursorId string, row []string, currRow int,
 	return nil
 }
 
-func fetchRows(ctx context.Context, c *cursor, fetchReq FetchReq) (*[][]string, error) {
+//write one row to the export file and report progress
+func processRow(ctx context.Context, vals []interface{}, currRow int,
+	ws wsWriter, ef *exportFile, fetchReq FetchReq) error {
+
+	cd := codecFor(fetchReq.Encoding)
+
+	if err := ef.row(vals); err != nil {
+		utils.Dbg(ctx, fmt.Sprintf("error writing record to %s: %s", ef.name, err))
+		return err
+	}
+
+	if currRow%1000 == 0 {
+		err := sendMsg(ws, cd, &res{K: []string{"current-row", strconv.Itoa(currRow)}})
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func fetchRows(ctx context.Context, c *cursor, fetchReq FetchReq) (*[][]interface{}, error) {
 	if fetchReq.cid != c.id {
 		return nil, errors.New(ERR_INVALID_CURSOR_ID)
 	}
@@ -481,7 +663,7 @@ func fetchRows(ctx context.Context, c *cursor, fetchReq FetchReq) (*[][]string,
 	}
 
 	vals := make([]interface{}, len(cols))
-	var results [][]string
+	var results [][]interface{}
 
 	n := 0
 	for c.rows.Next() {
@@ -495,23 +677,10 @@ func fetchRows(ctx context.Context, c *cursor, fetchReq FetchReq) (*[][]string,
 			return nil, err
 		}
 
-		var r []string
-		for i, c := range cols {
-			r = append(r, c)
-			var v string
-
-			if vals[i] == nil {
-				v = "NULL"
-			} else {
-				b, _ := vals[i].([]byte)
-				v = string(b)
-			}
-
-			r = append(r, v)
-		}
+		r := plainRow(cols, vals)
 
 		if ws != nil {
-			str, _ := json.Marshal(&res{K: r})
+			str, _ := json.Marshal(&rowRes{K: r})
 			err = ws.WriteMessage(websocket.TextMessage, []byte(str))
 			if err != nil {
 				return nil, err
@@ -540,3 +709,137 @@ func fetchRows(ctx context.Context, c *cursor, fetchReq FetchReq) (*[][]string,
 
 	return &results, nil
 }
+
+//name, value pairs with values as text. NULL stays nil
+func plainRow(cols []string, vals []interface{}) []interface{} {
+	r := make([]interface{}, 0, 2*len(cols))
+	for i, c := range cols {
+		r = append(r, c, textValue(vals[i]))
+	}
+
+	return r
+}
+
+func plainValue(_ *ColumnMeta, v interface{}) interface{} {
+	return textValue(v)
+}
+
+func textValue(v interface{}) interface{} {
+	switch t := v.(type) {
+	case nil:
+		return nil
+	case []byte:
+		return string(t)
+	default:
+		return fmt.Sprint(t)
+	}
+}
+
+//encodes one scanned value of a column
+type valueFunc func(m *ColumnMeta, v interface{}) interface{}
+
+//name, value pairs with values encoded according to their columns
+func typedRow(metas []*ColumnMeta, vals []interface{}, value valueFunc) []interface{} {
+	r := make([]interface{}, 0, 2*len(metas))
+	for i, m := range metas {
+		r = append(r, m.Name, value(m, vals[i]))
+	}
+
+	return r
+}
+
+func fetchTypedRows(ctx context.Context, c *cursor, fetchReq FetchReq) (*TypedRows, error) {
+	if fetchReq.cid != c.id {
+		return nil, errors.New(ERR_INVALID_CURSOR_ID)
+	}
+
+	metas, err := c.columnMeta()
+	if err != nil {
+		return nil, err
+	}
+
+	rows, err := fetchValueRows(c, fetchReq.n, len(metas), metas)
+	if err != nil {
+		return nil, err
+	}
+
+	results := &TypedRows{Rows: rows}
+	if !c.headerSent {
+		results.Columns = metas
+		c.headerSent = true
+	}
+
+	return results, nil
+}
+
+func fetchCompactRows(ctx context.Context, c *cursor, fetchReq FetchReq) (*CompactRows, error) {
+	if fetchReq.cid != c.id {
+		return nil, errors.New(ERR_INVALID_CURSOR_ID)
+	}
+
+	cols, err := c.rows.Columns()
+	if err != nil {
+		return nil, err
+	}
+
+	rows, err := fetchValueRows(c, fetchReq.n, len(cols), nil)
+	if err != nil {
+		return nil, err
+	}
+
+	results := &CompactRows{Rows: rows}
+	if !c.headerSent {
+		results.Names = cols
+		c.headerSent = true
+	}
+
+	return results, nil
+}
+
+//read up to n rows as value arrays, typed if metas are given
+func fetchValueRows(c *cursor, n int, numCols int, metas []*ColumnMeta) ([][]interface{}, error) {
+	vals := make([]interface{}, numCols)
+	results := [][]interface{}{}
+
+	value := plainValue
+	if metas != nil {
+		value = typedValue
+	}
+
+	for c.rows.Next() {
+		for i := range vals {
+			vals[i] = &vals[i]
+		}
+
+		err := c.rows.Scan(vals...)
+		if err != nil {
+			return nil, err
+		}
+
+		results = append(results, valueRow(metas, vals, value))
+
+		if len(results) == n {
+			break
+		}
+	}
+
+	if c.rows.Err() != nil {
+		return nil, c.rows.Err()
+	}
+
+	return results, nil
+}
+
+//values only. metas may be nil for plain values
+func valueRow(metas []*ColumnMeta, vals []interface{}, value valueFunc) []interface{} {
+	r := make([]interface{}, len(vals))
+	for i, v := range vals {
+		var m *ColumnMeta
+		if metas != nil {
+			m = metas[i]
+		}
+		r[i] = value(m, v)
+	}
+
+	return r
+}
@@ -1,3 +1,6 @@
+//go:build integration
+// +build integration
+
 /* Copyright (C) 2021 Pankaj Kargirwar <kargirwar@protonmail.com>
 
    This file is part of prosql-agent
@@ -62,7 +65,7 @@ var billsFields = []string{
 	"payment-updated-by",
 }
 
-func TestFetch(t *testing.T) {
+func TestFetchPool(t *testing.T) {
 	var pool *sql.DB
 	pool, err := sql.Open("mysql", "server:dev-server@tcp(127.0.0.1:3306)/test-generico")
 	if err != nil {
@@ -91,7 +94,7 @@ func TestFetch(t *testing.T) {
 
 	for j := 0; j < 1; j++ {
 		start := time.Now()
-		fetchRows(t, ctx, pool, "select * from `bills-1` limit 500", ch)
+		queryRows(t, ctx, pool, "select * from `bills-1` limit 500", ch)
 		end := time.Now()
 		t.Logf("%d took %s\n", j, end.Sub(start))
 	}
@@ -111,19 +114,19 @@ func TestFetch(t *testing.T) {
 	//q += "`" + billsFields[i] + "`" + " from `bills-1` limit 1000"
 	//
 	//s := time.Now()
-	//fetchRows(t, ctx, pool, q)
+	//queryRows(t, ctx, pool, q)
 	//e := time.Now()
 	//t.Logf("%d took %s\n", j, e.Sub(s))
 	//}
 	//
 	//s := time.Now()
-	//fetchRows(t, ctx, pool, "select * from `bills-1` limit 1000")
+	//queryRows(t, ctx, pool, "select * from `bills-1` limit 1000")
 	//e := time.Now()
 	//t.Logf("%d took %s\n", 200, e.Sub(s))
 
 }
 
-func fetchRows(t *testing.T, ctx context.Context, pool *sql.DB, q string, ch chan []string) {
+func queryRows(t *testing.T, ctx context.Context, pool *sql.DB, q string, ch chan []string) {
 	s := time.Now()
 	rows, err := pool.QueryContext(ctx, q)
 	if err != nil {
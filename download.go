@@ -0,0 +1,210 @@
+/* Copyright (C) 2021 Pankaj Kargirwar <kargirwar@protonmail.com>
+
+   This file is part of prosql-agent
+
+   prosql-agent is free software: you can redistribute it and/or modify
+   it under the terms of the GNU General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   prosql-agent is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU General Public License for more details.
+
+   You should have received a copy of the GNU General Public License
+   along with prosql-agent.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+/* Exports with download set are written to a directory of the agent's own
+and get a token instead of a place in the user's export directory. The token comes
+with the header message:
+
+{"k": ["header", "<cursor-id>", "<file name>", "<token>"]}
+
+Once eos arrives the file can be fetched from /download?token=<token> until
+it expires, timeouts.download-ttl after it was complete. The janitor removes
+it then */
+
+package main
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/dchest/uniuri"
+	log "github.com/sirupsen/logrus"
+)
+
+type downloadFile struct {
+	path        string
+	name        string //file name offered to the browser
+	contentType string
+	expires     time.Time //set once ready
+	ready       bool      //false while the export is being written
+}
+
+type downloads struct {
+	store map[string]*downloadFile
+	mutex sync.Mutex
+}
+
+var downloadStore *downloads
+
+func init() {
+	downloadStore = &downloads{
+		store: make(map[string]*downloadFile),
+	}
+	go cleanupDownloads()
+}
+
+//temporary export files live here, never in the user's export directory.
+//Not in the shared temp dir either, where others could see or plant files
+func downloadDir() (string, error) {
+	agentDir, err := getAgentDir()
+	if err != nil {
+		return "", err
+	}
+
+	dir := filepath.Join(agentDir, "downloads")
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return "", err
+	}
+
+	return dir, nil
+}
+
+//zip and gzip files, xlsx being a zip
+func (d *downloadFile) compressed() bool {
+	switch d.contentType {
+	case "application/gzip", "application/zip", exportFormats[EXPORT_XLSX].contentType:
+		return true
+	}
+
+	return false
+}
+
+func (ds *downloads) add(path string, contentType string) string {
+	ds.mutex.Lock()
+	defer ds.mutex.Unlock()
+
+	token := uniuri.NewLen(32)
+	ds.store[token] = &downloadFile{
+		path:        path,
+		name:        filepath.Base(path),
+		contentType: contentType,
+	}
+
+	return token
+}
+
+func (ds *downloads) setReady(token string) {
+	ds.mutex.Lock()
+	defer ds.mutex.Unlock()
+
+	//a long export must not eat up the time left to download it
+	if d, present := ds.store[token]; present {
+		d.ready = true
+		d.expires = time.Now().Add(getConfig().Timeouts.DownloadTtl.Duration)
+	}
+}
+
+func (ds *downloads) get(token string) (*downloadFile, error) {
+	ds.mutex.Lock()
+	defer ds.mutex.Unlock()
+
+	d, present := ds.store[token]
+	if !present {
+		return nil, errors.New(ERR_INVALID_DOWNLOAD_TOKEN)
+	}
+
+	if !d.ready {
+		return nil, errors.New(ERR_DOWNLOAD_NOT_READY)
+	}
+
+	if time.Now().After(d.expires) {
+		return nil, errors.New(ERR_INVALID_DOWNLOAD_TOKEN)
+	}
+
+	dl := *d
+	return &dl, nil
+}
+
+//forget the token and remove its file
+func (ds *downloads) clear(token string) {
+	ds.mutex.Lock()
+	d, present := ds.store[token]
+	delete(ds.store, token)
+	ds.mutex.Unlock()
+
+	if present {
+		os.Remove(d.path)
+	}
+}
+
+func (ds *downloads) expired() []string {
+	ds.mutex.Lock()
+	defer ds.mutex.Unlock()
+
+	var tokens []string
+	now := time.Now()
+	for k, d := range ds.store {
+		//the export clears its token itself if it fails
+		if d.ready && now.After(d.expires) {
+			tokens = append(tokens, k)
+		}
+	}
+
+	return tokens
+}
+
+func (ds *downloads) has(path string) bool {
+	ds.mutex.Lock()
+	defer ds.mutex.Unlock()
+
+	for _, d := range ds.store {
+		if d.path == path {
+			return true
+		}
+	}
+
+	return false
+}
+
+//remove expired downloads, and files left behind by an earlier run
+func cleanupDownloads() {
+	ticker := time.NewTicker(DOWNLOAD_CLEANUP_INTERVAL)
+
+	for range ticker.C {
+		for _, token := range downloadStore.expired() {
+			log.Debug("Removing expired download")
+			downloadStore.clear(token)
+		}
+
+		dir, err := downloadDir()
+		if err != nil {
+			continue
+		}
+
+		entries, err := os.ReadDir(dir)
+		if err != nil {
+			continue
+		}
+
+		for _, e := range entries {
+			path := filepath.Join(dir, e.Name())
+			fi, err := e.Info()
+			if err != nil || time.Since(fi.ModTime()) < getConfig().Timeouts.DownloadTtl.Duration || downloadStore.has(path) {
+				continue
+			}
+
+			log.WithFields(log.Fields{
+				"file": path,
+			}).Debug("Removing stale download")
+			os.Remove(path)
+		}
+	}
+}
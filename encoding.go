@@ -0,0 +1,185 @@
+/* Copyright (C) 2021 Pankaj Kargirwar <kargirwar@protonmail.com>
+
+   This file is part of prosql-agent
+
+   prosql-agent is free software: you can redistribute it and/or modify
+   it under the terms of the GNU General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   prosql-agent is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU General Public License for more details.
+
+   You should have received a copy of the GNU General Public License
+   along with prosql-agent.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+/* Encodings of the /fetch_ws stream. json sends text frames. msgpack and
+cbor send binary frames with the same messages as json, but values keep
+their native types: integers and floats are numbers, BLOBs are raw bytes.
+DECIMAL stays a string. Errors sent before streaming starts are always JSON
+text frames */
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"strconv"
+
+	"github.com/fxamacker/cbor/v2"
+	"github.com/gorilla/websocket"
+	"github.com/vmihailenco/msgpack/v5"
+)
+
+type codec interface {
+	msgType() int
+	marshal(v interface{}) ([]byte, error)
+
+	//wrap already encoded rows in a {"rows": [...]} message
+	rowsFrame(rows [][]byte) ([]byte, error)
+}
+
+var codecs = map[string]codec{
+	ENCODING_JSON:    jsonCodec{},
+	ENCODING_MSGPACK: msgpackCodec{},
+	ENCODING_CBOR:    cborCodec{},
+}
+
+func checkEncoding(opts *FetchOptions) error {
+	if opts.Encoding == "" {
+		opts.Encoding = ENCODING_JSON
+	}
+
+	if _, ok := codecs[opts.Encoding]; !ok {
+		return errors.New(ERR_INVALID_ENCODING)
+	}
+
+	return nil
+}
+
+func codecFor(encoding string) codec {
+	if cd, ok := codecs[encoding]; ok {
+		return cd
+	}
+
+	return codecs[ENCODING_JSON]
+}
+
+func isBinary(cd codec) bool {
+	return cd.msgType() == websocket.BinaryMessage
+}
+
+func sendMsg(ws wsWriter, cd codec, v interface{}) error {
+	str, err := cd.marshal(v)
+	if err != nil {
+		return err
+	}
+
+	return ws.WriteMessage(cd.msgType(), str)
+}
+
+type jsonCodec struct{}
+
+func (jsonCodec) msgType() int {
+	return websocket.TextMessage
+}
+
+func (jsonCodec) marshal(v interface{}) ([]byte, error) {
+	return json.Marshal(v)
+}
+
+func (jsonCodec) rowsFrame(rows [][]byte) ([]byte, error) {
+	var buf bytes.Buffer
+	buf.WriteString(`{"rows":[`)
+	buf.Write(bytes.Join(rows, []byte{','}))
+	buf.WriteString(`]}`)
+
+	return buf.Bytes(), nil
+}
+
+type msgpackCodec struct{}
+
+func (msgpackCodec) msgType() int {
+	return websocket.BinaryMessage
+}
+
+func (msgpackCodec) marshal(v interface{}) ([]byte, error) {
+	var buf bytes.Buffer
+
+	enc := msgpack.NewEncoder(&buf)
+	//same field names as the JSON messages
+	enc.SetCustomStructTag("json")
+	enc.UseCompactInts(true)
+
+	if err := enc.Encode(v); err != nil {
+		return nil, err
+	}
+
+	return buf.Bytes(), nil
+}
+
+func (cd msgpackCodec) rowsFrame(rows [][]byte) ([]byte, error) {
+	raw := make([]msgpack.RawMessage, len(rows))
+	for i, r := range rows {
+		raw[i] = r
+	}
+
+	return cd.marshal(map[string]interface{}{"rows": raw})
+}
+
+type cborCodec struct{}
+
+func (cborCodec) msgType() int {
+	return websocket.BinaryMessage
+}
+
+//cbor falls back to json tags by itself
+func (cborCodec) marshal(v interface{}) ([]byte, error) {
+	return cbor.Marshal(v)
+}
+
+func (cd cborCodec) rowsFrame(rows [][]byte) ([]byte, error) {
+	raw := make([]cbor.RawMessage, len(rows))
+	for i, r := range rows {
+		raw[i] = r
+	}
+
+	return cd.marshal(map[string]interface{}{"rows": raw})
+}
+
+//value for binary frames. Numbers become int64, uint64 or float64 and
+//BLOBs stay bytes
+func nativeValue(m *ColumnMeta, v interface{}) interface{} {
+	switch t := typedValue(m, v).(type) {
+	case json.Number:
+		if m.Type == "FLOAT" || m.Type == "DOUBLE" {
+			if f, err := t.Float64(); err == nil {
+				return f
+			}
+		}
+
+		if i, err := t.Int64(); err == nil {
+			return i
+		}
+
+		if u, err := strconv.ParseUint(string(t), 10, 64); err == nil {
+			return u
+		}
+
+		if f, err := t.Float64(); err == nil {
+			return f
+		}
+
+		return string(t)
+
+	case json.RawMessage:
+		return string(t)
+
+	default:
+		return t
+	}
+}
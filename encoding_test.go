@@ -0,0 +1,271 @@
+/* Copyright (C) 2021 Pankaj Kargirwar <kargirwar@protonmail.com>
+
+   This file is part of prosql-agent
+
+   prosql-agent is free software: you can redistribute it and/or modify
+   it under the terms of the GNU General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   prosql-agent is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU General Public License for more details.
+
+   You should have received a copy of the GNU General Public License
+   along with prosql-agent.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+
+	"github.com/fxamacker/cbor/v2"
+	"github.com/gorilla/websocket"
+	"github.com/vmihailenco/msgpack/v5"
+)
+
+type frame struct {
+	msgType int
+	data    []byte
+}
+
+type frameRecorder struct {
+	frames []frame
+}
+
+func (fr *frameRecorder) WriteMessage(msgType int, data []byte) error {
+	b := make([]byte, len(data))
+	copy(b, data)
+	fr.frames = append(fr.frames, frame{msgType, b})
+	return nil
+}
+
+//columns as the driver reports them and values as it scans them
+var testMetas = []*ColumnMeta{
+	{Name: "id", Type: "BIGINT", Kind: kindOf("BIGINT")},
+	{Name: "big", Type: "UNSIGNED BIGINT", Kind: kindOf("UNSIGNED BIGINT")},
+	{Name: "ratio", Type: "DOUBLE", Kind: kindOf("DOUBLE")},
+	{Name: "price", Type: "DECIMAL", Kind: kindOf("DECIMAL")},
+	{Name: "name", Type: "VARCHAR", Kind: kindOf("VARCHAR")},
+	{Name: "data", Type: "BLOB", Kind: kindOf("BLOB")},
+	{Name: "doc", Type: "JSON", Kind: kindOf("JSON")},
+	{Name: "missing", Type: "VARCHAR", Kind: kindOf("VARCHAR")},
+}
+
+var testVals = [][]interface{}{
+	{[]byte("-42"), []byte("18446744073709551615"), []byte("0.25"), []byte("12.50"),
+		[]byte("héllo"), []byte{0x00, 0xff, 0xfe, 0x80}, []byte(`{"a":1}`), nil},
+	{[]byte("7"), []byte("9223372036854775807"), []byte("-1.5"), []byte("0.00"),
+		[]byte(""), []byte{}, []byte(`[1,2]`), nil},
+	{[]byte("0"), []byte("1"), []byte("3"), []byte("99999999999999999999.99"),
+		[]byte("NULL"), []byte("\xc3\x28"), []byte(`null`), nil},
+}
+
+var testExpected = [][]interface{}{
+	{int64(-42), uint64(18446744073709551615), 0.25, "12.50",
+		"héllo", []byte{0x00, 0xff, 0xfe, 0x80}, `{"a":1}`, nil},
+	{int64(7), int64(9223372036854775807), -1.5, "0.00",
+		"", []byte{}, `[1,2]`, nil},
+	{int64(0), int64(1), 3.0, "99999999999999999999.99",
+		"NULL", []byte("\xc3\x28"), `null`, nil},
+}
+
+type testRowMsg struct {
+	K []interface{} `json:"k"`
+}
+
+type testRowsMsg struct {
+	Rows [][]interface{} `json:"rows"`
+}
+
+func decodeMsgpack(t *testing.T, data []byte, v interface{}) {
+	dec := msgpack.NewDecoder(bytes.NewReader(data))
+	dec.SetCustomStructTag("json")
+
+	if err := dec.Decode(v); err != nil {
+		t.Fatalf("msgpack: %s", err.Error())
+	}
+}
+
+func decodeCbor(t *testing.T, data []byte, v interface{}) {
+	if err := cbor.Unmarshal(data, v); err != nil {
+		t.Fatalf("cbor: %s", err.Error())
+	}
+}
+
+//the decoders pick the smallest integer type, compare integers as int64
+//when they fit. Loose msgpack decoding would do this but turns bin into
+//string
+func normalize(v interface{}) interface{} {
+	switch t := v.(type) {
+	case int8:
+		return int64(t)
+	case int16:
+		return int64(t)
+	case int32:
+		return int64(t)
+	case uint8:
+		return int64(t)
+	case uint16:
+		return int64(t)
+	case uint32:
+		return int64(t)
+	case uint64:
+		if t <= 1<<63-1 {
+			return int64(t)
+		}
+	case []interface{}:
+		r := make([]interface{}, len(t))
+		for i := range t {
+			r[i] = normalize(t[i])
+		}
+		return r
+	}
+
+	return v
+}
+
+func encodeRows(t *testing.T, encoding string, format string) *frameRecorder {
+	opts := FetchOptions{Format: format, Encoding: encoding, BatchRows: 2}
+	if err := checkFormat(&opts); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := checkEncoding(&opts); err != nil {
+		t.Fatal(err)
+	}
+
+	fr := &frameRecorder{}
+	cd := codecFor(opts.Encoding)
+	batcher := newRowBatcher(fr, opts)
+
+	for _, vals := range testVals {
+		var err error
+		if format == FORMAT_COMPACT {
+			err = batcher.add(valueRow(testMetas, vals, nativeValue))
+		} else {
+			err = sendMsg(fr, cd, &rowRes{K: typedRow(testMetas, vals, nativeValue)})
+		}
+
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := batcher.flush(); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, f := range fr.frames {
+		if f.msgType != websocket.BinaryMessage {
+			t.Fatalf("%s: expected binary frames", encoding)
+		}
+	}
+
+	return fr
+}
+
+//decoded rows of both encodings, values only
+func decodeRows(t *testing.T, encoding string, format string, fr *frameRecorder) [][]interface{} {
+	decode := decodeMsgpack
+	if encoding == ENCODING_CBOR {
+		decode = decodeCbor
+	}
+
+	var rows [][]interface{}
+	for _, f := range fr.frames {
+		if format == FORMAT_COMPACT {
+			var msg testRowsMsg
+			decode(t, f.data, &msg)
+			rows = append(rows, msg.Rows...)
+			continue
+		}
+
+		var msg testRowMsg
+		decode(t, f.data, &msg)
+
+		var r []interface{}
+		for i := 1; i < len(msg.K); i += 2 {
+			r = append(r, msg.K[i])
+		}
+		rows = append(rows, r)
+	}
+
+	for i := range rows {
+		rows[i] = normalize(rows[i]).([]interface{})
+	}
+
+	return rows
+}
+
+func TestKindOf(t *testing.T) {
+	tests := []struct {
+		dbType string
+		want   string
+	}{
+		{"TINYINT", KIND_NUMBER},
+		{"UNSIGNED TINYINT", KIND_NUMBER},
+		{"SMALLINT", KIND_NUMBER},
+		{"UNSIGNED SMALLINT", KIND_NUMBER},
+		{"MEDIUMINT", KIND_NUMBER},
+		{"UNSIGNED MEDIUMINT", KIND_NUMBER},
+		{"INT", KIND_NUMBER},
+		{"UNSIGNED INT", KIND_NUMBER},
+		{"BIGINT", KIND_NUMBER},
+		{"UNSIGNED BIGINT", KIND_NUMBER},
+		{"DOUBLE", KIND_NUMBER},
+		{"DECIMAL", KIND_STRING},
+		{"VARCHAR", KIND_STRING},
+		{"UNSIGNED", KIND_STRING},
+		{"VARBINARY", KIND_BINARY},
+		{"JSON", KIND_JSON},
+	}
+
+	for _, test := range tests {
+		if got := kindOf(test.dbType); got != test.want {
+			t.Errorf("%s: expected %s got %s\n", test.dbType, test.want, got)
+		}
+	}
+
+	m := &ColumnMeta{Name: "id", Type: "UNSIGNED INT", Kind: kindOf("UNSIGNED INT")}
+	if !isNumeric(m) {
+		t.Errorf("expected UNSIGNED INT to be exported as a number\n")
+	}
+}
+
+func TestEncodingRoundTrip(t *testing.T) {
+	for _, format := range []string{FORMAT_PAIRS, FORMAT_COMPACT} {
+		mp := decodeRows(t, ENCODING_MSGPACK, format, encodeRows(t, ENCODING_MSGPACK, format))
+		cb := decodeRows(t, ENCODING_CBOR, format, encodeRows(t, ENCODING_CBOR, format))
+
+		if !reflect.DeepEqual(mp, testExpected) {
+			t.Errorf("%s: msgpack rows\n got %#v\nwant %#v", format, mp, testExpected)
+		}
+
+		if !reflect.DeepEqual(cb, testExpected) {
+			t.Errorf("%s: cbor rows\n got %#v\nwant %#v", format, cb, testExpected)
+		}
+	}
+}
+
+func TestEncodingBatches(t *testing.T) {
+	for _, encoding := range []string{ENCODING_MSGPACK, ENCODING_CBOR} {
+		fr := encodeRows(t, encoding, FORMAT_COMPACT)
+
+		//3 rows, 2 per batch
+		if len(fr.frames) != 2 {
+			t.Errorf("%s: got %d frames, want 2", encoding, len(fr.frames))
+		}
+	}
+}
+
+func TestEncodingInvalid(t *testing.T) {
+	opts := FetchOptions{Encoding: "xml"}
+	if err := checkEncoding(&opts); err == nil || err.Error() != ERR_INVALID_ENCODING {
+		t.Errorf("expected %s, got %v", ERR_INVALID_ENCODING, err)
+	}
+}
@@ -0,0 +1,131 @@
+/* Copyright (C) 2021 Pankaj Kargirwar <kargirwar@protonmail.com>
+
+   This file is part of prosql-agent
+
+   prosql-agent is free software: you can redistribute it and/or modify
+   it under the terms of the GNU General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   prosql-agent is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU General Public License for more details.
+
+   You should have received a copy of the GNU General Public License
+   along with prosql-agent.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+/* What fetching an execute cursor returns:
+
+{"rows-affected": 3, "last-insert-id": 0, "warning-count": 1, "warnings": [
+    {"level": "Warning", "code": 1265, "message": "Data truncated for column 'v' at row 2"}
+]}
+
+Warnings are read with SHOW WARNINGS on the connection the statement ran
+on, right after it.
+
+The info string the server sends with the OK packet ("Rows matched: 3
+Changed: 2  Warnings: 0") is not part of the result, the driver reads it
+but does not hand it out. Its warnings are warning-count. Of the two row
+counts the server sends one: rows changed, which is rows-affected, unless
+the session logged in with found-rows. Then the server counts the rows
+an UPDATE matched, including those it left as they were, and the result
+carries them as rows-matched:
+
+{"rows-affected": 3, "rows-matched": 3, "last-insert-id": 0, "warning-count": 0}
+
+rows-affected is the same number then, the changed count is not known.
+The same goes for the statements of a script */
+
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+
+	"github.com/kargirwar/prosql-agent/utils"
+)
+
+type ExecuteResult struct {
+	RowsAffected int64      `json:"rows-affected"`
+	RowsMatched  *int64     `json:"rows-matched,omitempty"` //found-rows sessions only
+	LastInsertId int64      `json:"last-insert-id"`
+	WarningCount int64      `json:"warning-count"`
+	Warnings     []*Warning `json:"warnings,omitempty"`
+}
+
+type Warning struct {
+	Level   string `json:"level"`
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+}
+
+func newExecuteResult(result sql.Result, foundRows bool) (*ExecuteResult, error) {
+	var r ExecuteResult
+	var err error
+
+	r.RowsAffected, err = result.RowsAffected()
+	if err != nil {
+		return nil, err
+	}
+
+	if foundRows {
+		matched := r.RowsAffected
+		r.RowsMatched = &matched
+	}
+
+	//not every statement has one, 0 then
+	r.LastInsertId, _ = result.LastInsertId()
+
+	return &r, nil
+}
+
+//read the warnings of the last statement run on db, which must be a
+//single connection. Failing to read them doesn't fail the statement
+func (r *ExecuteResult) readWarnings(ctx context.Context, db dbConn) {
+	//SHOW statements leave the warnings alone, so count first
+	err := queryRow(ctx, db, "SHOW COUNT(*) WARNINGS", &r.WarningCount)
+	if err != nil {
+		utils.Dbg(ctx, fmt.Sprintf("unable to count warnings: %s", err.Error()))
+		return
+	}
+
+	if r.WarningCount == 0 {
+		return
+	}
+
+	rows, err := db.QueryContext(ctx, "SHOW WARNINGS")
+	if err != nil {
+		utils.Dbg(ctx, fmt.Sprintf("unable to read warnings: %s", err.Error()))
+		return
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var w Warning
+		if err := rows.Scan(&w.Level, &w.Code, &w.Message); err != nil {
+			utils.Dbg(ctx, fmt.Sprintf("unable to read warnings: %s", err.Error()))
+			return
+		}
+		r.Warnings = append(r.Warnings, &w)
+	}
+}
+
+func queryRow(ctx context.Context, db dbConn, query string, dest ...interface{}) error {
+	rows, err := db.QueryContext(ctx, query)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	if !rows.Next() {
+		if err := rows.Err(); err != nil {
+			return err
+		}
+		return sql.ErrNoRows
+	}
+
+	return rows.Scan(dest...)
+}
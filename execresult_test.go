@@ -0,0 +1,86 @@
+//go:build integration
+// +build integration
+
+/* Copyright (C) 2021 Pankaj Kargirwar <kargirwar@protonmail.com>
+
+   This file is part of prosql-agent
+
+   prosql-agent is free software: you can redistribute it and/or modify
+   it under the terms of the GNU General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   prosql-agent is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU General Public License for more details.
+
+   You should have received a copy of the GNU General Public License
+   along with prosql-agent.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"context"
+	"os"
+	"testing"
+)
+
+//rows-affected and rows-matched of statement on session sid
+func execCounts(t *testing.T, ctx context.Context, sid string, statement string) (int64, *int64) {
+	t.Helper()
+
+	cid, err := Execute(ctx, sid, statement)
+	if err != nil {
+		t.Fatalf("%s: %s\n", statement, err.Error())
+	}
+
+	r, err := FetchSet(ctx, sid, cid, 1, FetchOptions{})
+	if err != nil {
+		t.Fatalf("%s: %s\n", statement, err.Error())
+	}
+
+	result, ok := r.Rows.(*ExecuteResult)
+	if !ok {
+		t.Fatalf("%s: expected an execute result got %T\n", statement, r.Rows)
+	}
+
+	return result.RowsAffected, result.RowsMatched
+}
+
+func TestFoundRows(t *testing.T) {
+	ctx := context.Background()
+	sid, err := NewSession(ctx, "mysql", os.Getenv("DSN"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer Cleanup(ctx, sid)
+
+	execCounts(t, ctx, sid, "drop table if exists found_rows")
+	execCounts(t, ctx, sid, "create table found_rows (id int primary key, v int)")
+	defer execCounts(t, ctx, sid, "drop table found_rows")
+	execCounts(t, ctx, sid, "insert into found_rows values (1, 1), (2, 2)")
+
+	//one of the two rows matched changes
+	affected, matched := execCounts(t, ctx, sid, "update found_rows set v = 1")
+	if affected != 1 || matched != nil {
+		t.Errorf("expected 1 row changed and no rows-matched got %d %v\n", affected, matched)
+	}
+
+	dsn, err := reportFoundRows(os.Getenv("DSN"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	fsid, err := NewSession(ctx, "mysql", dsn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer Cleanup(ctx, fsid)
+
+	affected, matched = execCounts(t, ctx, fsid, "update found_rows set v = 1")
+	if matched == nil || *matched != 2 || affected != 2 {
+		t.Errorf("expected 2 rows matched got %d %v\n", affected, matched)
+	}
+}
@@ -0,0 +1,639 @@
+/* Copyright (C) 2021 Pankaj Kargirwar <kargirwar@protonmail.com>
+
+   This file is part of prosql-agent
+
+   prosql-agent is free software: you can redistribute it and/or modify
+   it under the terms of the GNU General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   prosql-agent is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU General Public License for more details.
+
+   You should have received a copy of the GNU General Public License
+   along with prosql-agent.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+
+	"github.com/kargirwar/prosql-agent/utils"
+)
+
+//writes exported rows to a file. Values are passed as scanned, nil is NULL
+type exporter interface {
+	header(metas []*ColumnMeta) error
+	row(vals []interface{}) error
+
+	//write whatever closes the document and flush. The file is closed by
+	//the caller
+	close() error
+}
+
+type exportFormat struct {
+	ext         string
+	contentType string
+	new         func(w io.Writer, opts FetchOptions) exporter
+}
+
+var exportFormats = map[string]exportFormat{
+	EXPORT_CSV:      {"csv", "text/csv; charset=utf-8", newCsvExporter},
+	EXPORT_TSV:      {"tsv", "text/tab-separated-values; charset=utf-8", newTsvExporter},
+	EXPORT_JSON:     {"json", "application/json", newJsonExporter},
+	EXPORT_NDJSON:   {"ndjson", "application/x-ndjson", newNdjsonExporter},
+	EXPORT_SQL:      {"sql", "application/sql", newSqlExporter},
+	EXPORT_MARKDOWN: {"md", "text/markdown; charset=utf-8", newMarkdownExporter},
+	EXPORT_XLSX:     {"xlsx", "application/vnd.openxmlformats-officedocument.spreadsheetml.sheet", newXlsxExporter},
+}
+
+//validate fetch options and fill in defaults
+func checkFetchOptions(opts *FetchOptions) error {
+	if err := checkFormat(opts); err != nil {
+		return err
+	}
+
+	if err := checkEncoding(opts); err != nil {
+		return err
+	}
+
+	return checkExport(opts)
+}
+
+func checkExport(opts *FetchOptions) error {
+	//a download is an export to a temporary file
+	if opts.Download {
+		opts.Export = true
+	}
+
+	if !opts.Export {
+		return nil
+	}
+
+	if opts.ExportFormat == "" {
+		opts.ExportFormat = EXPORT_CSV
+	}
+
+	if _, ok := exportFormats[opts.ExportFormat]; !ok {
+		return errors.New(ERR_INVALID_EXPORT_FORMAT)
+	}
+
+	if opts.ExportFormat == EXPORT_SQL && opts.Table == "" {
+		return errors.New("Table name not provided")
+	}
+
+	if opts.OnCollision != "" {
+		if err := checkCollision(opts.OnCollision); err != nil {
+			return err
+		}
+	}
+
+	if err := checkCsvDialect(opts); err != nil {
+		return err
+	}
+
+	if err := checkCompression(opts.Compress); err != nil {
+		return err
+	}
+
+	return checkSplit(opts)
+}
+
+//an export being written by one fetch. Its rows go to one file, or to
+//several parts of a split export
+type exportFile struct {
+	exp    exporter
+	part   *exportPart
+	parts  []*partInfo //finished parts
+	paths  []string    //of all parts, to clean up after a failure
+	opts   FetchOptions
+	format exportFormat
+	metas  []*ColumnMeta
+
+	manifest *os.File //split exports only
+	path     string   //the file, or the manifest of a split export
+	name     string   //as reported in the header message
+	token    string   //download token, if any
+	rows     int64    //atomic, read by the export job
+	written  int64    //atomic, bytes of all parts
+	closed   bool
+}
+
+func (ef *exportFile) bytes() int64 {
+	return atomic.LoadInt64(&ef.written)
+}
+
+func newExportFile(ctx context.Context, c *cursor, fetchReq FetchReq) (*exportFile, error) {
+	opts := fetchReq.FetchOptions
+	format := exportFormats[opts.ExportFormat]
+
+	metas, err := c.columnMeta()
+	if err != nil {
+		return nil, err
+	}
+
+	ext := compressedExt(format.ext, opts.Compress)
+	if isSplit(opts) {
+		ext = MANIFEST_EXT
+	}
+
+	path, f, err := getExportFile(ctx, opts, exportVars{
+		db:     fetchReq.db,
+		table:  fetchReq.Table,
+		cursor: c.id,
+		format: opts.ExportFormat,
+	}, ext)
+
+	if err != nil {
+		utils.Dbg(ctx, fmt.Sprintf("failed creating file: %s", err))
+		return nil, err
+	}
+
+	ef := &exportFile{
+		opts:   opts,
+		format: format,
+		metas:  metas,
+		path:   path,
+		name:   path,
+	}
+
+	//parts are opened as rows arrive, the file holds the manifest
+	if isSplit(opts) {
+		ef.manifest = f
+		f, err = ef.openPart()
+		if err != nil {
+			utils.Dbg(ctx, fmt.Sprintf("failed creating part: %s", err))
+			ef.manifest.Close()
+			os.Remove(path)
+			return nil, err
+		}
+	}
+
+	if err := ef.startPart(f); err != nil {
+		utils.Dbg(ctx, fmt.Sprintf("error writing header to %s: %s", f.Name(), err))
+		ef.close(ctx, false)
+		return nil, err
+	}
+
+	//the temporary path means nothing to the browser
+	if opts.Download {
+		ef.name = filepath.Base(path)
+		ef.token = downloadStore.add(path, compressedType(format.contentType, opts.Compress))
+	}
+
+	if fetchReq.job != nil {
+		fetchReq.job.setFile(ef)
+	}
+
+	return ef, nil
+}
+
+//next part of a split export, named after the manifest
+func (ef *exportFile) openPart() (*os.File, error) {
+	dir := filepath.Dir(ef.path)
+	base := strings.TrimSuffix(filepath.Base(ef.path), "."+MANIFEST_EXT)
+	name := fmt.Sprintf("%s-%03d", base, len(ef.paths)+1)
+
+	f, err := openExportFile(dir, name, compressedExt(ef.format.ext, ef.opts.Compress), collisionPolicy(ef.opts))
+	if err != nil {
+		return nil, err
+	}
+
+	ef.paths = append(ef.paths, f.Name())
+	return f, nil
+}
+
+//start writing a document to f
+func (ef *exportFile) startPart(f *os.File) error {
+	if !isSplit(ef.opts) {
+		ef.paths = append(ef.paths, f.Name())
+	}
+
+	p, w, err := newExportPart(f, zipEntry(f.Name(), ef.format.ext), ef.opts.Compress, &ef.written)
+	if err != nil {
+		//there is no document to finish, close leaves it alone
+		f.Close()
+		return err
+	}
+
+	ef.part = p
+	ef.exp = ef.format.new(w, ef.opts)
+	return ef.exp.header(ef.metas)
+}
+
+func (ef *exportFile) finishPart() error {
+	if ef.part == nil {
+		return nil
+	}
+
+	err := ef.exp.close()
+
+	info, cerr := ef.part.close()
+	if err == nil {
+		err = cerr
+	}
+
+	ef.parts = append(ef.parts, info)
+	ef.part = nil
+	return err
+}
+
+func (ef *exportFile) partFull() bool {
+	return (ef.opts.SplitRows > 0 && ef.part.rows >= int64(ef.opts.SplitRows)) ||
+		(ef.opts.SplitBytes > 0 && ef.part.w.n >= int64(ef.opts.SplitBytes))
+}
+
+//write one row, moving to the next part first if this one is full
+func (ef *exportFile) row(vals []interface{}) error {
+	if isSplit(ef.opts) && ef.part.rows > 0 && ef.partFull() {
+		if err := ef.finishPart(); err != nil {
+			return err
+		}
+
+		f, err := ef.openPart()
+		if err != nil {
+			return err
+		}
+
+		if err := ef.startPart(f); err != nil {
+			return err
+		}
+	}
+
+	if err := ef.exp.row(vals); err != nil {
+		return err
+	}
+
+	ef.part.rows++
+	atomic.AddInt64(&ef.rows, 1)
+	return nil
+}
+
+//finish the document and close the file, writing the manifest of a split
+//export. An incomplete export is removed, along with its download token if
+//it has one
+func (ef *exportFile) close(ctx context.Context, complete bool) error {
+	if ef.closed {
+		return nil
+	}
+	ef.closed = true
+
+	err := ef.finishPart()
+	if err != nil {
+		utils.Dbg(ctx, fmt.Sprintf("error closing %s: %s", ef.name, err))
+	}
+
+	if ef.manifest != nil {
+		if complete && err == nil {
+			err = writeManifest(ef.manifest, &exportManifest{
+				Format:   ef.opts.ExportFormat,
+				Compress: ef.opts.Compress,
+				Rows:     atomic.LoadInt64(&ef.rows),
+				Parts:    ef.parts,
+			})
+		}
+
+		if cerr := ef.manifest.Close(); err == nil {
+			err = cerr
+		}
+	}
+
+	if complete && err == nil {
+		if ef.token != "" {
+			downloadStore.setReady(ef.token)
+		}
+		return nil
+	}
+
+	utils.Dbg(ctx, fmt.Sprintf("removing incomplete export %s", ef.path))
+	if ef.token != "" {
+		downloadStore.clear(ef.token)
+	} else {
+		os.Remove(ef.path)
+	}
+
+	for _, p := range ef.paths {
+		if p != ef.path {
+			os.Remove(p)
+		}
+	}
+
+	return err
+}
+
+//text of a value as it would appear in a delimited file
+func exportText(v interface{}, nullToken string) string {
+	if v == nil {
+		return nullToken
+	}
+
+	return textValue(v).(string)
+}
+
+//==============================================================//
+//          csv, tsv
+//==============================================================//
+type csvExporter struct {
+	w         *csvWriter
+	opts      FetchOptions
+	nullToken string
+	formats   []string //time format per column, see csvdialect.go
+	layouts   []string
+}
+
+func newCsvExporter(w io.Writer, opts FetchOptions) exporter {
+	return &csvExporter{w: newCsvWriter(w, ',', opts), opts: opts, nullToken: opts.NullToken}
+}
+
+func newTsvExporter(w io.Writer, opts FetchOptions) exporter {
+	return &csvExporter{w: newCsvWriter(w, '\t', opts), opts: opts, nullToken: opts.NullToken}
+}
+
+func (e *csvExporter) header(metas []*ColumnMeta) error {
+	e.layouts = make([]string, len(metas))
+	e.formats = make([]string, len(metas))
+	for i, m := range metas {
+		e.layouts[i], e.formats[i] = timeFormatOf(m, e.opts)
+	}
+
+	if e.opts.NoHeader {
+		return nil
+	}
+
+	return e.w.write(columnNames(metas), nil)
+}
+
+func (e *csvExporter) row(vals []interface{}) error {
+	r := make([]string, len(vals))
+	null := make([]bool, len(vals))
+	for i, v := range vals {
+		r[i] = exportText(v, e.nullToken)
+		null[i] = v == nil
+
+		if v != nil && e.formats[i] != "" {
+			r[i] = reformatTime(r[i], e.layouts[i], e.formats[i])
+		}
+	}
+
+	return e.w.write(r, null)
+}
+
+func (e *csvExporter) close() error {
+	return e.w.flush()
+}
+
+//==============================================================//
+//          json, ndjson
+//==============================================================//
+
+//one object per row with keys in column order. json writes an array of
+//them, ndjson one per line
+type jsonExporter struct {
+	w     *bufio.Writer
+	metas []*ColumnMeta
+	keys  [][]byte
+	lines bool
+	n     int
+}
+
+func newJsonExporter(w io.Writer, opts FetchOptions) exporter {
+	return &jsonExporter{w: bufio.NewWriter(w)}
+}
+
+func newNdjsonExporter(w io.Writer, opts FetchOptions) exporter {
+	return &jsonExporter{w: bufio.NewWriter(w), lines: true}
+}
+
+func (e *jsonExporter) header(metas []*ColumnMeta) error {
+	e.metas = metas
+	e.keys = make([][]byte, len(metas))
+	for i, m := range metas {
+		e.keys[i], _ = json.Marshal(m.Name)
+	}
+
+	if !e.lines {
+		_, err := e.w.WriteString("[\n")
+		return err
+	}
+
+	return nil
+}
+
+func (e *jsonExporter) row(vals []interface{}) error {
+	if !e.lines && e.n > 0 {
+		e.w.WriteString(",\n")
+	}
+
+	e.w.WriteByte('{')
+	for i, v := range vals {
+		if i > 0 {
+			e.w.WriteByte(',')
+		}
+
+		str, err := json.Marshal(typedValue(e.metas[i], v))
+		if err != nil {
+			return err
+		}
+
+		e.w.Write(e.keys[i])
+		e.w.WriteByte(':')
+		e.w.Write(str)
+	}
+	e.w.WriteByte('}')
+
+	if e.lines {
+		e.w.WriteByte('\n')
+	}
+
+	e.n++
+	return nil
+}
+
+func (e *jsonExporter) close() error {
+	if !e.lines {
+		if e.n > 0 {
+			e.w.WriteByte('\n')
+		}
+		e.w.WriteString("]\n")
+	}
+
+	return e.w.Flush()
+}
+
+//==============================================================//
+//          sql
+//==============================================================//
+
+//one INSERT statement per row
+type sqlExporter struct {
+	w      *bufio.Writer
+	table  string
+	metas  []*ColumnMeta
+	prefix string
+}
+
+func newSqlExporter(w io.Writer, opts FetchOptions) exporter {
+	return &sqlExporter{w: bufio.NewWriter(w), table: opts.Table}
+}
+
+func (e *sqlExporter) header(metas []*ColumnMeta) error {
+	e.metas = metas
+
+	cols := make([]string, len(metas))
+	for i, m := range metas {
+		cols[i] = quoteIdentifier(m.Name)
+	}
+
+	e.prefix = "INSERT INTO " + quoteIdentifier(e.table) +
+		" (" + strings.Join(cols, ", ") + ") VALUES ("
+
+	return nil
+}
+
+func (e *sqlExporter) row(vals []interface{}) error {
+	e.w.WriteString(e.prefix)
+
+	for i, v := range vals {
+		if i > 0 {
+			e.w.WriteString(", ")
+		}
+		e.w.WriteString(sqlLiteral(e.metas[i], v))
+	}
+
+	_, err := e.w.WriteString(");\n")
+	return err
+}
+
+func (e *sqlExporter) close() error {
+	return e.w.Flush()
+}
+
+func sqlLiteral(m *ColumnMeta, v interface{}) string {
+	if v == nil {
+		return "NULL"
+	}
+
+	if b, ok := v.([]byte); ok && m.Kind == KIND_BINARY {
+		return "X'" + hex.EncodeToString(b) + "'"
+	}
+
+	s := textValue(v).(string)
+	if isNumeric(m) {
+		return s
+	}
+
+	return quoteString(s)
+}
+
+//single quoted MySQL string literal
+func quoteString(s string) string {
+	var b strings.Builder
+	b.WriteByte('\'')
+
+	//byte by byte, so that invalid UTF-8 goes through untouched
+	for i := 0; i < len(s); i++ {
+		switch r := s[i]; r {
+		case '\'':
+			b.WriteString("''")
+		case '\\':
+			b.WriteString(`\\`)
+		case 0:
+			b.WriteString(`\0`)
+		case '\n':
+			b.WriteString(`\n`)
+		case '\r':
+			b.WriteString(`\r`)
+		case 0x1a:
+			b.WriteString(`\Z`)
+		default:
+			b.WriteByte(r)
+		}
+	}
+
+	b.WriteByte('\'')
+	return b.String()
+}
+
+//==============================================================//
+//          markdown
+//==============================================================//
+type markdownExporter struct {
+	w         *bufio.Writer
+	nullToken string
+}
+
+func newMarkdownExporter(w io.Writer, opts FetchOptions) exporter {
+	return &markdownExporter{w: bufio.NewWriter(w), nullToken: opts.NullToken}
+}
+
+func (e *markdownExporter) header(metas []*ColumnMeta) error {
+	names := columnNames(metas)
+	for i := range names {
+		names[i] = markdownEscape(names[i])
+	}
+	e.writeLine(names)
+
+	sep := make([]string, len(names))
+	for i := range sep {
+		sep[i] = "---"
+	}
+
+	return e.writeLine(sep)
+}
+
+func (e *markdownExporter) row(vals []interface{}) error {
+	r := make([]string, len(vals))
+	for i, v := range vals {
+		r[i] = markdownEscape(exportText(v, e.nullToken))
+	}
+
+	return e.writeLine(r)
+}
+
+func (e *markdownExporter) writeLine(cells []string) error {
+	_, err := e.w.WriteString("| " + strings.Join(cells, " | ") + " |\n")
+	return err
+}
+
+func (e *markdownExporter) close() error {
+	return e.w.Flush()
+}
+
+var markdownReplacer = strings.NewReplacer(
+	`\`, `\\`,
+	"|", `\|`,
+	"\r\n", "<br>",
+	"\n", "<br>",
+	"\r", "<br>",
+)
+
+func markdownEscape(s string) string {
+	return markdownReplacer.Replace(s)
+}
+
+//DECIMAL is sent as a string but is still a number in exported files
+func isNumeric(m *ColumnMeta) bool {
+	return m.Kind == KIND_NUMBER || m.Type == "DECIMAL"
+}
+
+func columnNames(metas []*ColumnMeta) []string {
+	names := make([]string, len(metas))
+	for i, m := range metas {
+		names[i] = m.Name
+	}
+
+	return names
+}
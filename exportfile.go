@@ -0,0 +1,310 @@
+/* Copyright (C) 2021 Pankaj Kargirwar <kargirwar@protonmail.com>
+
+   This file is part of prosql-agent
+
+   prosql-agent is free software: you can redistribute it and/or modify
+   it under the terms of the GNU General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   prosql-agent is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU General Public License for more details.
+
+   You should have received a copy of the GNU General Public License
+   along with prosql-agent.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+/* Where exported files go. The agent has a default export directory and a
+list of allowed directories, from [export] in the config file (see
+config.go):
+
+dir           default directory, ~/Downloads if not set
+allowed-dirs  more directories
+template      default file name template
+on-collision  suffix, overwrite or fail
+
+A request may pick a directory (relative ones are taken from the default
+directory), a file name template and a collision policy, but the file
+always ends up below one of the allowed directories. Templates may use
+{db}, {table}, {cursor}, {format}, {timestamp}, {date} and {time} */
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/kargirwar/prosql-agent/utils"
+)
+
+const DEFAULT_EXPORT_TEMPLATE = "query-results-{timestamp}"
+
+//give up looking for a free name after this many suffixes
+const MAX_EXPORT_SUFFIX = 1000
+
+type exportConfig struct {
+	dir       string
+	allowed   []string
+	template  string
+	collision string
+}
+
+func newExportConfig(dir string, allowed []string, template string, collision string) (*exportConfig, error) {
+	cfg := &exportConfig{
+		dir:       dir,
+		template:  template,
+		collision: collision,
+	}
+
+	if cfg.dir == "" {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			home = ""
+		}
+		cfg.dir = filepath.Join(home, "Downloads")
+	}
+
+	if abs, err := filepath.Abs(cfg.dir); err == nil {
+		cfg.dir = abs
+	}
+
+	cfg.allowed = []string{cfg.dir}
+	for _, d := range allowed {
+		if abs, err := filepath.Abs(d); err == nil && d != "" {
+			cfg.allowed = append(cfg.allowed, abs)
+		}
+	}
+
+	if cfg.template == "" {
+		cfg.template = DEFAULT_EXPORT_TEMPLATE
+	}
+
+	if err := checkCollision(cfg.collision); err != nil {
+		return nil, err
+	}
+
+	return cfg, nil
+}
+
+func checkCollision(collision string) error {
+	switch collision {
+	case COLLISION_SUFFIX, COLLISION_OVERWRITE, COLLISION_FAIL:
+		return nil
+	}
+
+	return errors.New(ERR_INVALID_COLLISION)
+}
+
+//whether path is one of the allowed directories or below one of them. Both
+//the path and the directories are compared as given and with symlinks
+//resolved
+func (cfg *exportConfig) allows(path string) bool {
+	for _, root := range cfg.allowed {
+		roots := []string{root}
+		if real, err := filepath.EvalSymlinks(root); err == nil {
+			roots = append(roots, real)
+		}
+
+		for _, r := range roots {
+			rel, err := filepath.Rel(r, path)
+			if err != nil {
+				continue
+			}
+
+			if rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+//whether the part of dir which already exists is allowed once symlinks are
+//resolved. Nothing needs to be checked if even the allowed directory does
+//not exist yet
+func (cfg *exportConfig) allowsBelow(dir string) bool {
+	d := dir
+	for {
+		real, err := filepath.EvalSymlinks(d)
+		if err == nil {
+			return !cfg.allows(d) || cfg.allows(real)
+		}
+
+		parent := filepath.Dir(d)
+		if !os.IsNotExist(err) || parent == d {
+			return false
+		}
+		d = parent
+	}
+}
+
+//what the file name template is filled in with
+type exportVars struct {
+	db     string
+	table  string
+	cursor string
+	format string
+}
+
+func expandTemplate(template string, vars exportVars, t time.Time) string {
+	r := strings.NewReplacer(
+		"{db}", sanitizeFileName(vars.db),
+		"{table}", sanitizeFileName(vars.table),
+		"{cursor}", sanitizeFileName(vars.cursor),
+		"{format}", sanitizeFileName(vars.format),
+		"{timestamp}", t.Format("2006-01-02T15-04-05"),
+		"{date}", t.Format("2006-01-02"),
+		"{time}", t.Format("15-04-05"),
+	)
+
+	return r.Replace(template)
+}
+
+//replace characters which can't be, or shouldn't be, in a file name
+func sanitizeFileName(s string) string {
+	return strings.Map(func(r rune) rune {
+		if r < 32 || strings.ContainsRune(`/\:*?"<>|`, r) {
+			return '_'
+		}
+		return r
+	}, s)
+}
+
+func exportDir(opts FetchOptions) (string, error) {
+	cfg := getConfig().export
+
+	dir := cfg.dir
+	if opts.ExportDir != "" {
+		dir = opts.ExportDir
+		if !filepath.IsAbs(dir) {
+			dir = filepath.Join(cfg.dir, dir)
+		}
+	}
+	dir = filepath.Clean(dir)
+
+	//check before creating anything
+	if !cfg.allows(dir) {
+		return "", errors.New(ERR_INVALID_EXPORT_PATH)
+	}
+
+	//the default directory is always created, others only when asked
+	if opts.Mkdir || dir == cfg.dir {
+		//MkdirAll would follow a symlink out of the allowed directories
+		if !cfg.allowsBelow(dir) {
+			return "", errors.New(ERR_INVALID_EXPORT_PATH)
+		}
+
+		if err := os.MkdirAll(dir, 0700); err != nil {
+			return "", err
+		}
+	}
+
+	//and again once symlinks are resolved
+	real, err := filepath.EvalSymlinks(dir)
+	if os.IsNotExist(err) {
+		return "", errors.New("Export directory does not exist")
+	}
+
+	if err != nil {
+		return "", err
+	}
+
+	if !cfg.allows(real) {
+		return "", errors.New(ERR_INVALID_EXPORT_PATH)
+	}
+
+	return real, nil
+}
+
+func getExportFile(ctx context.Context, opts FetchOptions, vars exportVars, ext string) (string, *os.File, error) {
+	var dir string
+	var err error
+
+	if opts.Download {
+		dir, err = downloadDir()
+	} else {
+		dir, err = exportDir(opts)
+	}
+
+	if err != nil {
+		utils.Dbg(ctx, fmt.Sprintf("invalid export dir %s: %s", opts.ExportDir, err))
+		return "", nil, err
+	}
+
+	template := opts.FileName
+	if template == "" {
+		template = getConfig().export.template
+	}
+
+	collision := collisionPolicy(opts)
+
+	//never clobber another pending download
+	if opts.Download {
+		collision = COLLISION_SUFFIX
+	}
+
+	name := expandTemplate(template, vars, time.Now())
+	if name == "" || name != filepath.Base(name) || strings.ContainsAny(name, `/\`) {
+		return "", nil, errors.New(ERR_INVALID_EXPORT_PATH)
+	}
+
+	f, err := openExportFile(dir, name, ext, collision)
+	if err != nil {
+		utils.Dbg(ctx, fmt.Sprintf("failed creating file: %s", err))
+		return "", nil, err
+	}
+
+	return f.Name(), f, nil
+}
+
+func collisionPolicy(opts FetchOptions) string {
+	if opts.OnCollision != "" {
+		return opts.OnCollision
+	}
+
+	return getConfig().export.collision
+}
+
+func openExportFile(dir string, name string, ext string, collision string) (*os.File, error) {
+	path := filepath.Join(dir, name+"."+ext)
+
+	switch collision {
+	case COLLISION_OVERWRITE:
+		//never follow a symlink out of the export directory
+		if fi, err := os.Lstat(path); err == nil && fi.Mode()&os.ModeSymlink != 0 {
+			return nil, errors.New(ERR_INVALID_EXPORT_PATH)
+		}
+		return os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+
+	case COLLISION_FAIL:
+		f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+		if os.IsExist(err) {
+			return nil, errors.New(ERR_EXPORT_FILE_EXISTS)
+		}
+		return f, err
+	}
+
+	//suffix: name.ext, name-1.ext, name-2.ext ...
+	for i := 0; i < MAX_EXPORT_SUFFIX; i++ {
+		if i > 0 {
+			path = filepath.Join(dir, name+"-"+strconv.Itoa(i)+"."+ext)
+		}
+
+		f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+		if os.IsExist(err) {
+			continue
+		}
+		return f, err
+	}
+
+	return nil, errors.New(ERR_EXPORT_FILE_EXISTS)
+}
@@ -0,0 +1,220 @@
+/* Copyright (C) 2021 Pankaj Kargirwar <kargirwar@protonmail.com>
+
+   This file is part of prosql-agent
+
+   prosql-agent is free software: you can redistribute it and/or modify
+   it under the terms of the GNU General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   prosql-agent is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU General Public License for more details.
+
+   You should have received a copy of the GNU General Public License
+   along with prosql-agent.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+//export to a fresh default directory with one more allowed directory.
+//Returns both, symlinks resolved
+func withExportDirs(t *testing.T) (string, string) {
+	base, err := filepath.EvalSymlinks(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dir := filepath.Join(base, "exports")
+	other := filepath.Join(base, "other")
+	if err := os.MkdirAll(other, 0700); err != nil {
+		t.Fatal(err)
+	}
+
+	export, err := newExportConfig(dir, []string{other}, "", COLLISION_SUFFIX)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	saved := getConfig()
+	cfg := *saved
+	cfg.export = export
+	setConfig(&cfg)
+	t.Cleanup(func() {
+		setConfig(saved)
+	})
+
+	return dir, other
+}
+
+func TestExportDirSandbox(t *testing.T) {
+	dir, other := withExportDirs(t)
+	base := filepath.Dir(dir)
+
+	outside := filepath.Join(base, "outside")
+	if err := os.MkdirAll(outside, 0700); err != nil {
+		t.Fatal(err)
+	}
+
+	//links from inside the sandbox to outside and to another allowed directory
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink(outside, filepath.Join(dir, "escape")); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink(other, filepath.Join(dir, "to-other")); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name string
+		opts FetchOptions
+		want string //empty if the directory must be rejected
+	}{
+		{"default", FetchOptions{}, dir},
+		{"relative", FetchOptions{ExportDir: "sub", Mkdir: true}, filepath.Join(dir, "sub")},
+		{"dot dot", FetchOptions{ExportDir: "..", Mkdir: true}, ""},
+		{"dot dot outside", FetchOptions{ExportDir: "../outside"}, ""},
+		{"dot dot inside", FetchOptions{ExportDir: "sub/../../outside"}, ""},
+		{"dot dot back in", FetchOptions{ExportDir: "../exports/sub"}, filepath.Join(dir, "sub")},
+		{"absolute allowed", FetchOptions{ExportDir: other}, other},
+		{"absolute outside", FetchOptions{ExportDir: outside}, ""},
+		{"absolute root", FetchOptions{ExportDir: "/"}, ""},
+		{"absolute dot dot", FetchOptions{ExportDir: other + "/../outside"}, ""},
+		{"symlink outside", FetchOptions{ExportDir: "escape"}, ""},
+		{"below symlink outside", FetchOptions{ExportDir: "escape/sub", Mkdir: true}, ""},
+		{"symlink to allowed", FetchOptions{ExportDir: "to-other"}, other},
+	}
+
+	for _, tt := range tests {
+		got, err := exportDir(tt.opts)
+		if tt.want == "" {
+			if err == nil {
+				t.Errorf("%s: expected %s to be rejected got %s\n", tt.name, tt.opts.ExportDir, got)
+			}
+			continue
+		}
+
+		if err != nil || got != tt.want {
+			t.Errorf("%s: expected %s got %s, %v\n", tt.name, tt.want, got, err)
+		}
+	}
+
+	//nothing may have been created outside while checking
+	if _, err := os.Stat(filepath.Join(outside, "sub")); !os.IsNotExist(err) {
+		t.Errorf("directory created outside the sandbox\n")
+	}
+}
+
+func TestExportFileNameSandbox(t *testing.T) {
+	dir, _ := withExportDirs(t)
+	ctx := context.Background()
+
+	for _, name := range []string{"../escape", "sub/file", `sub\file`, "/etc/passwd"} {
+		_, _, err := getExportFile(ctx, FetchOptions{FileName: name}, exportVars{}, "csv")
+		if err == nil || err.Error() != ERR_INVALID_EXPORT_PATH {
+			t.Errorf("expected file name %q to be rejected got %v\n", name, err)
+		}
+	}
+
+	//path separators coming in through the template variables are replaced
+	path, f, err := getExportFile(ctx, FetchOptions{FileName: "{db}-{table}"},
+		exportVars{db: "../..", table: "a/b"}, "csv")
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+
+	if filepath.Dir(path) != dir {
+		t.Errorf("expected %s in %s\n", path, dir)
+	}
+}
+
+func TestExportOverwriteSymlink(t *testing.T) {
+	dir, _ := withExportDirs(t)
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		t.Fatal(err)
+	}
+
+	target := filepath.Join(filepath.Dir(dir), "target.csv")
+	if err := os.WriteFile(target, []byte("keep"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := os.Symlink(target, filepath.Join(dir, "results.csv")); err != nil {
+		t.Fatal(err)
+	}
+
+	_, err := openExportFile(dir, "results", "csv", COLLISION_OVERWRITE)
+	if err == nil || err.Error() != ERR_INVALID_EXPORT_PATH {
+		t.Errorf("expected overwriting through a symlink to be rejected got %v\n", err)
+	}
+
+	if b, _ := os.ReadFile(target); string(b) != "keep" {
+		t.Errorf("file outside the sandbox was overwritten\n")
+	}
+}
+
+type failingExporter struct{}
+
+func (failingExporter) header(metas []*ColumnMeta) error {
+	return errors.New("disk full")
+}
+
+func (failingExporter) row(vals []interface{}) error {
+	return nil
+}
+
+func (failingExporter) close() error {
+	return nil
+}
+
+func TestExportHeaderFailure(t *testing.T) {
+	dir, _ := withExportDirs(t)
+
+	exportFormats["failing"] = exportFormat{"txt", "text/plain", func(w io.Writer, opts FetchOptions) exporter {
+		return failingExporter{}
+	}}
+	t.Cleanup(func() {
+		delete(exportFormats, "failing")
+	})
+
+	c := &cursor{id: "c1", columns: []*ColumnMeta{{Name: "id", Type: "INT", Kind: KIND_NUMBER}}}
+
+	tests := []struct {
+		name string
+		opts FetchOptions
+	}{
+		{"plain", FetchOptions{Export: true, ExportFormat: "failing"}},
+		{"zip", FetchOptions{Export: true, ExportFormat: "failing", Compress: COMPRESS_ZIP}},
+		{"split", FetchOptions{Export: true, ExportFormat: "failing", SplitRows: 10}},
+	}
+
+	for _, test := range tests {
+		ef, err := newExportFile(context.Background(), c, FetchReq{FetchOptions: test.opts})
+		if err == nil {
+			t.Errorf("%s: expected the header error got %+v\n", test.name, ef)
+			continue
+		}
+
+		entries, err := os.ReadDir(dir)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		for _, e := range entries {
+			t.Errorf("%s: expected no files left got %s\n", test.name, e.Name())
+		}
+	}
+}
@@ -0,0 +1,412 @@
+/* Copyright (C) 2021 Pankaj Kargirwar <kargirwar@protonmail.com>
+
+   This file is part of prosql-agent
+
+   prosql-agent is free software: you can redistribute it and/or modify
+   it under the terms of the GNU General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   prosql-agent is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU General Public License for more details.
+
+   You should have received a copy of the GNU General Public License
+   along with prosql-agent.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+/* Every export runs as a job owned by its session, so it carries on when
+the websocket which started it goes away. Progress messages are passed on
+to whichever websockets are attached at the time. A websocket which
+attaches later first gets the current state:
+
+{"k": ["job", "<cursor-id>", "<job-id>"]}
+{"k": ["header", "<cursor-id>", "<file>", "<token>"]}   once rows are written
+{"k": ["current-row", "<rows>"]}
+{"k": ["eos"]}                                          if the job is done
+
+A cancelled or failed job removes its partial file */
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/dchest/uniuri"
+	"github.com/gorilla/websocket"
+	"github.com/kargirwar/prosql-agent/utils"
+)
+
+type exportJob struct {
+	id       string
+	cursorId string
+	format   string
+	encoding string
+	started  time.Time
+	ended    time.Time
+	status   string
+	err      error
+
+	ef        *exportFile
+	listeners []wsWriter
+	cancel    context.CancelFunc
+	cancelled bool
+	done      chan struct{}
+	mutex     sync.Mutex
+}
+
+type ExportJobStatus struct {
+	Id       string  `json:"job-id"`
+	CursorId string  `json:"cursor-id"`
+	Format   string  `json:"format"`
+	Status   string  `json:"status"`
+	File     string  `json:"file,omitempty"`
+	Token    string  `json:"token,omitempty"`
+	Rows     int64   `json:"rows"`
+	Bytes    int64   `json:"bytes"`
+	Elapsed  float64 `json:"elapsed"` //seconds
+	Error    string  `json:"error,omitempty"`
+
+	DbError *utils.DbError `json:"db-error,omitempty"`
+}
+
+func newExportJob(cid string, opts FetchOptions) *exportJob {
+	return &exportJob{
+		id:       uniuri.New(),
+		cursorId: cid,
+		format:   opts.ExportFormat,
+		encoding: opts.Encoding,
+		started:  time.Now(),
+		status:   JOB_RUNNING,
+		done:     make(chan struct{}),
+	}
+}
+
+//run the export on the session. The job has its own context, it must not
+//end with the request which started it
+func (j *exportJob) start(s *session, n int, opts FetchOptions) {
+	ctx, cancel := context.WithCancel(utils.WithRequestId(context.Background(), j.id))
+
+	j.mutex.Lock()
+	j.cancel = cancel
+	j.mutex.Unlock()
+
+	go func() {
+		defer cancel()
+		defer utils.TimeTrack(ctx, time.Now())
+
+		_, err := s.request(&Req{
+			ctx:  ctx,
+			code: CMD_FETCH_WS,
+			fetch: FetchReq{
+				FetchOptions: opts,
+				cid:          j.cursorId,
+				n:            n,
+				ws:           j,
+				job:          j,
+			},
+		})
+
+		utils.Dbg(ctx, fmt.Sprintf("EXPORT s: %s c: %s j: %s err %v\n", s.id, j.cursorId, j.id, err))
+		j.finish(err)
+	}()
+}
+
+func (j *exportJob) finish(err error) {
+	j.mutex.Lock()
+	defer j.mutex.Unlock()
+
+	j.ended = time.Now()
+	j.err = err
+
+	switch {
+	case j.cancelled:
+		j.status = JOB_CANCELLED
+		j.err = errors.New(ERR_JOB_CANCELLED)
+	case err != nil:
+		j.status = JOB_FAILED
+	default:
+		j.status = JOB_DONE
+	}
+
+	close(j.done)
+}
+
+func (j *exportJob) stop() error {
+	j.mutex.Lock()
+	defer j.mutex.Unlock()
+
+	if j.status != JOB_RUNNING {
+		return errors.New(ERR_JOB_NOT_RUNNING)
+	}
+
+	j.cancelled = true
+	if j.cancel != nil {
+		j.cancel()
+	}
+
+	return nil
+}
+
+func (j *exportJob) setFile(ef *exportFile) {
+	j.mutex.Lock()
+	defer j.mutex.Unlock()
+	j.ef = ef
+}
+
+func (j *exportJob) error() error {
+	j.mutex.Lock()
+	defer j.mutex.Unlock()
+	return j.err
+}
+
+//wsWriter. Progress goes to every attached websocket, one which fails is
+//dropped. The export itself never fails because of a websocket
+func (j *exportJob) WriteMessage(messageType int, data []byte) error {
+	j.mutex.Lock()
+	defer j.mutex.Unlock()
+
+	live := j.listeners[:0]
+	for _, l := range j.listeners {
+		if err := l.WriteMessage(messageType, data); err == nil {
+			live = append(live, l)
+		}
+	}
+	j.listeners = live
+
+	return nil
+}
+
+//send the current state and then pass on progress as it comes
+func (j *exportJob) attach(ws wsWriter) error {
+	j.mutex.Lock()
+	defer j.mutex.Unlock()
+
+	cd := codecFor(j.encoding)
+
+	msgs := []*res{{K: []string{"job", j.cursorId, j.id}}}
+
+	if rows := j.rows(); rows > 0 {
+		k := []string{"header", j.cursorId, j.ef.name}
+		if j.ef.token != "" {
+			k = append(k, j.ef.token)
+		}
+		msgs = append(msgs, &res{K: k}, &res{K: []string{"current-row", strconv.FormatInt(rows, 10)}})
+	}
+
+	if j.status == JOB_DONE {
+		msgs = append(msgs, &res{K: []string{"eos"}})
+	}
+
+	for _, m := range msgs {
+		if err := sendMsg(ws, cd, m); err != nil {
+			return err
+		}
+	}
+
+	if j.status == JOB_RUNNING {
+		j.listeners = append(j.listeners, ws)
+	}
+
+	return nil
+}
+
+func (j *exportJob) detach(ws wsWriter) {
+	j.mutex.Lock()
+	defer j.mutex.Unlock()
+
+	for i, l := range j.listeners {
+		if l == ws {
+			j.listeners = append(j.listeners[:i], j.listeners[i+1:]...)
+			return
+		}
+	}
+}
+
+//caller holds the mutex
+func (j *exportJob) rows() int64 {
+	if j.ef == nil {
+		return 0
+	}
+	return atomic.LoadInt64(&j.ef.rows)
+}
+
+func (j *exportJob) snapshot() *ExportJobStatus {
+	j.mutex.Lock()
+	defer j.mutex.Unlock()
+
+	st := &ExportJobStatus{
+		Id:       j.id,
+		CursorId: j.cursorId,
+		Format:   j.format,
+		Status:   j.status,
+		Rows:     j.rows(),
+	}
+
+	if j.ef != nil {
+		st.File = j.ef.name
+		st.Token = j.ef.token
+		st.Bytes = j.ef.bytes()
+	}
+
+	end := j.ended
+	if j.status == JOB_RUNNING {
+		end = time.Now()
+	}
+	st.Elapsed = end.Sub(j.started).Seconds()
+
+	if j.err != nil {
+		st.Error = j.err.Error()
+		st.DbError = utils.DbErrorOf(j.err)
+	}
+
+	return st
+}
+
+func (j *exportJob) isRunning() bool {
+	j.mutex.Lock()
+	defer j.mutex.Unlock()
+	return j.status == JOB_RUNNING
+}
+
+//retention counts from the end of the job, however long it ran
+func (j *exportJob) endedBefore(t time.Time) bool {
+	j.mutex.Lock()
+	defer j.mutex.Unlock()
+	return j.status != JOB_RUNNING && j.ended.Before(t)
+}
+
+//error message for a websocket whose job failed, same as fetch_ws sends
+func jobErrorMsg(err error) []byte {
+	str, _ := json.Marshal(utils.ErrorResponse(err, ERR_DB_ERROR))
+	return str
+}
+
+//==============================================================//
+//          jobs of a session
+//==============================================================//
+type exportJobs struct {
+	store map[string]*exportJob
+	mutex sync.Mutex
+}
+
+func newExportJobs() *exportJobs {
+	return &exportJobs{
+		store: make(map[string]*exportJob),
+	}
+}
+
+func (js *exportJobs) add(j *exportJob) {
+	js.mutex.Lock()
+	defer js.mutex.Unlock()
+	js.store[j.id] = j
+}
+
+func (js *exportJobs) get(jid string) (*exportJob, error) {
+	js.mutex.Lock()
+	defer js.mutex.Unlock()
+
+	j, present := js.store[jid]
+	if !present {
+		return nil, errors.New(ERR_INVALID_JOB_ID)
+	}
+
+	return j, nil
+}
+
+//forget jobs which ended more than timeouts.export-job-retention ago. Run
+//by the session cleanup, and before listing
+func (js *exportJobs) expire() {
+	js.mutex.Lock()
+	defer js.mutex.Unlock()
+
+	before := time.Now().Add(-getConfig().Timeouts.ExportJobRetention.Duration)
+	for k, j := range js.store {
+		if j.endedBefore(before) {
+			delete(js.store, k)
+		}
+	}
+}
+
+func (js *exportJobs) list() []*ExportJobStatus {
+	js.expire()
+
+	js.mutex.Lock()
+	defer js.mutex.Unlock()
+
+	list := []*ExportJobStatus{}
+	for _, j := range js.store {
+		list = append(list, j.snapshot())
+	}
+
+	//oldest first
+	sort.Slice(list, func(a, b int) bool {
+		return js.store[list[a].Id].started.Before(js.store[list[b].Id].started)
+	})
+
+	return list
+}
+
+func (js *exportJobs) running() bool {
+	js.mutex.Lock()
+	defer js.mutex.Unlock()
+
+	for _, j := range js.store {
+		if j.isRunning() {
+			return true
+		}
+	}
+
+	return false
+}
+
+//whether cursor cid belongs to a running job
+func (js *exportJobs) exporting(cid string) bool {
+	js.mutex.Lock()
+	defer js.mutex.Unlock()
+
+	for _, j := range js.store {
+		if j.cursorId == cid && j.isRunning() {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (js *exportJobs) stopAll() {
+	js.mutex.Lock()
+	defer js.mutex.Unlock()
+
+	for _, j := range js.store {
+		j.stop()
+	}
+}
+
+//wait for the job while ws is attached. Returns early if the websocket
+//goes away, the job carries on
+func waitForJob(ws *websocket.Conn, j *exportJob) {
+	gone := make(chan struct{})
+	go func() {
+		for {
+			if _, _, err := ws.ReadMessage(); err != nil {
+				close(gone)
+				return
+			}
+		}
+	}()
+
+	select {
+	case <-j.done:
+	case <-gone:
+	}
+}
@@ -0,0 +1,96 @@
+/* Copyright (C) 2021 Pankaj Kargirwar <kargirwar@protonmail.com>
+
+   This file is part of prosql-agent
+
+   prosql-agent is free software: you can redistribute it and/or modify
+   it under the terms of the GNU General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   prosql-agent is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU General Public License for more details.
+
+   You should have received a copy of the GNU General Public License
+   along with prosql-agent.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestExportJobRetention(t *testing.T) {
+	saved := getConfig()
+	cfg := *saved
+	cfg.Timeouts.ExportJobRetention = duration{time.Minute}
+	setConfig(&cfg)
+	t.Cleanup(func() {
+		setConfig(saved)
+	})
+
+	js := newExportJobs()
+	long := time.Now().Add(-time.Hour)
+
+	//ran for an hour and just ended
+	recent := newExportJob("c1", FetchOptions{})
+	recent.started = long
+	recent.finish(nil)
+	js.add(recent)
+
+	old := newExportJob("c2", FetchOptions{})
+	old.started = long
+	old.finish(nil)
+	old.ended = long.Add(time.Second)
+	js.add(old)
+
+	running := newExportJob("c3", FetchOptions{})
+	running.started = long
+	js.add(running)
+
+	//without anybody listing the jobs
+	js.expire()
+	if _, err := js.get(old.id); err == nil {
+		t.Errorf("expected job %s to be gone\n", old.id)
+	}
+
+	list := js.list()
+	if len(list) != 2 || (list[0].Id != recent.id && list[1].Id != recent.id) {
+		t.Errorf("expected the recent and the running job got %+v\n", list)
+	}
+
+	if !js.running() {
+		t.Errorf("expected a running job\n")
+	}
+}
+
+func TestCancelWith(t *testing.T) {
+	//a job cancelled while its query runs cancels the cursor
+	c := createCursor(context.Background(), "select 1", false)
+	ctx, cancel := context.WithCancel(context.Background())
+	stop := cancelWith(ctx, c)
+	cancel()
+
+	select {
+	case <-c.ctx.Done():
+	case <-time.After(time.Second):
+		t.Errorf("expected the cursor to be cancelled\n")
+	}
+	stop()
+
+	//once the query has started the job's end leaves the cursor alone
+	c = createCursor(context.Background(), "select 1", false)
+	ctx, cancel = context.WithCancel(context.Background())
+	stop = cancelWith(ctx, c)
+	stop()
+	cancel()
+
+	time.Sleep(10 * time.Millisecond)
+	if c.ctx.Err() != nil {
+		t.Errorf("expected the cursor to be left alone\n")
+	}
+}
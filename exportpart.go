@@ -0,0 +1,198 @@
+/* Copyright (C) 2021 Pankaj Kargirwar <kargirwar@protonmail.com>
+
+   This file is part of prosql-agent
+
+   prosql-agent is free software: you can redistribute it and/or modify
+   it under the terms of the GNU General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   prosql-agent is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU General Public License for more details.
+
+   You should have received a copy of the GNU General Public License
+   along with prosql-agent.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+/* Export files may be compressed as they are written and split into parts.
+
+compress     gzip gives results.csv.gz, zip gives results.zip holding
+             results.csv
+split-rows   start a new part after this many rows
+split-bytes  start a new part once this many bytes reached the disk. With
+             compression the check lags by whatever the compressor buffers
+
+Every part is a complete document with its own header. A split export is
+known by its manifest, which is written once the last part is complete:
+
+{"format": "csv", "compress": "gzip", "rows": 2500000, "parts": [
+    {"file": "results-001.csv.gz", "rows": 1000000, "bytes": 9912331, "sha256": "..."},
+    ...
+]}
+
+Parts live next to the manifest and are named after it. Split exports
+can't be downloaded, there would be nothing to hand out a token for */
+
+package main
+
+import (
+	"archive/zip"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"hash"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+)
+
+const MANIFEST_EXT = "manifest.json"
+
+type partInfo struct {
+	File   string `json:"file"`
+	Rows   int64  `json:"rows"`
+	Bytes  int64  `json:"bytes"`
+	Sha256 string `json:"sha256"`
+}
+
+type exportManifest struct {
+	Format   string      `json:"format"`
+	Compress string      `json:"compress,omitempty"`
+	Rows     int64       `json:"rows"`
+	Parts    []*partInfo `json:"parts"`
+}
+
+//counts bytes as they reach the file. total is shared by all parts of an
+//export and read by the export job
+type countingWriter struct {
+	w     io.Writer
+	n     int64
+	total *int64 //atomic
+}
+
+func (cw *countingWriter) Write(p []byte) (int, error) {
+	n, err := cw.w.Write(p)
+	cw.n += int64(n)
+	atomic.AddInt64(cw.total, int64(n))
+	return n, err
+}
+
+//one file of an export
+type exportPart struct {
+	f    *os.File
+	path string
+	w    *countingWriter
+	hash hash.Hash
+	cz   io.Closer //compressor, nil if none
+	rows int64
+}
+
+func checkCompression(compress string) error {
+	switch compress {
+	case "", COMPRESS_GZIP, COMPRESS_ZIP:
+		return nil
+	}
+
+	return errors.New(ERR_INVALID_COMPRESSION)
+}
+
+func checkSplit(opts *FetchOptions) error {
+	if opts.SplitRows < 0 || opts.SplitBytes < 0 {
+		return errors.New(ERR_INVALID_SPLIT)
+	}
+
+	if isSplit(*opts) && opts.Download {
+		return errors.New(ERR_INVALID_SPLIT)
+	}
+
+	return nil
+}
+
+func isSplit(opts FetchOptions) bool {
+	return opts.SplitRows > 0 || opts.SplitBytes > 0
+}
+
+//extension of the files, ext being that of the export format
+func compressedExt(ext string, compress string) string {
+	switch compress {
+	case COMPRESS_GZIP:
+		return ext + ".gz"
+	case COMPRESS_ZIP:
+		return "zip"
+	}
+
+	return ext
+}
+
+func compressedType(contentType string, compress string) string {
+	switch compress {
+	case COMPRESS_GZIP:
+		return "application/gzip"
+	case COMPRESS_ZIP:
+		return "application/zip"
+	}
+
+	return contentType
+}
+
+//set up writing to f. The returned writer is what the exporter writes to,
+//entry is the name of the file inside a zip
+func newExportPart(f *os.File, entry string, compress string, total *int64) (*exportPart, io.Writer, error) {
+	p := &exportPart{
+		f:    f,
+		path: f.Name(),
+		hash: sha256.New(),
+	}
+	p.w = &countingWriter{w: io.MultiWriter(f, p.hash), total: total}
+
+	switch compress {
+	case COMPRESS_GZIP:
+		gz := gzip.NewWriter(p.w)
+		p.cz = gz
+		return p, gz, nil
+
+	case COMPRESS_ZIP:
+		zw := zip.NewWriter(p.w)
+		p.cz = zw
+		w, err := zw.Create(entry)
+		return p, w, err
+	}
+
+	return p, p.w, nil
+}
+
+//flush the compressor and close the file
+func (p *exportPart) close() (*partInfo, error) {
+	var err error
+	if p.cz != nil {
+		err = p.cz.Close()
+	}
+
+	if cerr := p.f.Close(); err == nil {
+		err = cerr
+	}
+
+	return &partInfo{
+		File:   filepath.Base(p.path),
+		Rows:   p.rows,
+		Bytes:  p.w.n,
+		Sha256: hex.EncodeToString(p.hash.Sum(nil)),
+	}, err
+}
+
+//name of the file inside a zip: the part's name with the format's extension
+func zipEntry(path string, ext string) string {
+	return strings.TrimSuffix(filepath.Base(path), ".zip") + "." + ext
+}
+
+func writeManifest(f *os.File, m *exportManifest) error {
+	enc := json.NewEncoder(f)
+	enc.SetIndent("", "    ")
+	return enc.Encode(m)
+}
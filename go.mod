@@ -3,17 +3,22 @@ module github.com/kargirwar/prosql-agent
 go 1.17
 
 require (
+	github.com/BurntSushi/toml v0.4.1
 	github.com/dchest/uniuri v0.0.0-20200228104902-7aecb25e1fe5
 	github.com/denisbrodbeck/machineid v1.0.1
-	github.com/go-sql-driver/mysql v1.6.0
+	github.com/fxamacker/cbor/v2 v2.4.0
+	github.com/go-sql-driver/mysql v1.7.1
 	github.com/gorilla/mux v1.8.0
 	github.com/gorilla/websocket v1.4.2
 	github.com/sirupsen/logrus v1.8.1
+	github.com/vmihailenco/msgpack/v5 v5.3.5
+	golang.org/x/crypto v0.8.0
 	gopkg.in/natefinch/lumberjack.v2 v2.0.0
 )
 
 require (
-	github.com/BurntSushi/toml v0.4.1 // indirect
-	golang.org/x/sys v0.0.0-20191026070338-33540a1f6037 // indirect
+	github.com/vmihailenco/tagparser/v2 v2.0.0 // indirect
+	github.com/x448/float16 v0.8.4 // indirect
+	golang.org/x/sys v0.7.0 // indirect
 	gopkg.in/yaml.v2 v2.4.0 // indirect
 )
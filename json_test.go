@@ -1,3 +1,6 @@
+//go:build integration
+// +build integration
+
 /* Copyright (C) 2021 Pankaj Kargirwar <kargirwar@protonmail.com>
 
    This file is part of prosql-agent
@@ -28,6 +31,7 @@ import (
 	"unicode/utf8"
 
 	_ "github.com/go-sql-driver/mysql"
+	"github.com/kargirwar/prosql-agent/utils"
 )
 
 func TestJson(t *testing.T) {
@@ -49,7 +53,7 @@ func TestJson(t *testing.T) {
 	data := fetchAll(t, ctx, pool)
 	fmt.Println(data)
 
-	res := &Response{
+	res := &utils.Response{
 		Data: data,
 	}
 
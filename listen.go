@@ -0,0 +1,216 @@
+/* Copyright (C) 2021 Pankaj Kargirwar <kargirwar@protonmail.com>
+
+   This file is part of prosql-agent
+
+   prosql-agent is free software: you can redistribute it and/or modify
+   it under the terms of the GNU General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   prosql-agent is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU General Public License for more details.
+
+   You should have received a copy of the GNU General Public License
+   along with prosql-agent.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+/* Where the agent listens, from [listen] in the config file, see config.go:
+
+address     address to bind, 127.0.0.1 by default
+port        port to try first, PORT by default
+port-range  ports tried in order when it is taken, 23891-23899 by
+            default. "none" gives up right away
+tls         serve HTTPS, see tlscert.go
+
+What the agent ended up on is written to agent.json in the agent's
+directory, for tools which need to find it:
+
+{"scheme": "http", "address": "127.0.0.1", "port": 23891,
+ "url": "http://127.0.0.1:23891", "pid": 4242, "version": "0.6.3"}
+
+The file is removed when the agent is stopped */
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"github.com/kargirwar/prosql-agent/utils"
+	log "github.com/sirupsen/logrus"
+)
+
+const DEFAULT_LISTEN_ADDRESS = "127.0.0.1"
+const DEFAULT_PORT_RANGE = "23891-23899"
+const DISCOVERY_FILE = "agent.json"
+
+type listenConfig struct {
+	address  string
+	port     int
+	fallback []int
+	tls      bool
+}
+
+type discovery struct {
+	Scheme  string `json:"scheme"`
+	Address string `json:"address"`
+	Port    int    `json:"port"`
+	Url     string `json:"url"`
+	Pid     int    `json:"pid"`
+	Version string `json:"version"`
+	Ca      string `json:"ca,omitempty"` //to be trusted for HTTPS
+}
+
+//invalid settings are errors, the agent must not end up somewhere it
+//wasn't asked to listen
+func newListenConfig(address string, port int, ports string, tls bool) (*listenConfig, error) {
+	if port < 1 || port > 65535 {
+		return nil, fmt.Errorf("invalid port %d", port)
+	}
+
+	cfg := &listenConfig{
+		address: address,
+		port:    port,
+		tls:     tls,
+	}
+
+	if cfg.address == "" {
+		cfg.address = DEFAULT_LISTEN_ADDRESS
+	}
+
+	var err error
+	cfg.fallback, err = parsePortRange(ports)
+	if err != nil {
+		return nil, err
+	}
+
+	return cfg, nil
+}
+
+func parsePort(s string) (int, error) {
+	port, err := strconv.Atoi(strings.TrimSpace(s))
+	if err != nil || port < 1 || port > 65535 {
+		return 0, fmt.Errorf("invalid port %q", s)
+	}
+
+	return port, nil
+}
+
+//"from-to", a single port or "none"
+func parsePortRange(s string) ([]int, error) {
+	if s == "none" {
+		return nil, nil
+	}
+
+	from, to := s, s
+	if i := strings.IndexByte(s, '-'); i >= 0 {
+		from, to = s[:i], s[i+1:]
+	}
+
+	first, err := parsePort(from)
+	if err != nil {
+		return nil, err
+	}
+
+	last, err := parsePort(to)
+	if err != nil {
+		return nil, err
+	}
+
+	if last < first {
+		return nil, fmt.Errorf("invalid port range %q", s)
+	}
+
+	var ports []int
+	for p := first; p <= last; p++ {
+		ports = append(ports, p)
+	}
+
+	return ports, nil
+}
+
+//listen on the configured port or else on the first free fallback port
+func (cfg *listenConfig) listen() (net.Listener, int, error) {
+	ports := append([]int{cfg.port}, cfg.fallback...)
+
+	var err error
+	for _, port := range ports {
+		var ln net.Listener
+		ln, err = net.Listen("tcp", net.JoinHostPort(cfg.address, strconv.Itoa(port)))
+		if err == nil {
+			return ln, port, nil
+		}
+
+		log.WithFields(log.Fields{
+			"port":  port,
+			"error": err.Error(),
+		}).Info("Unable to listen")
+	}
+
+	return nil, 0, errors.New("no port available: " + err.Error())
+}
+
+func (cfg *listenConfig) scheme() string {
+	if cfg.tls {
+		return "https"
+	}
+
+	return "http"
+}
+
+//url for reaching the agent on port. An unspecified address is reached
+//on loopback
+func (cfg *listenConfig) url(port int) string {
+	host := cfg.address
+	if ip := net.ParseIP(host); ip != nil && ip.IsUnspecified() {
+		host = DEFAULT_LISTEN_ADDRESS
+	}
+
+	return cfg.scheme() + "://" + net.JoinHostPort(host, strconv.Itoa(port))
+}
+
+//ca is the CA certificate file in HTTPS mode
+func writeDiscovery(path string, cfg *listenConfig, port int, ca string) error {
+	data, err := json.MarshalIndent(&discovery{
+		Scheme:  cfg.scheme(),
+		Address: cfg.address,
+		Port:    port,
+		Url:     cfg.url(port),
+		Pid:     os.Getpid(),
+		Version: VERSION,
+		Ca:      ca,
+	}, "", "    ")
+
+	if err != nil {
+		return err
+	}
+
+	return utils.WriteFileAtomic(path, data, 0644)
+}
+
+//remove the discovery file when the agent is stopped. SIGHUP reloads the
+//configuration
+func handleSignals(discoveryPath string) {
+	ch := make(chan os.Signal, 1)
+	signal.Notify(ch, os.Interrupt, syscall.SIGTERM, syscall.SIGHUP)
+
+	sig := <-ch
+	for sig == syscall.SIGHUP {
+		reloadConfig()
+		sig = <-ch
+	}
+
+	log.Info("Stopping on " + sig.String())
+
+	os.Remove(discoveryPath)
+	os.Exit(0)
+}
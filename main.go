@@ -19,12 +19,13 @@
 package main
 
 import (
-	_ "fmt"
+	"errors"
+	"flag"
+	"fmt"
 	"net/http"
 	"os"
 	"path/filepath"
 	"runtime"
-	"strconv"
 	"time"
 
 	"github.com/gorilla/mux"
@@ -52,7 +53,7 @@ func init() {
 	}
 	log.SetOutput(logger)
 
-	log.SetLevel(log.DebugLevel)
+	log.SetLevel(getConfig().level)
 }
 
 func getLogFileName() string {
@@ -80,8 +81,66 @@ func getLogFileName() string {
 	return LOG_FILE
 }
 
+//where the agent keeps its files
+func getAgentDir() (string, error) {
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return "", err
+	}
+
+	var dir string
+	switch runtime.GOOS {
+	case "linux":
+		dir = filepath.Join(home, ".prosql-agent")
+	case "darwin":
+		dir = filepath.Join(home, "Library", "ProsqlAgent")
+	default:
+		config, err := os.UserConfigDir()
+		if err != nil {
+			return "", err
+		}
+		dir = filepath.Join(config, "ProsqlAgent")
+	}
+
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return "", err
+	}
+
+	return dir, nil
+}
+
 func main() {
 
+	//see config.go
+	agentCfg, err := initConfig(os.Args[1:])
+	if err == flag.ErrHelp {
+		os.Exit(0)
+	}
+
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err.Error())
+		log.Fatal(err.Error())
+		os.Exit(-1)
+	}
+
+	dir, err := getAgentDir()
+	if err != nil {
+		log.Fatal(err.Error())
+		os.Exit(-1)
+	}
+
+	pairingStore, err = loadPairing(filepath.Join(dir, PAIRING_FILE))
+	if err != nil {
+		log.Fatal(err.Error())
+		os.Exit(-1)
+	}
+
+	profileStore, err = loadProfiles(filepath.Join(dir, PROFILES_FILE))
+	if err != nil {
+		log.Fatal(err.Error())
+		os.Exit(-1)
+	}
+
 	r := mux.NewRouter()
 
 	//middleware
@@ -91,19 +150,78 @@ func main() {
 
 	//routes
 	r.HandleFunc("/about", about).Methods(http.MethodGet, http.MethodOptions)
-	r.HandleFunc("/ping", ping).Methods(http.MethodGet, http.MethodOptions)
-	r.HandleFunc("/login", login).Methods(http.MethodGet, http.MethodOptions)
-	r.HandleFunc("/query", query).Methods(http.MethodGet, http.MethodOptions)
-	r.HandleFunc("/execute", execute).Methods(http.MethodGet, http.MethodOptions)
+	r.HandleFunc("/pair/start", pairStart).Methods(http.MethodPost, http.MethodOptions)
+	r.HandleFunc("/pair/complete", pairComplete).Methods(http.MethodPost, http.MethodOptions)
+	r.HandleFunc("/pair/tokens", pairTokens).Methods(http.MethodGet, http.MethodOptions)
+	r.HandleFunc("/pair/revoke", pairRevoke).Methods(http.MethodPost, http.MethodOptions)
+	r.HandleFunc("/pair/ticket", pairTicket).Methods(http.MethodPost, http.MethodOptions)
+	r.HandleFunc("/profiles", profilesList).Methods(http.MethodGet, http.MethodOptions)
+	r.HandleFunc("/profiles/unlock", profilesUnlock).Methods(http.MethodPost, http.MethodOptions)
+	r.HandleFunc("/profiles/lock", profilesLock).Methods(http.MethodPost, http.MethodOptions)
+	r.HandleFunc("/profiles/passphrase", profilesPassphrase).Methods(http.MethodPost, http.MethodOptions)
+	r.HandleFunc("/profiles/create", profileCreate).Methods(http.MethodPost, http.MethodOptions)
+	r.HandleFunc("/profiles/update", profileUpdate).Methods(http.MethodPost, http.MethodOptions)
+	r.HandleFunc("/profiles/delete", profileDelete).Methods(http.MethodPost, http.MethodOptions)
+	r.HandleFunc("/ping", ping).Methods(http.MethodGet, http.MethodPost, http.MethodOptions)
+	r.HandleFunc("/login", login).Methods(http.MethodGet, http.MethodPost, http.MethodOptions)
+	r.HandleFunc("/query", query).Methods(http.MethodGet, http.MethodPost, http.MethodOptions)
+	r.HandleFunc("/execute", execute).Methods(http.MethodGet, http.MethodPost, http.MethodOptions)
+	r.HandleFunc("/script", script).Methods(http.MethodPost, http.MethodOptions)
 	r.HandleFunc("/fetch", fetch).Methods(http.MethodGet, http.MethodOptions)
 	r.HandleFunc("/fetch_ws", fetch_ws).Methods(http.MethodGet, http.MethodOptions)
+	r.HandleFunc("/session_ws", session_ws).Methods(http.MethodGet, http.MethodOptions)
+	r.HandleFunc("/export/start", exportStart).Methods(http.MethodGet, http.MethodOptions)
+	r.HandleFunc("/export/jobs", exportList).Methods(http.MethodGet, http.MethodOptions)
+	r.HandleFunc("/export/cancel", exportCancel).Methods(http.MethodGet, http.MethodOptions)
+	r.HandleFunc("/export/ws", export_ws).Methods(http.MethodGet, http.MethodOptions)
+	r.HandleFunc("/download", download).Methods(http.MethodGet, http.MethodHead, http.MethodOptions)
 	r.HandleFunc("/cancel", cancel).Methods(http.MethodGet, http.MethodOptions)
+	r.HandleFunc("/set-db", setDb).Methods(http.MethodGet, http.MethodPost, http.MethodOptions)
+	r.HandleFunc("/tx/begin", txBegin).Methods(http.MethodGet, http.MethodPost, http.MethodOptions)
+	r.HandleFunc("/tx/commit", txCommit).Methods(http.MethodGet, http.MethodPost, http.MethodOptions)
+	r.HandleFunc("/tx/rollback", txRollback).Methods(http.MethodGet, http.MethodPost, http.MethodOptions)
+	r.HandleFunc("/tx/savepoint", txSavepoint).Methods(http.MethodGet, http.MethodPost, http.MethodOptions)
+	r.HandleFunc("/tx/rollback-to", txRollbackTo).Methods(http.MethodGet, http.MethodPost, http.MethodOptions)
+	r.HandleFunc("/tx/release", txRelease).Methods(http.MethodGet, http.MethodPost, http.MethodOptions)
+	r.HandleFunc("/tx/status", txStatus).Methods(http.MethodGet, http.MethodPost, http.MethodOptions)
 
 	http.Handle("/", r)
 
-	log.Info("prosql-agent Listening at:" + strconv.Itoa(PORT))
+	//see listen.go
+	cfg := agentCfg.listen
 
-	if err := http.ListenAndServe(":"+strconv.Itoa(PORT), nil); err != nil {
+	var certFile, keyFile, ca string
+	if cfg.tls {
+		certFile, keyFile, err = localCert(dir, cfg.address)
+		if err != nil {
+			log.Fatal(err.Error())
+			os.Exit(-1)
+		}
+		ca = filepath.Join(dir, CA_CERT_FILE)
+	}
+
+	ln, port, err := cfg.listen()
+	if err != nil {
+		log.Fatal(err.Error())
+		os.Exit(-1)
+	}
+
+	discovery := filepath.Join(dir, DISCOVERY_FILE)
+	if err := writeDiscovery(discovery, cfg, port, ca); err != nil {
+		log.Info("Unable to write discovery file: " + err.Error())
+	}
+	go handleSignals(discovery)
+
+	log.Info("prosql-agent Listening at:" + cfg.url(port))
+	fmt.Fprintln(os.Stderr, "prosql-agent listening at "+cfg.url(port))
+
+	if cfg.tls {
+		err = http.ServeTLS(ln, nil, certFile, keyFile)
+	} else {
+		err = http.Serve(ln, nil)
+	}
+
+	if err != nil {
 		log.Fatal(err.Error())
 		os.Exit(-1)
 	}
@@ -111,15 +229,34 @@ func main() {
 
 func mw(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		w.Header().Set("Access-Control-Allow-Origin", ALLOW)
+		//see origins.go
+		if !checkOrigin(r) {
+			w.WriteHeader(http.StatusForbidden)
+			utils.SendError(r.Context(), w, errors.New(ERR_ORIGIN_NOT_ALLOWED), ERR_ORIGIN_NOT_ALLOWED)
+			return
+		}
+
+		if origin := r.Header.Get("Origin"); origin != "" {
+			w.Header().Set("Access-Control-Allow-Origin", origin)
+			w.Header().Add("Vary", "Origin")
+		}
+
 		w.Header().Set("Access-Control-Allow-Credentials", "true")
 		w.Header().Set("Access-Control-Allow-Private-Network", "true")
-		w.Header().Set("Access-Control-Allow-Headers", "X-Request-ID")
+		w.Header().Set("Access-Control-Allow-Headers", "X-Request-ID, Content-Type, Authorization")
 		w.Header().Set("Content-Type", "application/json")
 
 		if r.Method == http.MethodOptions {
 			return
 		}
+
+		//see pairing.go
+		if !authorized(r) {
+			w.WriteHeader(http.StatusUnauthorized)
+			utils.SendError(r.Context(), w, errors.New(ERR_UNAUTHORIZED), ERR_UNAUTHORIZED)
+			return
+		}
+
 		next.ServeHTTP(w, r)
 	})
 }
@@ -0,0 +1,145 @@
+/* Copyright (C) 2021 Pankaj Kargirwar <kargirwar@protonmail.com>
+
+   This file is part of prosql-agent
+
+   prosql-agent is free software: you can redistribute it and/or modify
+   it under the terms of the GNU General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   prosql-agent is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU General Public License for more details.
+
+   You should have received a copy of the GNU General Public License
+   along with prosql-agent.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+/* Pages may use the agent only from the allowed origins, [origins] allowed
+in the config file (see config.go), ALLOW by default. For example:
+
+allowed = ["https://prosql.io", "https://*.prosql.io", "http://localhost:8080"]
+
+*. allows any subdomain, at any depth: https://*.prosql.io allows
+https://staging.prosql.io but not https://prosql.io itself. Scheme and
+port must match exactly. Requests without an Origin header don't come
+from a page and are left to the token check */
+
+package main
+
+import (
+	"errors"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/kargirwar/prosql-agent/utils"
+	log "github.com/sirupsen/logrus"
+)
+
+type originPattern struct {
+	scheme   string
+	host     string //without the *. of wildcards
+	port     string
+	wildcard bool
+}
+
+func init() {
+	utils.Upgrader.CheckOrigin = checkOrigin
+}
+
+//invalid entries are logged and left out
+func parseOrigins(list []string) []*originPattern {
+	var patterns []*originPattern
+	for _, s := range list {
+		s = strings.TrimSpace(s)
+		if s == "" {
+			continue
+		}
+
+		p, err := parseOrigin(s)
+		if err != nil {
+			log.WithFields(log.Fields{
+				"origin": s,
+			}).Info("Ignoring invalid allowed origin")
+			continue
+		}
+
+		patterns = append(patterns, p)
+	}
+
+	return patterns
+}
+
+func parseOrigin(s string) (*originPattern, error) {
+	u, err := url.Parse(s)
+	if err != nil {
+		return nil, err
+	}
+
+	if u.Scheme == "" || u.Hostname() == "" || (u.Path != "" && u.Path != "/") ||
+		u.User != nil || u.RawQuery != "" || u.Fragment != "" {
+		return nil, errors.New(ERR_INVALID_ORIGIN)
+	}
+
+	p := &originPattern{
+		scheme: strings.ToLower(u.Scheme),
+		host:   strings.ToLower(u.Hostname()),
+		port:   u.Port(),
+	}
+
+	if strings.HasPrefix(p.host, "*.") {
+		p.host = p.host[2:]
+		p.wildcard = true
+	}
+
+	if p.host == "" || strings.Contains(p.host, "*") {
+		return nil, errors.New(ERR_INVALID_ORIGIN)
+	}
+
+	return p, nil
+}
+
+func (p *originPattern) matches(u *url.URL) bool {
+	if strings.ToLower(u.Scheme) != p.scheme || u.Port() != p.port {
+		return false
+	}
+
+	host := strings.ToLower(u.Hostname())
+	if p.wildcard {
+		return strings.HasSuffix(host, "."+p.host)
+	}
+
+	return host == p.host
+}
+
+func originAllowed(origin string) bool {
+	u, err := url.Parse(origin)
+	if err != nil || u.Host == "" {
+		return false
+	}
+
+	for _, p := range getConfig().origins {
+		if p.matches(u) {
+			return true
+		}
+	}
+
+	return false
+}
+
+//for mw and for websocket upgrades
+func checkOrigin(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" || originAllowed(origin) {
+		return true
+	}
+
+	log.WithFields(log.Fields{
+		"origin": origin,
+		"path":   r.URL.Path,
+	}).Info("Rejected origin")
+
+	return false
+}
@@ -0,0 +1,177 @@
+/* Copyright (C) 2021 Pankaj Kargirwar <kargirwar@protonmail.com>
+
+   This file is part of prosql-agent
+
+   prosql-agent is free software: you can redistribute it and/or modify
+   it under the terms of the GNU General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   prosql-agent is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU General Public License for more details.
+
+   You should have received a copy of the GNU General Public License
+   along with prosql-agent.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/websocket"
+	"github.com/kargirwar/prosql-agent/utils"
+)
+
+const testOrigins = "https://prosql.io, https://*.example.com, http://localhost:8080, bogus, https://*"
+
+func withOrigins(t *testing.T, list string) {
+	saved := getConfig()
+	cfg := *saved
+	cfg.origins = parseOrigins(strings.Split(list, ","))
+	setConfig(&cfg)
+	t.Cleanup(func() {
+		setConfig(saved)
+	})
+}
+
+func TestParseOrigins(t *testing.T) {
+	patterns := parseOrigins(strings.Split(testOrigins, ","))
+	if len(patterns) != 3 {
+		t.Errorf("expected 3 valid origins got %d\n", len(patterns))
+	}
+
+	cfg := defaultConfig()
+	if err := cfg.prepare(); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(cfg.origins) != 1 || cfg.origins[0].host != "prosql.io" {
+		t.Errorf("expected the default origin got %+v\n", cfg.origins)
+	}
+}
+
+func TestOriginAllowed(t *testing.T) {
+	withOrigins(t, testOrigins)
+
+	tests := []struct {
+		origin string
+		want   bool
+	}{
+		{"https://prosql.io", true},
+		{"https://PROSQL.io", true},
+		{"http://prosql.io", false},
+		{"https://prosql.io:8443", false},
+		{"https://www.prosql.io", false},
+		{"https://prosql.io.evil.com", false},
+		{"https://evilprosql.io", false},
+		{"https://staging.example.com", true},
+		{"https://a.b.example.com", true},
+		{"https://example.com", false},
+		{"https://evilexample.com", false},
+		{"http://staging.example.com", false},
+		{"http://localhost:8080", true},
+		{"http://localhost:8081", false},
+		{"http://localhost", false},
+		{"null", false},
+		{"", false},
+	}
+
+	for _, test := range tests {
+		if got := originAllowed(test.origin); got != test.want {
+			t.Errorf("%q: expected %t got %t\n", test.origin, test.want, got)
+		}
+	}
+}
+
+func preflight(origin string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(http.MethodOptions, "/login", nil)
+	r.Header.Set("Origin", origin)
+	r.Header.Set("Access-Control-Request-Method", http.MethodPost)
+
+	w := httptest.NewRecorder()
+	mw(http.NotFoundHandler()).ServeHTTP(w, r)
+	return w
+}
+
+func TestPreflightCrossSite(t *testing.T) {
+	withOrigins(t, testOrigins)
+
+	w := preflight("https://evil.com")
+	if w.Code != http.StatusForbidden {
+		t.Errorf("expected %d got %d\n", http.StatusForbidden, w.Code)
+	}
+
+	if h := w.Header().Get("Access-Control-Allow-Origin"); h != "" {
+		t.Errorf("expected no Access-Control-Allow-Origin got %s\n", h)
+	}
+
+	if !strings.Contains(w.Body.String(), ERR_ORIGIN_NOT_ALLOWED) {
+		t.Errorf("expected %s got %s\n", ERR_ORIGIN_NOT_ALLOWED, w.Body.String())
+	}
+}
+
+func TestPreflightAllowed(t *testing.T) {
+	withOrigins(t, testOrigins)
+
+	w := preflight("https://staging.example.com")
+	if w.Code != http.StatusOK {
+		t.Errorf("expected %d got %d\n", http.StatusOK, w.Code)
+	}
+
+	if h := w.Header().Get("Access-Control-Allow-Origin"); h != "https://staging.example.com" {
+		t.Errorf("expected the origin to be allowed got %q\n", h)
+	}
+}
+
+//pages from other sites can't open websockets, whatever route they use
+func TestWebsocketCrossSite(t *testing.T) {
+	withOrigins(t, testOrigins)
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ws, err := utils.Upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		ws.Close()
+	}))
+	defer srv.Close()
+
+	url := "ws" + strings.TrimPrefix(srv.URL, "http") + "/fetch_ws"
+
+	tests := []struct {
+		origin string
+		want   int
+	}{
+		{"https://evil.com", http.StatusForbidden},
+		{"https://prosql.io.evil.com", http.StatusForbidden},
+		{"https://prosql.io", http.StatusSwitchingProtocols},
+		{"", http.StatusSwitchingProtocols},
+	}
+
+	for _, test := range tests {
+		h := http.Header{}
+		if test.origin != "" {
+			h.Set("Origin", test.origin)
+		}
+
+		ws, res, err := websocket.DefaultDialer.Dial(url, h)
+		if ws != nil {
+			ws.Close()
+		}
+
+		if res == nil {
+			t.Errorf("%q: %v\n", test.origin, err)
+			continue
+		}
+
+		if res.StatusCode != test.want {
+			t.Errorf("%q: expected %d got %d\n", test.origin, test.want, res.StatusCode)
+		}
+	}
+}
@@ -0,0 +1,404 @@
+/* Copyright (C) 2021 Pankaj Kargirwar <kargirwar@protonmail.com>
+
+   This file is part of prosql-agent
+
+   prosql-agent is free software: you can redistribute it and/or modify
+   it under the terms of the GNU General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   prosql-agent is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU General Public License for more details.
+
+   You should have received a copy of the GNU General Public License
+   along with prosql-agent.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+/* Only browsers paired with the agent may use it:
+
+1. The UI calls /pair/start. The agent shows a one-time code on its
+   console and in the log, valid for PAIRING_CODE_TTL
+2. The user types the code into the UI, which sends it to /pair/complete
+   together with a name for the browser, and gets a token back
+3. Every other request carries the token as "Authorization: Bearer
+   <token>". /about needs none
+4. Websockets and downloads, where the browser can't set headers, use a
+   ticket instead: the UI asks /pair/ticket for one and passes it as the
+   ticket parameter. A ticket works once, within PAIRING_TICKET_TTL, and
+   only on ticketRoutes. The token itself is never accepted in a URL
+
+A token is a random id signed with the agent's secret. The secret and the
+ids of all tokens issued are kept in pairing.json in the agent's
+directory, so tokens survive restarts. Revoking a token forgets its id */
+
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/dchest/uniuri"
+	"github.com/kargirwar/prosql-agent/utils"
+	log "github.com/sirupsen/logrus"
+)
+
+const PAIRING_FILE = "pairing.json"
+
+//routes which work without a token
+var openRoutes = map[string]bool{
+	"/about":         true,
+	"/pair/start":    true,
+	"/pair/complete": true,
+}
+
+//routes which take a ticket in place of the token
+var ticketRoutes = map[string]bool{
+	"/download":   true,
+	"/fetch_ws":   true,
+	"/session_ws": true,
+	"/export/ws":  true,
+}
+
+type AuthToken struct {
+	Id      string    `json:"token-id"`
+	Name    string    `json:"name"`
+	Created time.Time `json:"created"`
+}
+
+//what pairing.json holds
+type pairingState struct {
+	Secret []byte       `json:"secret"`
+	Tokens []*AuthToken `json:"tokens"`
+}
+
+type pairing struct {
+	path        string
+	state       pairingState
+	code        string //current one-time code, empty if none
+	expires     time.Time
+	failures    int
+	lockedUntil time.Time
+	tickets     map[string]ticket //kept in memory only
+	mutex       sync.Mutex
+}
+
+type ticket struct {
+	tokenId string
+	expires time.Time
+}
+
+//nil until main has loaded it, which lets nobody in
+var pairingStore *pairing
+
+//read the pairing state from path, creating it on first start
+func loadPairing(path string) (*pairing, error) {
+	p := &pairing{path: path}
+
+	data, err := os.ReadFile(path)
+	if err == nil {
+		if err := json.Unmarshal(data, &p.state); err != nil {
+			return nil, fmt.Errorf("%s: %s", path, err.Error())
+		}
+
+		if len(p.state.Secret) == 0 {
+			return nil, fmt.Errorf("%s: no secret", path)
+		}
+
+		return p, nil
+	}
+
+	if !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	p.state.Secret = make([]byte, 32)
+	if _, err := rand.Read(p.state.Secret); err != nil {
+		return nil, err
+	}
+
+	if err := p.save(); err != nil {
+		return nil, err
+	}
+
+	return p, nil
+}
+
+//caller holds the mutex or owns p
+func (p *pairing) save() error {
+	data, err := json.MarshalIndent(&p.state, "", "    ")
+	if err != nil {
+		return err
+	}
+
+	return utils.WriteFileAtomic(p.path, data, 0600)
+}
+
+//issue a new one-time code and show it to the user. A code which is still
+//valid is shown again instead
+func (p *pairing) start() (time.Time, error) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	now := time.Now()
+	if now.Before(p.lockedUntil) {
+		return time.Time{}, errors.New(ERR_PAIRING_LOCKED)
+	}
+
+	if p.code == "" || now.After(p.expires) {
+		code, err := newPairingCode()
+		if err != nil {
+			return time.Time{}, err
+		}
+
+		p.code = code
+		p.expires = now.Add(PAIRING_CODE_TTL)
+	}
+
+	fmt.Fprintf(os.Stderr, "Pairing code: %s (valid until %s)\n", p.code, p.expires.Format("15:04:05"))
+	log.WithFields(log.Fields{
+		"code":    p.code,
+		"expires": p.expires,
+	}).Info("Pairing code")
+
+	return p.expires, nil
+}
+
+//exchange the one-time code for a token. Every code works once, and too
+//many wrong ones lock pairing for a while
+func (p *pairing) complete(code string, name string) (string, *AuthToken, error) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	now := time.Now()
+	if now.Before(p.lockedUntil) {
+		return "", nil, errors.New(ERR_PAIRING_LOCKED)
+	}
+
+	if p.code == "" || now.After(p.expires) ||
+		subtle.ConstantTimeCompare([]byte(code), []byte(p.code)) != 1 {
+
+		p.failures++
+		if p.failures >= PAIRING_MAX_FAILURES {
+			p.code = ""
+			p.failures = 0
+			p.lockedUntil = now.Add(PAIRING_LOCKOUT)
+			log.Info("Pairing locked after too many wrong codes")
+		}
+
+		return "", nil, errors.New(ERR_INVALID_PAIRING_CODE)
+	}
+
+	p.code = ""
+	p.failures = 0
+
+	t := &AuthToken{
+		Id:      uniuri.NewLen(24),
+		Name:    name,
+		Created: now,
+	}
+
+	p.state.Tokens = append(p.state.Tokens, t)
+	if err := p.save(); err != nil {
+		p.state.Tokens = p.state.Tokens[:len(p.state.Tokens)-1]
+		return "", nil, err
+	}
+
+	log.WithFields(log.Fields{
+		"token-id": t.Id,
+		"name":     t.Name,
+	}).Info("Paired")
+
+	return p.sign(t.Id), t, nil
+}
+
+//<id>.<signature>
+func (p *pairing) sign(id string) string {
+	return id + "." + base64.RawURLEncoding.EncodeToString(p.mac(id))
+}
+
+func (p *pairing) mac(id string) []byte {
+	m := hmac.New(sha256.New, p.state.Secret)
+	m.Write([]byte(id))
+	return m.Sum(nil)
+}
+
+//the token if it was issued by this agent and not revoked since
+func (p *pairing) verify(token string) (*AuthToken, error) {
+	i := strings.LastIndexByte(token, '.')
+	if i < 0 {
+		return nil, errors.New(ERR_UNAUTHORIZED)
+	}
+
+	id := token[:i]
+	sig, err := base64.RawURLEncoding.DecodeString(token[i+1:])
+	if err != nil || !hmac.Equal(sig, p.mac(id)) {
+		return nil, errors.New(ERR_UNAUTHORIZED)
+	}
+
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	for _, t := range p.state.Tokens {
+		if t.Id == id {
+			return t, nil
+		}
+	}
+
+	return nil, errors.New(ERR_UNAUTHORIZED)
+}
+
+//issue a single-use ticket on behalf of the token with id tokenId
+func (p *pairing) issueTicket(tokenId string) (string, time.Time, error) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	now := time.Now()
+	if p.tickets == nil {
+		p.tickets = make(map[string]ticket)
+	}
+
+	//tickets nobody redeemed
+	for k, t := range p.tickets {
+		if now.After(t.expires) {
+			delete(p.tickets, k)
+		}
+	}
+
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", time.Time{}, err
+	}
+
+	k := base64.RawURLEncoding.EncodeToString(b)
+	t := ticket{tokenId: tokenId, expires: now.Add(PAIRING_TICKET_TTL)}
+	p.tickets[k] = t
+
+	return k, t.expires, nil
+}
+
+//use up a ticket. It must not have expired, and the token it was issued
+//for must not have been revoked since
+func (p *pairing) redeem(k string) error {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	t, ok := p.tickets[k]
+	if !ok {
+		return errors.New(ERR_UNAUTHORIZED)
+	}
+
+	delete(p.tickets, k)
+	if time.Now().After(t.expires) {
+		return errors.New(ERR_UNAUTHORIZED)
+	}
+
+	for _, a := range p.state.Tokens {
+		if a.Id == t.tokenId {
+			return nil
+		}
+	}
+
+	return errors.New(ERR_UNAUTHORIZED)
+}
+
+func (p *pairing) list() []*AuthToken {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	tokens := make([]*AuthToken, len(p.state.Tokens))
+	copy(tokens, p.state.Tokens)
+	return tokens
+}
+
+func (p *pairing) revoke(id string) error {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	for i, t := range p.state.Tokens {
+		if t.Id != id {
+			continue
+		}
+
+		tokens := append([]*AuthToken{}, p.state.Tokens[:i]...)
+		tokens = append(tokens, p.state.Tokens[i+1:]...)
+
+		old := p.state.Tokens
+		p.state.Tokens = tokens
+		if err := p.save(); err != nil {
+			p.state.Tokens = old
+			return err
+		}
+
+		log.WithFields(log.Fields{
+			"token-id": id,
+		}).Info("Token revoked")
+		return nil
+	}
+
+	return errors.New(ERR_INVALID_TOKEN_ID)
+}
+
+func newPairingCode() (string, error) {
+	max := big.NewInt(1)
+	for i := 0; i < PAIRING_CODE_LEN; i++ {
+		max.Mul(max, big.NewInt(10))
+	}
+
+	n, err := rand.Int(rand.Reader, max)
+	if err != nil {
+		return "", err
+	}
+
+	return fmt.Sprintf("%0*d", PAIRING_CODE_LEN, n), nil
+}
+
+//token sent with the request, if any
+func requestToken(r *http.Request) string {
+	const bearer = "Bearer "
+
+	if h := r.Header.Get("Authorization"); len(h) > len(bearer) && strings.EqualFold(h[:len(bearer)], bearer) {
+		return strings.TrimSpace(h[len(bearer):])
+	}
+
+	return ""
+}
+
+func authorized(r *http.Request) bool {
+	if openRoutes[r.URL.Path] {
+		return true
+	}
+
+	if pairingStore == nil {
+		return false
+	}
+
+	if token := requestToken(r); token != "" {
+		_, err := pairingStore.verify(token)
+		return err == nil
+	}
+
+	if !ticketRoutes[r.URL.Path] {
+		return false
+	}
+
+	k := r.URL.Query().Get("ticket")
+	if k == "" {
+		return false
+	}
+
+	return pairingStore.redeem(k) == nil
+}
@@ -0,0 +1,250 @@
+/* Copyright (C) 2021 Pankaj Kargirwar <kargirwar@protonmail.com>
+
+   This file is part of prosql-agent
+
+   prosql-agent is free software: you can redistribute it and/or modify
+   it under the terms of the GNU General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   prosql-agent is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU General Public License for more details.
+
+   You should have received a copy of the GNU General Public License
+   along with prosql-agent.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"encoding/base64"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func newTestPairing(t *testing.T) *pairing {
+	p, err := loadPairing(filepath.Join(t.TempDir(), PAIRING_FILE))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return p
+}
+
+func pair(t *testing.T, p *pairing) string {
+	if _, err := p.start(); err != nil {
+		t.Fatal(err)
+	}
+
+	token, _, err := p.complete(p.code, "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return token
+}
+
+func TestPairingTokens(t *testing.T) {
+	p := newTestPairing(t)
+	token := pair(t, p)
+
+	if _, err := p.verify(token); err != nil {
+		t.Fatalf("expected the token to verify got %s\n", err)
+	}
+
+	//survives a restart
+	loaded, err := loadPairing(p.path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := loaded.verify(token); err != nil {
+		t.Errorf("expected the token to verify after reload got %s\n", err)
+	}
+
+	id := token[:strings.LastIndexByte(token, '.')]
+	otherId := id[:len(id)-1] + "x"
+	if otherId == id {
+		otherId = id[:len(id)-1] + "y"
+	}
+
+	other := newTestPairing(t)
+	sig := base64.RawURLEncoding.EncodeToString(make([]byte, 32))
+
+	forged := []struct {
+		name  string
+		token string
+	}{
+		{"empty", ""},
+		{"no signature", id},
+		{"empty signature", id + "."},
+		{"bad encoding", id + ".!!!"},
+		{"zero signature", id + "." + sig},
+		{"truncated signature", token[:len(token)-2]},
+		{"other id", otherId + token[len(id):]},
+		{"signed by another agent", other.sign(id)},
+		{"unknown id", p.sign("not-issued")},
+	}
+
+	for _, test := range forged {
+		if _, err := p.verify(test.token); err == nil || err.Error() != ERR_UNAUTHORIZED {
+			t.Errorf("%s: expected %s got %v\n", test.name, ERR_UNAUTHORIZED, err)
+		}
+	}
+
+	if err := p.revoke(id); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := p.verify(token); err == nil {
+		t.Errorf("expected a revoked token to fail\n")
+	}
+
+	loaded, err = loadPairing(p.path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := loaded.verify(token); err == nil {
+		t.Errorf("expected a revoked token to fail after reload\n")
+	}
+}
+
+func TestPairingCode(t *testing.T) {
+	p := newTestPairing(t)
+	if _, err := p.start(); err != nil {
+		t.Fatal(err)
+	}
+
+	code := p.code
+	if len(code) != PAIRING_CODE_LEN {
+		t.Errorf("expected a code of %d digits got %q\n", PAIRING_CODE_LEN, code)
+	}
+
+	//expired
+	p.expires = time.Now().Add(-time.Second)
+	if _, _, err := p.complete(code, "test"); err == nil || err.Error() != ERR_INVALID_PAIRING_CODE {
+		t.Errorf("expected an expired code to fail got %v\n", err)
+	}
+
+	//a fresh one works once
+	if _, err := p.start(); err != nil {
+		t.Fatal(err)
+	}
+
+	code = p.code
+	if _, _, err := p.complete(code, "test"); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, _, err := p.complete(code, "test"); err == nil || err.Error() != ERR_INVALID_PAIRING_CODE {
+		t.Errorf("expected a used code to fail got %v\n", err)
+	}
+}
+
+func TestPairingLockout(t *testing.T) {
+	p := newTestPairing(t)
+	if _, err := p.start(); err != nil {
+		t.Fatal(err)
+	}
+
+	code := p.code
+	wrong := strings.Repeat("x", PAIRING_CODE_LEN)
+
+	for i := 0; i < PAIRING_MAX_FAILURES; i++ {
+		if _, _, err := p.complete(wrong, "test"); err == nil || err.Error() != ERR_INVALID_PAIRING_CODE {
+			t.Fatalf("attempt %d: expected %s got %v\n", i, ERR_INVALID_PAIRING_CODE, err)
+		}
+	}
+
+	//the right code does not help once locked, and no new one is issued
+	if _, _, err := p.complete(code, "test"); err == nil || err.Error() != ERR_PAIRING_LOCKED {
+		t.Errorf("expected %s got %v\n", ERR_PAIRING_LOCKED, err)
+	}
+
+	if _, err := p.start(); err == nil || err.Error() != ERR_PAIRING_LOCKED {
+		t.Errorf("expected %s got %v\n", ERR_PAIRING_LOCKED, err)
+	}
+
+	//the code in use when the lock started is gone for good
+	p.lockedUntil = time.Now().Add(-time.Second)
+	if _, _, err := p.complete(code, "test"); err == nil || err.Error() != ERR_INVALID_PAIRING_CODE {
+		t.Errorf("expected the old code to fail after the lockout got %v\n", err)
+	}
+
+	pair(t, p)
+	if len(p.list()) != 1 {
+		t.Errorf("expected 1 token got %d\n", len(p.list()))
+	}
+}
+
+func TestPairingTickets(t *testing.T) {
+	p := newTestPairing(t)
+	token := pair(t, p)
+	id := token[:strings.LastIndexByte(token, '.')]
+
+	old := pairingStore
+	pairingStore = p
+	defer func() { pairingStore = old }()
+
+	newTicket := func() string {
+		k, _, err := p.issueTicket(id)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		return k
+	}
+
+	//works once, and only where headers can't be set
+	k := newTicket()
+	if authorized(httptest.NewRequest("GET", "/query?ticket="+k, nil)) {
+		t.Errorf("expected a ticket to be refused outside ticketRoutes\n")
+	}
+
+	k = newTicket()
+	if !authorized(httptest.NewRequest("GET", "/download?ticket="+k, nil)) {
+		t.Errorf("expected a fresh ticket to be accepted\n")
+	}
+
+	if authorized(httptest.NewRequest("GET", "/download?ticket="+k, nil)) {
+		t.Errorf("expected a used ticket to be refused\n")
+	}
+
+	//the token itself is never accepted in the URL
+	for _, path := range []string{"/query", "/download", "/session_ws"} {
+		if authorized(httptest.NewRequest("GET", path+"?access-token="+token, nil)) {
+			t.Errorf("%s: expected the token to be refused as a parameter\n", path)
+		}
+	}
+
+	r := httptest.NewRequest("GET", "/query", nil)
+	r.Header.Set("Authorization", "Bearer "+token)
+	if !authorized(r) {
+		t.Errorf("expected the token to be accepted in the header\n")
+	}
+
+	//expired
+	k = newTicket()
+	tk := p.tickets[k]
+	tk.expires = time.Now().Add(-time.Second)
+	p.tickets[k] = tk
+	if authorized(httptest.NewRequest("GET", "/export/ws?ticket="+k, nil)) {
+		t.Errorf("expected an expired ticket to be refused\n")
+	}
+
+	//revoking the token voids its tickets
+	k = newTicket()
+	if err := p.revoke(id); err != nil {
+		t.Fatal(err)
+	}
+
+	if authorized(httptest.NewRequest("GET", "/fetch_ws?ticket="+k, nil)) {
+		t.Errorf("expected a ticket of a revoked token to be refused\n")
+	}
+}
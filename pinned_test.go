@@ -0,0 +1,111 @@
+//go:build integration
+// +build integration
+
+/* Copyright (C) 2021 Pankaj Kargirwar <kargirwar@protonmail.com>
+
+   This file is part of prosql-agent
+
+   prosql-agent is free software: you can redistribute it and/or modify
+   it under the terms of the GNU General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   prosql-agent is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU General Public License for more details.
+
+   You should have received a copy of the GNU General Public License
+   along with prosql-agent.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"testing"
+	"time"
+)
+
+//first value of the first row query returns on session sid
+func queryValue(t *testing.T, ctx context.Context, sid string, query string) string {
+	t.Helper()
+
+	cid, err := Query(ctx, sid, query)
+	if err != nil {
+		t.Fatalf("%s: %s\n", query, err.Error())
+	}
+
+	rows, _, err := Fetch(ctx, sid, cid, 1)
+	if err != nil {
+		t.Fatalf("%s: %s\n", query, err.Error())
+	}
+
+	if rows == nil || len(*rows) == 0 {
+		t.Fatalf("%s: no rows\n", query)
+	}
+
+	return fmt.Sprintf("%v", (*rows)[0][1])
+}
+
+func TestPinnedSessionOutlivesCursorCleanup(t *testing.T) {
+	saved := getConfig()
+	cfg := *saved
+	cfg.Timeouts.CursorIdle = duration{time.Second}
+	setConfig(&cfg)
+	t.Cleanup(func() {
+		setConfig(saved)
+	})
+
+	ctx := context.Background()
+	sid, err := NewPinnedSession(ctx, "mysql", os.Getenv("DSN"), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	id := queryValue(t, ctx, sid, "select connection_id()")
+
+	cid, err := Execute(ctx, sid, "set @pinned = 42")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, _, err := Fetch(ctx, sid, cid, 1); err != nil {
+		t.Fatal(err)
+	}
+
+	//leave rows open on the primary for the cleanup to find
+	cid, err = Query(ctx, sid, "select 1 union all select 2 union all select 3")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, _, err := Fetch(ctx, sid, cid, 1); err != nil {
+		t.Fatal(err)
+	}
+
+	deadline := time.Now().Add(10 * time.Second)
+	for {
+		_, _, err := Fetch(ctx, sid, cid, 1)
+		if err != nil && err.Error() == ERR_INVALID_CURSOR_ID {
+			break
+		}
+
+		if time.Now().After(deadline) {
+			t.Fatalf("cursor was not cleaned up\n")
+		}
+
+		//fetching refreshes the access time, give the cleanup a chance
+		time.Sleep(3 * time.Second)
+	}
+
+	if got := queryValue(t, ctx, sid, "select connection_id()"); got != id {
+		t.Errorf("expected connection %s got %s\n", id, got)
+	}
+
+	if got := queryValue(t, ctx, sid, "select @pinned"); got != "42" {
+		t.Errorf("expected @pinned 42 got %s\n", got)
+	}
+}
@@ -0,0 +1,648 @@
+/* Copyright (C) 2021 Pankaj Kargirwar <kargirwar@protonmail.com>
+
+   This file is part of prosql-agent
+
+   prosql-agent is free software: you can redistribute it and/or modify
+   it under the terms of the GNU General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   prosql-agent is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU General Public License for more details.
+
+   You should have received a copy of the GNU General Public License
+   along with prosql-agent.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+/* Saved connection profiles, so that the UI logs in with /login?profile=<id>
+instead of sending credentials with every login:
+
+{"id": "...", "name": "staging", "host": "db.internal", "port": "3306",
+ "user": "app", "db": "shop", "tls": "preferred", "has-password": true,
+ "tunnel": {"host": "bastion.example.com", "port": "22", "user": "me",
+            "key-file": "/home/me/.ssh/id_ed25519", "host-key": "SHA256:..."}}
+
+tls is the mysql driver's tls setting: true, skip-verify or preferred.
+With a tunnel connections are made through SSH, see tunnel.go.
+
+Profiles are kept in profiles.json in the agent's directory. Passwords,
+of the database and of the tunnel, are encrypted with AES-256-GCM under a
+key derived from a master passphrase with Argon2id and are never sent
+back. The passphrase itself is not stored:
+
+1. /profiles/unlock with a passphrase. The first time this sets it
+2. While unlocked profiles may be created, changed and used to log in.
+   Profiles without passwords work while locked too
+3. /profiles/lock, or stopping the agent, forgets the key. Sessions
+   already logged in are not affected */
+
+package main
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/dchest/uniuri"
+	"github.com/go-sql-driver/mysql"
+	"github.com/kargirwar/prosql-agent/utils"
+	"golang.org/x/crypto/argon2"
+)
+
+const PROFILES_FILE = "profiles.json"
+
+//sealed with the key to tell a wrong passphrase from a right one
+const profileCheck = "prosql-agent"
+
+type Tunnel struct {
+	Host     string `json:"host"`
+	Port     string `json:"port"`
+	User     string `json:"user"`
+	Password string `json:"password,omitempty"` //sealed. Also unlocks an encrypted key file
+	KeyFile  string `json:"key-file,omitempty"` //private key on this machine
+	HostKey  string `json:"host-key,omitempty"` //fingerprint, recorded on first connect
+
+	HasPassword bool `json:"has-password"`
+}
+
+type Profile struct {
+	Id       string    `json:"id"`
+	Name     string    `json:"name"`
+	Host     string    `json:"host"`
+	Port     string    `json:"port"`
+	User     string    `json:"user"`
+	Password string    `json:"password,omitempty"` //sealed
+	Db       string    `json:"db"`
+	Tls      string    `json:"tls,omitempty"`
+	Tunnel   *Tunnel   `json:"tunnel,omitempty"`
+	Created  time.Time `json:"created"`
+	Updated  time.Time `json:"updated"`
+
+	HasPassword bool `json:"has-password"`
+}
+
+type kdfParams struct {
+	Salt    []byte `json:"salt"`
+	Time    uint32 `json:"time"`
+	Memory  uint32 `json:"memory"` //KiB
+	Threads uint8  `json:"threads"`
+}
+
+//what profiles.json holds
+type profileState struct {
+	Kdf      *kdfParams `json:"kdf,omitempty"` //nil until a passphrase is set
+	Check    string     `json:"check,omitempty"`
+	Profiles []*Profile `json:"profiles"`
+}
+
+type profiles struct {
+	path  string
+	state profileState
+	key   []byte //nil while locked
+	mutex sync.Mutex
+}
+
+//nil until main has loaded it
+var profileStore *profiles
+
+func loadProfiles(path string) (*profiles, error) {
+	ps := &profiles{path: path}
+
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return ps, nil
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	if err := json.Unmarshal(data, &ps.state); err != nil {
+		return nil, fmt.Errorf("%s: %s", path, err.Error())
+	}
+
+	return ps, nil
+}
+
+//caller holds the mutex or owns ps
+func (ps *profiles) save() error {
+	data, err := json.MarshalIndent(&ps.state, "", "    ")
+	if err != nil {
+		return err
+	}
+
+	return utils.WriteFileAtomic(ps.path, data, 0600)
+}
+
+func (k *kdfParams) deriveKey(passphrase string) []byte {
+	return argon2.IDKey([]byte(passphrase), k.Salt, k.Time, k.Memory, k.Threads, 32)
+}
+
+//nonce and ciphertext, base64. ad binds the value to where it is kept
+func seal(key []byte, plain string, ad string) (string, error) {
+	gcm, err := newGcm(key)
+	if err != nil {
+		return "", err
+	}
+
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return "", err
+	}
+
+	sealed := gcm.Seal(nonce, nonce, []byte(plain), []byte(ad))
+	return base64.StdEncoding.EncodeToString(sealed), nil
+}
+
+func unseal(key []byte, sealed string, ad string) (string, error) {
+	data, err := base64.StdEncoding.DecodeString(sealed)
+	if err != nil {
+		return "", err
+	}
+
+	gcm, err := newGcm(key)
+	if err != nil {
+		return "", err
+	}
+
+	if len(data) < gcm.NonceSize() {
+		return "", errors.New("sealed value too short")
+	}
+
+	n := gcm.NonceSize()
+	plain, err := gcm.Open(nil, data[:n], data[n:], []byte(ad))
+	if err != nil {
+		return "", err
+	}
+
+	return string(plain), nil
+}
+
+func newGcm(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+
+	return cipher.NewGCM(block)
+}
+
+//set the passphrase if there is none yet, otherwise check it
+func (ps *profiles) unlock(passphrase string) error {
+	ps.mutex.Lock()
+	defer ps.mutex.Unlock()
+
+	if ps.state.Kdf == nil {
+		if len(passphrase) < MIN_PASSPHRASE_LEN {
+			return errors.New(ERR_WEAK_PASSPHRASE)
+		}
+
+		key, err := ps.setPassphrase(passphrase)
+		if err != nil {
+			return err
+		}
+
+		if err := ps.save(); err != nil {
+			return err
+		}
+
+		ps.key = key
+		return nil
+	}
+
+	key, err := ps.verify(passphrase)
+	if err != nil {
+		return err
+	}
+
+	ps.key = key
+	return nil
+}
+
+//key for passphrase if it is the right one. Caller holds the mutex
+func (ps *profiles) verify(passphrase string) ([]byte, error) {
+	if ps.state.Kdf == nil {
+		return nil, errors.New(ERR_WRONG_PASSPHRASE)
+	}
+
+	key := ps.state.Kdf.deriveKey(passphrase)
+	check, err := unseal(key, ps.state.Check, "check")
+	if err != nil || subtle.ConstantTimeCompare([]byte(check), []byte(profileCheck)) != 1 {
+		return nil, errors.New(ERR_WRONG_PASSPHRASE)
+	}
+
+	return key, nil
+}
+
+//new salt and check for passphrase. Caller holds the mutex and saves
+func (ps *profiles) setPassphrase(passphrase string) ([]byte, error) {
+	kdf := &kdfParams{
+		Salt:    make([]byte, 16),
+		Time:    ARGON2_TIME,
+		Memory:  ARGON2_MEMORY,
+		Threads: ARGON2_THREADS,
+	}
+
+	if _, err := rand.Read(kdf.Salt); err != nil {
+		return nil, err
+	}
+
+	key := kdf.deriveKey(passphrase)
+	check, err := seal(key, profileCheck, "check")
+	if err != nil {
+		return nil, err
+	}
+
+	ps.state.Kdf = kdf
+	ps.state.Check = check
+	return key, nil
+}
+
+func (ps *profiles) lock() {
+	ps.mutex.Lock()
+	defer ps.mutex.Unlock()
+
+	ps.key = nil
+}
+
+//re-encrypt every password under a new passphrase
+func (ps *profiles) changePassphrase(old string, passphrase string) error {
+	if len(passphrase) < MIN_PASSPHRASE_LEN {
+		return errors.New(ERR_WEAK_PASSPHRASE)
+	}
+
+	ps.mutex.Lock()
+	defer ps.mutex.Unlock()
+
+	oldKey, err := ps.verify(old)
+	if err != nil {
+		return err
+	}
+
+	saved := ps.state
+
+	key, err := ps.setPassphrase(passphrase)
+	if err != nil {
+		ps.state = saved
+		return err
+	}
+
+	//work on copies, nothing changes unless all of it succeeds
+	var list []*Profile
+	for _, p := range saved.Profiles {
+		c := p.copy()
+		if err := c.reseal(oldKey, key); err != nil {
+			ps.state = saved
+			return err
+		}
+		list = append(list, c)
+	}
+	ps.state.Profiles = list
+
+	if err := ps.save(); err != nil {
+		ps.state = saved
+		return err
+	}
+
+	ps.key = key
+	return nil
+}
+
+func (p *Profile) copy() *Profile {
+	c := *p
+	if p.Tunnel != nil {
+		t := *p.Tunnel
+		c.Tunnel = &t
+	}
+
+	return &c
+}
+
+func (p *Profile) reseal(oldKey []byte, key []byte) error {
+	fields := []struct {
+		value *string
+		ad    string
+	}{
+		{&p.Password, p.Id + "/password"},
+	}
+
+	if p.Tunnel != nil {
+		fields = append(fields, struct {
+			value *string
+			ad    string
+		}{&p.Tunnel.Password, p.Id + "/tunnel-password"})
+	}
+
+	for _, f := range fields {
+		if *f.value == "" {
+			continue
+		}
+
+		plain, err := unseal(oldKey, *f.value, f.ad)
+		if err != nil {
+			return err
+		}
+
+		*f.value, err = seal(key, plain, f.ad)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (ps *profiles) status() *ProfileList {
+	ps.mutex.Lock()
+	defer ps.mutex.Unlock()
+
+	list := &ProfileList{
+		Initialized: ps.state.Kdf != nil,
+		Locked:      ps.key == nil,
+		Profiles:    []*Profile{},
+	}
+
+	for _, p := range ps.state.Profiles {
+		list.Profiles = append(list.Profiles, p.view())
+	}
+
+	return list
+}
+
+//what is sent to the UI: the profile without its passwords
+func (p *Profile) view() *Profile {
+	v := p.copy()
+	v.HasPassword = p.Password != ""
+	v.Password = ""
+
+	if v.Tunnel != nil {
+		v.Tunnel.HasPassword = p.Tunnel.Password != ""
+		v.Tunnel.Password = ""
+	}
+
+	return v
+}
+
+//caller holds the mutex
+func (ps *profiles) find(id string) (int, error) {
+	for i, p := range ps.state.Profiles {
+		if p.Id == id {
+			return i, nil
+		}
+	}
+
+	return -1, errors.New(ERR_INVALID_PROFILE_ID)
+}
+
+//create a profile, or update one when pr has an id
+func (ps *profiles) put(pr *ProfileRequest) (*Profile, error) {
+	if err := pr.check(); err != nil {
+		return nil, err
+	}
+
+	ps.mutex.Lock()
+	defer ps.mutex.Unlock()
+
+	if ps.key == nil {
+		return nil, errors.New(ERR_PROFILES_LOCKED)
+	}
+
+	now := time.Now()
+	p := &Profile{Id: uniuri.New(), Created: now}
+	i := -1
+
+	if pr.Id != "" {
+		var err error
+		if i, err = ps.find(pr.Id); err != nil {
+			return nil, err
+		}
+		p = ps.state.Profiles[i].copy()
+	}
+
+	if err := pr.apply(p, ps.key); err != nil {
+		return nil, err
+	}
+	p.Updated = now
+
+	list := append([]*Profile{}, ps.state.Profiles...)
+	if i < 0 {
+		list = append(list, p)
+	} else {
+		list[i] = p
+	}
+
+	saved := ps.state.Profiles
+	ps.state.Profiles = list
+	if err := ps.save(); err != nil {
+		ps.state.Profiles = saved
+		return nil, err
+	}
+
+	return p.view(), nil
+}
+
+func (ps *profiles) remove(id string) error {
+	ps.mutex.Lock()
+	defer ps.mutex.Unlock()
+
+	i, err := ps.find(id)
+	if err != nil {
+		return err
+	}
+
+	saved := ps.state.Profiles
+	list := append([]*Profile{}, saved[:i]...)
+	ps.state.Profiles = append(list, saved[i+1:]...)
+
+	if err := ps.save(); err != nil {
+		ps.state.Profiles = saved
+		return err
+	}
+
+	return nil
+}
+
+//remember the tunnel's host key after the first connection
+func (ps *profiles) setHostKey(id string, fingerprint string) error {
+	ps.mutex.Lock()
+	defer ps.mutex.Unlock()
+
+	i, err := ps.find(id)
+	if err != nil {
+		return err
+	}
+
+	p := ps.state.Profiles[i].copy()
+	if p.Tunnel == nil {
+		return nil
+	}
+	p.Tunnel.HostKey = fingerprint
+
+	saved := ps.state.Profiles[i]
+	ps.state.Profiles[i] = p
+	if err := ps.save(); err != nil {
+		ps.state.Profiles[i] = saved
+		return err
+	}
+
+	return nil
+}
+
+//dsn for logging in with profile id. db overrides the profile's database.
+//Passwords are decrypted here and go no further than the session
+func (ps *profiles) dsn(id string, db string) (string, error) {
+	ps.mutex.Lock()
+	defer ps.mutex.Unlock()
+
+	i, err := ps.find(id)
+	if err != nil {
+		return "", err
+	}
+	p := ps.state.Profiles[i]
+
+	hasSecrets := p.Password != "" || (p.Tunnel != nil && p.Tunnel.Password != "")
+	if hasSecrets && ps.key == nil {
+		return "", errors.New(ERR_PROFILES_LOCKED)
+	}
+
+	cfg := mysql.NewConfig()
+	cfg.User = p.User
+	cfg.Net = "tcp"
+	cfg.Addr = net.JoinHostPort(p.Host, p.Port)
+	cfg.DBName = p.Db
+	cfg.TLSConfig = p.Tls
+
+	if db != "" {
+		cfg.DBName = db
+	}
+
+	if err := checkDbName(cfg.DBName); err != nil {
+		return "", err
+	}
+
+	if p.Password != "" {
+		cfg.Passwd, err = unseal(ps.key, p.Password, p.Id+"/password")
+		if err != nil {
+			return "", err
+		}
+	}
+
+	if p.Tunnel != nil {
+		t, err := newTunnel(p, ps.key)
+		if err != nil {
+			return "", err
+		}
+
+		cfg.Net, cfg.Addr = t.register()
+	}
+
+	return cfg.FormatDSN(), nil
+}
+
+func (pr *ProfileRequest) check() error {
+	if pr.Name == "" || pr.Host == "" || pr.Port == "" || pr.User == "" {
+		return errors.New("Name, host, port and user are required")
+	}
+
+	switch pr.Tls {
+	case "", "false", "true", "skip-verify", "preferred":
+	default:
+		return errors.New("tls must be true, false, skip-verify or preferred")
+	}
+
+	if pr.Tunnel == nil {
+		return nil
+	}
+
+	if pr.Tunnel.Host == "" || pr.Tunnel.User == "" {
+		return errors.New("Tunnel host and user are required")
+	}
+
+	//the certificate would be checked against the tunnel's address
+	if pr.Tls == "true" {
+		return errors.New("tls can't be verified through a tunnel, use skip-verify or preferred")
+	}
+
+	return nil
+}
+
+func (pr *ProfileRequest) apply(p *Profile, key []byte) error {
+	p.Name = pr.Name
+	p.Host = pr.Host
+	p.Port = pr.Port
+	p.User = pr.User
+	p.Db = pr.Db
+	p.Tls = pr.Tls
+
+	if pr.Password != nil {
+		sealed, err := sealPassword(key, *pr.Password, p.Id+"/password")
+		if err != nil {
+			return err
+		}
+		p.Password = sealed
+	}
+	p.HasPassword = p.Password != ""
+
+	if pr.Tunnel == nil {
+		p.Tunnel = nil
+		return nil
+	}
+
+	t := &Tunnel{}
+	if p.Tunnel != nil {
+		t = p.Tunnel
+	}
+
+	port := pr.Tunnel.Port
+	if port == "" {
+		port = DEFAULT_SSH_PORT
+	}
+
+	//a different server has a different key
+	if t.Host != pr.Tunnel.Host || t.Port != port {
+		t.HostKey = ""
+	}
+
+	t.Host = pr.Tunnel.Host
+	t.Port = port
+	t.User = pr.Tunnel.User
+	t.KeyFile = pr.Tunnel.KeyFile
+
+	if pr.Tunnel.Password != nil {
+		sealed, err := sealPassword(key, *pr.Tunnel.Password, p.Id+"/tunnel-password")
+		if err != nil {
+			return err
+		}
+		t.Password = sealed
+	}
+	t.HasPassword = t.Password != ""
+
+	p.Tunnel = t
+	return nil
+}
+
+//an empty password is stored as no password
+func sealPassword(key []byte, password string, ad string) (string, error) {
+	if password == "" {
+		return "", nil
+	}
+
+	return seal(key, password, ad)
+}
+
+type ProfileList struct {
+	Initialized bool       `json:"initialized"` //a passphrase has been set
+	Locked      bool       `json:"locked"`
+	Profiles    []*Profile `json:"profiles"`
+}
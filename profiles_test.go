@@ -0,0 +1,183 @@
+/* Copyright (C) 2021 Pankaj Kargirwar <kargirwar@protonmail.com>
+
+   This file is part of prosql-agent
+
+   prosql-agent is free software: you can redistribute it and/or modify
+   it under the terms of the GNU General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   prosql-agent is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU General Public License for more details.
+
+   You should have received a copy of the GNU General Public License
+   along with prosql-agent.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"path/filepath"
+	"testing"
+
+	"github.com/go-sql-driver/mysql"
+)
+
+func newTestProfiles(t *testing.T) *profiles {
+	ps, err := loadProfiles(filepath.Join(t.TempDir(), PROFILES_FILE))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return ps
+}
+
+func reloadProfiles(t *testing.T, ps *profiles) *profiles {
+	loaded, err := loadProfiles(ps.path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return loaded
+}
+
+func expectError(t *testing.T, what string, err error, code string) {
+	t.Helper()
+	if err == nil || err.Error() != code {
+		t.Errorf("%s: expected %s got %v\n", what, code, err)
+	}
+}
+
+func TestProfilePassphrase(t *testing.T) {
+	ps := newTestProfiles(t)
+
+	expectError(t, "short passphrase", ps.unlock("short"), ERR_WEAK_PASSPHRASE)
+	if ps.status().Initialized {
+		t.Errorf("expected no passphrase after a weak one\n")
+	}
+
+	if err := ps.unlock("correct horse"); err != nil {
+		t.Fatal(err)
+	}
+
+	ps.lock()
+	expectError(t, "wrong passphrase", ps.unlock("wrong horse"), ERR_WRONG_PASSPHRASE)
+	expectError(t, "empty passphrase", ps.unlock(""), ERR_WRONG_PASSPHRASE)
+	if !ps.status().Locked {
+		t.Errorf("expected a wrong passphrase to leave the profiles locked\n")
+	}
+
+	//the passphrase is not stored, only what checks it
+	loaded := reloadProfiles(t, ps)
+	expectError(t, "wrong passphrase after reload", loaded.unlock("wrong horse"), ERR_WRONG_PASSPHRASE)
+	if err := loaded.unlock("correct horse"); err != nil {
+		t.Errorf("expected the passphrase to unlock after reload got %s\n", err)
+	}
+}
+
+func TestChangePassphrase(t *testing.T) {
+	ps := newTestProfiles(t)
+	if err := ps.unlock("old passphrase"); err != nil {
+		t.Fatal(err)
+	}
+
+	str := func(s string) *string {
+		return &s
+	}
+
+	requests := []*ProfileRequest{
+		{Name: "db", Host: "db1", Port: "3306", User: "u1", Password: str("secret one")},
+		{Name: "none", Host: "db2", Port: "3306", User: "u2"},
+		{Name: "tunnel", Host: "db3", Port: "3306", User: "u3", Password: str("secret three"),
+			Tunnel: &TunnelRequest{Host: "bastion", User: "me", Password: str("ssh secret")}},
+		{Name: "tunnel only", Host: "db4", Port: "3306", User: "u4",
+			Tunnel: &TunnelRequest{Host: "bastion", User: "me", Password: str("ssh secret 2")}},
+	}
+
+	//sealed field and what it must decrypt to
+	type secret struct {
+		id       string
+		ad       string
+		value    func(p *Profile) string
+		expected string
+	}
+	var secrets []secret
+
+	password := func(p *Profile) string { return p.Password }
+	tunnelPassword := func(p *Profile) string { return p.Tunnel.Password }
+
+	for _, pr := range requests {
+		p, err := ps.put(pr)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if pr.Password != nil {
+			secrets = append(secrets, secret{p.Id, p.Id + "/password", password, *pr.Password})
+		}
+
+		if pr.Tunnel != nil && pr.Tunnel.Password != nil {
+			secrets = append(secrets, secret{p.Id, p.Id + "/tunnel-password", tunnelPassword, *pr.Tunnel.Password})
+		}
+	}
+
+	check := func(what string, ps *profiles) {
+		t.Helper()
+		for _, s := range secrets {
+			i, err := ps.find(s.id)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			plain, err := unseal(ps.key, s.value(ps.state.Profiles[i]), s.ad)
+			if err != nil || plain != s.expected {
+				t.Errorf("%s: %s: expected %q got %q, %v\n", what, s.ad, s.expected, plain, err)
+			}
+		}
+	}
+
+	check("before", ps)
+	before := ps.state
+
+	expectError(t, "wrong old passphrase", ps.changePassphrase("wrong passphrase", "new passphrase"), ERR_WRONG_PASSPHRASE)
+	expectError(t, "weak new passphrase", ps.changePassphrase("old passphrase", "short"), ERR_WEAK_PASSPHRASE)
+	if ps.state.Check != before.Check {
+		t.Errorf("expected a failed change to leave the passphrase alone\n")
+	}
+	check("after failed changes", ps)
+
+	if err := ps.changePassphrase("old passphrase", "new passphrase"); err != nil {
+		t.Fatal(err)
+	}
+	check("after change", ps)
+
+	for i, p := range ps.state.Profiles {
+		if p.Password != "" && p.Password == before.Profiles[i].Password {
+			t.Errorf("%s: expected the password to be sealed again\n", p.Name)
+		}
+	}
+
+	//what was written to disk opens with the new passphrase only
+	loaded := reloadProfiles(t, ps)
+	expectError(t, "old passphrase after change", loaded.unlock("old passphrase"), ERR_WRONG_PASSPHRASE)
+	if err := loaded.unlock("new passphrase"); err != nil {
+		t.Fatal(err)
+	}
+	check("after reload", loaded)
+
+	dsn, err := loaded.dsn(secrets[0].id, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cfg, err := mysql.ParseDSN(dsn)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if cfg.Passwd != secrets[0].expected {
+		t.Errorf("expected %q in the dsn got %q\n", secrets[0].expected, cfg.Passwd)
+	}
+}
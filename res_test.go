@@ -0,0 +1,256 @@
+/* Copyright (C) 2021 Pankaj Kargirwar <kargirwar@protonmail.com>
+
+   This file is part of prosql-agent
+
+   prosql-agent is free software: you can redistribute it and/or modify
+   it under the terms of the GNU General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   prosql-agent is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU General Public License for more details.
+
+   You should have received a copy of the GNU General Public License
+   along with prosql-agent.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"testing"
+
+	"github.com/dchest/uniuri"
+)
+
+var errBoom = errors.New("boom")
+
+//session whose handler answers every request with respond. The pool is
+//never connected to
+func fakeSession(t *testing.T, respond func(req *Req) *Res) string {
+	pool, err := sql.Open("mysql", "root@tcp(127.0.0.1:1)/test")
+	if err != nil {
+		t.Fatalf("%s\n", err.Error())
+	}
+
+	s := &session{
+		id:          uniuri.New(),
+		pool:        pool,
+		in:          make(chan *Req),
+		cursorStore: NewCursorStore(),
+		jobs:        newExportJobs(),
+	}
+	sessionStore.set(s.id, s)
+
+	done := make(chan struct{})
+	go func() {
+		for {
+			select {
+			case req := <-s.in:
+				req.resChan <- respond(req)
+			case <-done:
+				return
+			}
+		}
+	}()
+
+	t.Cleanup(func() {
+		close(done)
+		sessionStore.clear(s.id)
+		pool.Close()
+	})
+
+	return s.id
+}
+
+//every External Interface function which goes through the session handler
+func externalCalls(ctx context.Context, sid string) map[string]func() error {
+	return map[string]func() error{
+		"Query": func() error {
+			_, err := Query(ctx, sid, "select 1")
+			return err
+		},
+		"Execute": func() error {
+			_, err := Execute(ctx, sid, "do 1")
+			return err
+		},
+		"SetDb": func() error {
+			_, err := SetDb(ctx, sid, "test")
+			return err
+		},
+		"FetchSet": func() error {
+			_, err := FetchSet(ctx, sid, "cid", 10, FetchOptions{})
+			return err
+		},
+		"Fetch": func() error {
+			_, _, err := Fetch(ctx, sid, "cid", 10)
+			return err
+		},
+		"FetchTyped": func() error {
+			_, _, err := FetchTyped(ctx, sid, "cid", 10)
+			return err
+		},
+		"FetchCompact": func() error {
+			_, _, err := FetchCompact(ctx, sid, "cid", 10)
+			return err
+		},
+		"Fetch_ws": func() error {
+			return Fetch_ws(ctx, sid, "cid", &frameRecorder{}, 10, FetchOptions{})
+		},
+		"TxBegin": func() error {
+			return TxBegin(ctx, sid)
+		},
+		"TxSavepoint": func() error {
+			return TxSavepoint(ctx, sid, "a")
+		},
+		"TxGetStatus": func() error {
+			_, err := TxGetStatus(ctx, sid)
+			return err
+		},
+		"Cleanup": func() error {
+			return Cleanup(ctx, sid)
+		},
+	}
+}
+
+func TestResError(t *testing.T) {
+	tests := []struct {
+		res  *Res
+		want string
+	}{
+		{nil, ERR_UNEXPECTED_RESPONSE},
+		{&Res{code: ERROR}, ERR_UNEXPECTED_RESPONSE},
+		{&Res{code: "bogus"}, ERR_UNEXPECTED_RESPONSE},
+		{&Res{}, ERR_UNEXPECTED_RESPONSE},
+		{errorRes(errBoom), errBoom.Error()},
+		{&Res{code: SUCCESS}, ""},
+		{&Res{code: EOF}, ""},
+		{&Res{code: CLEANUP_DONE}, ""},
+	}
+
+	for _, test := range tests {
+		err := test.res.error()
+		if test.want == "" && err != nil {
+			t.Errorf("%+v: expected no error got %s\n", test.res, err.Error())
+		}
+
+		if test.want != "" && (err == nil || err.Error() != test.want) {
+			t.Errorf("%+v: expected %s got %v\n", test.res, test.want, err)
+		}
+	}
+}
+
+//errors from the session handler reach the caller
+func TestExternalError(t *testing.T) {
+	ctx := context.Background()
+	sid := fakeSession(t, func(req *Req) *Res {
+		return errorRes(errBoom)
+	})
+
+	for name, call := range externalCalls(ctx, sid) {
+		if err := call(); err != errBoom {
+			t.Errorf("%s: expected %s got %v\n", name, errBoom.Error(), err)
+		}
+	}
+}
+
+//responses the caller can't make sense of are errors, not panics
+func TestExternalUnexpectedResponse(t *testing.T) {
+	ctx := context.Background()
+
+	responses := map[string]func(req *Req) *Res{
+		"unknown code": func(req *Req) *Res {
+			return &Res{code: "bogus"}
+		},
+		"error without error": func(req *Req) *Res {
+			return &Res{code: ERROR}
+		},
+	}
+
+	for kind, respond := range responses {
+		sid := fakeSession(t, respond)
+
+		for name, call := range externalCalls(ctx, sid) {
+			err := call()
+			if err == nil || err.Error() != ERR_UNEXPECTED_RESPONSE {
+				t.Errorf("%s: %s: expected %s got %v\n", kind, name, ERR_UNEXPECTED_RESPONSE, err)
+			}
+		}
+	}
+}
+
+//a success without the result the command must return
+func TestExternalMissingResult(t *testing.T) {
+	ctx := context.Background()
+	sid := fakeSession(t, func(req *Req) *Res {
+		return &Res{code: SUCCESS}
+	})
+
+	calls := externalCalls(ctx, sid)
+	for _, name := range []string{"Query", "Execute", "FetchSet", "Fetch", "TxGetStatus"} {
+		err := calls[name]()
+		if err == nil || err.Error() != ERR_UNEXPECTED_RESPONSE {
+			t.Errorf("%s: expected %s got %v\n", name, ERR_UNEXPECTED_RESPONSE, err)
+		}
+	}
+}
+
+//session handler side of the error paths. Each request must get exactly
+//one response
+func handle(t *testing.T, s *session, req *Req) *Res {
+	req.ctx = context.Background()
+	req.resChan = make(chan *Res, 1)
+
+	handleSessionRequest(req.ctx, s, req)
+
+	select {
+	case res := <-req.resChan:
+		return res
+	default:
+		t.Fatalf("%s: no response\n", req.code)
+	}
+
+	return nil
+}
+
+func TestHandlerErrors(t *testing.T) {
+	s := &session{
+		id:          uniuri.New(),
+		cursorStore: NewCursorStore(),
+		jobs:        newExportJobs(),
+	}
+
+	tests := []struct {
+		req  *Req
+		want string
+	}{
+		{&Req{code: CMD_CANCEL, cid: "nope"}, ERR_INVALID_CURSOR_ID},
+		{&Req{code: CMD_FETCH, fetch: FetchReq{cid: "nope"}}, ERR_INVALID_CURSOR_ID},
+		{&Req{code: CMD_FETCH_WS, fetch: FetchReq{cid: "nope"}}, ERR_INVALID_CURSOR_ID},
+		{&Req{code: CMD_TX_COMMIT}, ERR_NO_TX},
+		{&Req{code: CMD_TX_ROLLBACK}, ERR_NO_TX},
+		{&Req{code: CMD_TX_SAVEPOINT, name: "a"}, ERR_NO_TX},
+		{&Req{code: "bogus"}, ERR_INVALID_CMD},
+	}
+
+	for _, test := range tests {
+		err := handle(t, s, test.req).error()
+		if err == nil || err.Error() != test.want {
+			t.Errorf("%s: expected %s got %v\n", test.req.code, test.want, err)
+		}
+	}
+}
+
+func TestCursorInvalidCommand(t *testing.T) {
+	c := createCursor(context.Background(), "select 1", false)
+	defer c.cancel()
+
+	res := handleCursorRequest(c, &Req{ctx: context.Background(), code: CMD_QUERY})
+	if err := res.error(); err == nil || err.Error() != ERR_INVALID_CURSOR_CMD {
+		t.Errorf("expected %s got %v\n", ERR_INVALID_CURSOR_CMD, err)
+	}
+}
@@ -19,10 +19,17 @@
 package main
 
 import (
+	"compress/gzip"
+	"encoding/json"
 	"errors"
 	"fmt"
+	"io"
 	"log"
+	"mime"
+	"net"
 	"net/http"
+	"os"
+	"strings"
 	"time"
 
 	"context"
@@ -31,7 +38,8 @@ import (
 	"strconv"
 
 	"github.com/denisbrodbeck/machineid"
-	_ "github.com/go-sql-driver/mysql"
+	"github.com/go-sql-driver/mysql"
+	"github.com/gorilla/websocket"
 	"github.com/kargirwar/prosql-agent/utils"
 )
 
@@ -41,19 +49,294 @@ type QueryParams struct {
 	Query     string
 	NumOfRows int
 	Export    bool
+	Typed     bool
+	NullToken string
+
+	Delimiter      string
+	QuoteAll       bool
+	LineEnding     string
+	Bom            bool
+	NoHeader       bool
+	DateFormat     string
+	DateTimeFormat string
+
+	Format     string
+	BatchRows  int
+	BatchBytes int
+	Encoding   string
+
+	ExportFormat string
+	Table        string
+	ExportDir    string
+	FileName     string
+	OnCollision  string
+	Mkdir        bool
+	Compress     string
+	SplitRows    int
+	SplitBytes   int
+	Download     bool
 }
 
+//body of POST /login and /ping
+type LoginRequest struct {
+	Profile         string `json:"profile"` //saved profile, instead of the credentials
+	User            string `json:"user"`
+	Pass            string `json:"pass"`
+	Host            string `json:"host"`
+	Port            string `json:"port"`
+	Db              string `json:"db"`
+	Pinned          bool   `json:"pinned"`
+	ReadConns       int    `json:"read-conns"`
+	MultiStatements bool   `json:"multi-statements"` //see allowMultiStatements
+	FoundRows       bool   `json:"found-rows"`       //see reportFoundRows
+}
+
+type LoginParams struct {
+	Dsn       string
+	Pinned    bool
+	ReadConns int
+}
+
+//body of POST /set-db
+type SetDbRequest struct {
+	SessionId string `json:"session-id"`
+	Db        string `json:"db"`
+}
+
+//body of POST /tx/*. Name is the savepoint name where one is needed
+type TxRequest struct {
+	SessionId string `json:"session-id"`
+	Name      string `json:"name"`
+}
+
+//body of POST /query and /execute
+type QueryRequest struct {
+	SessionId string `json:"session-id"`
+	Query     string `json:"query"`
+}
+
+//body of POST /script
+type ScriptRequest struct {
+	SessionId string `json:"session-id"`
+	Script    string `json:"script"`
+	OnError   string `json:"on-error"`
+}
+
+//body of POST /pair/complete
+type PairRequest struct {
+	Code string `json:"code"`
+	Name string `json:"name"` //shown when tokens are listed
+}
+
+//body of POST /pair/revoke
+type RevokeRequest struct {
+	TokenId string `json:"token-id"`
+}
+
+//body of POST /profiles/create and /profiles/update. Passwords left out
+//are kept, empty ones are removed
+type ProfileRequest struct {
+	Id       string         `json:"id"`
+	Name     string         `json:"name"`
+	Host     string         `json:"host"`
+	Port     string         `json:"port"`
+	User     string         `json:"user"`
+	Password *string        `json:"password"`
+	Db       string         `json:"db"`
+	Tls      string         `json:"tls"`
+	Tunnel   *TunnelRequest `json:"tunnel"`
+}
+
+type TunnelRequest struct {
+	Host     string  `json:"host"`
+	Port     string  `json:"port"`
+	User     string  `json:"user"`
+	Password *string `json:"password"`
+	KeyFile  string  `json:"key-file"`
+}
+
+//body of POST /profiles/unlock and /profiles/passphrase
+type PassphraseRequest struct {
+	Passphrase    string `json:"passphrase"`
+	NewPassphrase string `json:"new-passphrase"`
+}
+
+//body of POST /profiles/delete
+type ProfileIdRequest struct {
+	Id string `json:"id"`
+}
+
+//decode JSON body of a POST request into v. Unknown fields are rejected so that
+//typos in the client do not silently fall back to defaults
+func decodeBody(r *http.Request, v interface{}) error {
+	if r.Body == nil {
+		return errors.New("Request body not provided")
+	}
+
+	dec := json.NewDecoder(http.MaxBytesReader(nil, r.Body, MAX_REQUEST_BODY_SIZE))
+	dec.DisallowUnknownFields()
+
+	if err := dec.Decode(v); err != nil {
+		return errors.New("Invalid request body: " + err.Error())
+	}
+
+	//there must be exactly one JSON value in the body
+	if dec.More() {
+		return errors.New("Invalid request body: unexpected data after JSON object")
+	}
+
+	return nil
+}
+
+//an empty password is valid, so only user, host and port are required.
+//With a profile they come from the profile, see profiles.go
+func (lr *LoginRequest) dsn() (string, error) {
+	if lr.Profile != "" {
+		if lr.User != "" || lr.Pass != "" || lr.Host != "" || lr.Port != "" {
+			return "", errors.New("Credentials can't be sent along with a profile")
+		}
+		return profileStore.dsn(lr.Profile, lr.Db)
+	}
+
+	if lr.User == "" {
+		return "", errors.New("User not provided")
+	}
+
+	if lr.Host == "" {
+		return "", errors.New("Host not provided")
+	}
+
+	if lr.Port == "" {
+		return "", errors.New("Port not provided")
+	}
+
+	return formatDsn(lr.User, lr.Pass, lr.Host, lr.Port, lr.Db)
+}
+
+func (qr *QueryRequest) params() (*QueryParams, error) {
+	if qr.SessionId == "" {
+		return nil, errors.New("Session ID not provided")
+	}
+
+	if qr.Query == "" {
+		return nil, errors.New("Query not provided")
+	}
+
+	return &QueryParams{
+		SessionId: qr.SessionId,
+		Query:     qr.Query,
+	}, nil
+}
+
+func (lr *LoginRequest) params() (*LoginParams, error) {
+	dsn, err := lr.dsn()
+	if err != nil {
+		return nil, err
+	}
+
+	if lr.MultiStatements {
+		if dsn, err = allowMultiStatements(dsn); err != nil {
+			return nil, err
+		}
+	}
+
+	if lr.FoundRows {
+		if dsn, err = reportFoundRows(dsn); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := checkReadConns(lr.Pinned, lr.ReadConns); err != nil {
+		return nil, err
+	}
+
+	return &LoginParams{
+		Dsn:       dsn,
+		Pinned:    lr.Pinned,
+		ReadConns: lr.ReadConns,
+	}, nil
+}
+
+func checkReadConns(pinned bool, n int) error {
+	if n != 0 && !pinned {
+		return errors.New("Read connections are only available for pinned sessions")
+	}
+
+	if n < 0 || n > MAX_READ_CONNS {
+		return fmt.Errorf("Read connections must be between 0 and %d", MAX_READ_CONNS)
+	}
+
+	return nil
+}
+
+func getLoginParams(r *http.Request) (*LoginParams, error) {
+	var lr LoginRequest
+
+	if r.Method == http.MethodPost {
+		if err := decodeBody(r, &lr); err != nil {
+			return nil, err
+		}
+		return lr.params()
+	}
+
+	params := r.URL.Query()
+
+	dsn, err := getDsn(r)
+	if err != nil {
+		return nil, err
+	}
+
+	_, lr.Pinned = params["pinned"]
+
+	if _, present := params["multi-statements"]; present {
+		if dsn, err = allowMultiStatements(dsn); err != nil {
+			return nil, err
+		}
+	}
+
+	if _, present := params["found-rows"]; present {
+		if dsn, err = reportFoundRows(dsn); err != nil {
+			return nil, err
+		}
+	}
+
+	n, present := params["read-conns"]
+	if present && len(n) != 0 {
+		lr.ReadConns, err = strconv.Atoi(n[0])
+		if err != nil {
+			return nil, errors.New("Read connections must be integer")
+		}
+	}
+
+	if err := checkReadConns(lr.Pinned, lr.ReadConns); err != nil {
+		return nil, err
+	}
+
+	return &LoginParams{
+		Dsn:       dsn,
+		Pinned:    lr.Pinned,
+		ReadConns: lr.ReadConns,
+	}, nil
+}
+
+//dsn from the query string of a GET login. Same rules as LoginRequest.dsn
 func getDsn(r *http.Request) (dsn string, err error) {
 	params := r.URL.Query()
 
-	user, present := params["user"]
-	if !present || len(user) == 0 {
-		e := errors.New("User not provided")
-		return "", e
+	if params.Get("profile") != "" {
+		lr := LoginRequest{
+			Profile: params.Get("profile"),
+			User:    params.Get("user"),
+			Pass:    params.Get("pass"),
+			Host:    params.Get("host"),
+			Port:    params.Get("port"),
+			Db:      params.Get("db"),
+		}
+		return lr.dsn()
 	}
 
-	pass, present := params["pass"]
-	if !present || len(pass) == 0 {
+	user, present := params["user"]
+	if !present || len(user) == 0 {
 		e := errors.New("User not provided")
 		return "", e
 	}
@@ -76,7 +359,58 @@ func getDsn(r *http.Request) (dsn string, err error) {
 		dbName = db[0]
 	}
 
-	return fmt.Sprintf("%s:%s@tcp(%s:%s)/%s", user[0], pass[0], host[0], port[0], dbName), nil
+	return formatDsn(user[0], params.Get("pass"), host[0], port[0], dbName)
+}
+
+//let the driver escape whatever the values contain
+func formatDsn(user string, pass string, host string, port string, db string) (string, error) {
+	if err := checkDbName(db); err != nil {
+		return "", err
+	}
+
+	cfg := mysql.NewConfig()
+	cfg.User = user
+	cfg.Passwd = pass
+	cfg.Net = "tcp"
+	cfg.Addr = net.JoinHostPort(host, port)
+	cfg.DBName = db
+
+	return cfg.FormatDSN(), nil
+}
+
+//let one query carry several statements separated by ;, each of which
+//comes back as a result set of its own. Off unless asked for at login, so
+//that text spliced into a query can't run statements of its own
+func allowMultiStatements(dsn string) (string, error) {
+	cfg, err := mysql.ParseDSN(dsn)
+	if err != nil {
+		return "", err
+	}
+
+	cfg.MultiStatements = true
+	return cfg.FormatDSN(), nil
+}
+
+//have the server count the rows an UPDATE matched instead of those it
+//changed, see execresult.go
+func reportFoundRows(dsn string) (string, error) {
+	cfg, err := mysql.ParseDSN(dsn)
+	if err != nil {
+		return "", err
+	}
+
+	cfg.ClientFoundRows = true
+	return cfg.FormatDSN(), nil
+}
+
+//the driver writes the database name into the dsn as is, where / and ?
+//would end it early
+func checkDbName(db string) error {
+	if strings.ContainsAny(db, "/?") {
+		return errors.New("Database name can't contain / or ?")
+	}
+
+	return nil
 }
 
 func about(w http.ResponseWriter, r *http.Request) {
@@ -96,17 +430,235 @@ func about(w http.ResponseWriter, r *http.Request) {
 	}{id, VERSION, OS}, false)
 }
 
-func ping(w http.ResponseWriter, r *http.Request) {
+//show a one-time pairing code on the agent's console
+func pairStart(w http.ResponseWriter, r *http.Request) {
 	defer utils.TimeTrack(r.Context(), time.Now())
 
-	dsn, err := getDsn(r)
+	expires, err := pairingStore.start()
 	if err != nil {
+		sendPairingError(r.Context(), w, err)
+		return
+	}
+
+	utils.SendSuccess(r.Context(), w, struct {
+		Expires time.Time `json:"expires"`
+	}{expires}, false)
+}
+
+//exchange the code shown by pairStart for a token
+func pairComplete(w http.ResponseWriter, r *http.Request) {
+	defer utils.TimeTrack(r.Context(), time.Now())
+
+	var pr PairRequest
+	if err := decodeBody(r, &pr); err != nil {
 		utils.SendError(r.Context(), w, err, ERR_INVALID_USER_INPUT)
 		return
 	}
 
+	token, t, err := pairingStore.complete(pr.Code, pr.Name)
+	if err != nil {
+		sendPairingError(r.Context(), w, err)
+		return
+	}
+
+	utils.SendSuccess(r.Context(), w, struct {
+		Token   string `json:"token"`
+		TokenId string `json:"token-id"`
+	}{token, t.Id}, false)
+}
+
+//wrong codes and lockouts are refusals, anything else is the agent's fault
+func sendPairingError(ctx context.Context, w http.ResponseWriter, err error) {
+	switch err.Error() {
+	case ERR_INVALID_PAIRING_CODE, ERR_PAIRING_LOCKED:
+		w.WriteHeader(http.StatusUnauthorized)
+		utils.SendError(ctx, w, err, err.Error())
+	default:
+		utils.SendError(ctx, w, err, ERR_UNRECOVERABLE)
+	}
+}
+
+func pairTokens(w http.ResponseWriter, r *http.Request) {
+	defer utils.TimeTrack(r.Context(), time.Now())
+
+	utils.SendSuccess(r.Context(), w, pairingStore.list(), false)
+}
+
+//revoke a token. Requests carrying it are refused from now on
+func pairRevoke(w http.ResponseWriter, r *http.Request) {
+	defer utils.TimeTrack(r.Context(), time.Now())
+
+	var rr RevokeRequest
+	if err := decodeBody(r, &rr); err != nil {
+		utils.SendError(r.Context(), w, err, ERR_INVALID_USER_INPUT)
+		return
+	}
+
+	if err := pairingStore.revoke(rr.TokenId); err != nil {
+		utils.SendError(r.Context(), w, err, ERR_INVALID_USER_INPUT)
+		return
+	}
+
+	utils.SendSuccess(r.Context(), w, "success", false)
+}
+
+//single-use ticket for a websocket or download, see pairing.go
+func pairTicket(w http.ResponseWriter, r *http.Request) {
+	defer utils.TimeTrack(r.Context(), time.Now())
+
+	t, err := pairingStore.verify(requestToken(r))
+	if err != nil {
+		w.WriteHeader(http.StatusUnauthorized)
+		utils.SendError(r.Context(), w, err, ERR_UNAUTHORIZED)
+		return
+	}
+
+	ticket, expires, err := pairingStore.issueTicket(t.Id)
+	if err != nil {
+		utils.SendError(r.Context(), w, err, ERR_UNRECOVERABLE)
+		return
+	}
+
+	utils.SendSuccess(r.Context(), w, struct {
+		Ticket  string    `json:"ticket"`
+		Expires time.Time `json:"expires"`
+	}{ticket, expires}, false)
+}
+
+//saved profiles, without their passwords
+func profilesList(w http.ResponseWriter, r *http.Request) {
+	defer utils.TimeTrack(r.Context(), time.Now())
+
+	utils.SendSuccess(r.Context(), w, profileStore.status(), false)
+}
+
+//set the master passphrase, or check it and keep the key until locked
+func profilesUnlock(w http.ResponseWriter, r *http.Request) {
+	defer utils.TimeTrack(r.Context(), time.Now())
+
+	var pr PassphraseRequest
+	if err := decodeBody(r, &pr); err != nil {
+		utils.SendError(r.Context(), w, err, ERR_INVALID_USER_INPUT)
+		return
+	}
+
+	if err := profileStore.unlock(pr.Passphrase); err != nil {
+		sendProfileError(r.Context(), w, err, ERR_UNRECOVERABLE)
+		return
+	}
+
+	utils.SendSuccess(r.Context(), w, "success", false)
+}
+
+func profilesLock(w http.ResponseWriter, r *http.Request) {
+	defer utils.TimeTrack(r.Context(), time.Now())
+
+	profileStore.lock()
+	utils.SendSuccess(r.Context(), w, "success", false)
+}
+
+//change the master passphrase, passwords are encrypted again
+func profilesPassphrase(w http.ResponseWriter, r *http.Request) {
+	defer utils.TimeTrack(r.Context(), time.Now())
+
+	var pr PassphraseRequest
+	if err := decodeBody(r, &pr); err != nil {
+		utils.SendError(r.Context(), w, err, ERR_INVALID_USER_INPUT)
+		return
+	}
+
+	if err := profileStore.changePassphrase(pr.Passphrase, pr.NewPassphrase); err != nil {
+		sendProfileError(r.Context(), w, err, ERR_UNRECOVERABLE)
+		return
+	}
+
+	utils.SendSuccess(r.Context(), w, "success", false)
+}
+
+func profileCreate(w http.ResponseWriter, r *http.Request) {
+	defer utils.TimeTrack(r.Context(), time.Now())
+
+	var pr ProfileRequest
+	if err := decodeBody(r, &pr); err != nil {
+		utils.SendError(r.Context(), w, err, ERR_INVALID_USER_INPUT)
+		return
+	}
+
+	if pr.Id != "" {
+		utils.SendError(r.Context(), w, errors.New("Profile ID not allowed"), ERR_INVALID_USER_INPUT)
+		return
+	}
+
+	putProfile(w, r, &pr)
+}
+
+func profileUpdate(w http.ResponseWriter, r *http.Request) {
+	defer utils.TimeTrack(r.Context(), time.Now())
+
+	var pr ProfileRequest
+	if err := decodeBody(r, &pr); err != nil {
+		utils.SendError(r.Context(), w, err, ERR_INVALID_USER_INPUT)
+		return
+	}
+
+	if pr.Id == "" {
+		utils.SendError(r.Context(), w, errors.New("Profile ID not provided"), ERR_INVALID_USER_INPUT)
+		return
+	}
+
+	putProfile(w, r, &pr)
+}
+
+func putProfile(w http.ResponseWriter, r *http.Request, pr *ProfileRequest) {
+	p, err := profileStore.put(pr)
+	if err != nil {
+		sendProfileError(r.Context(), w, err, ERR_INVALID_USER_INPUT)
+		return
+	}
+
+	utils.SendSuccess(r.Context(), w, p, false)
+}
+
+func profileDelete(w http.ResponseWriter, r *http.Request) {
+	defer utils.TimeTrack(r.Context(), time.Now())
+
+	var pr ProfileIdRequest
+	if err := decodeBody(r, &pr); err != nil {
+		utils.SendError(r.Context(), w, err, ERR_INVALID_USER_INPUT)
+		return
+	}
+
+	if err := profileStore.remove(pr.Id); err != nil {
+		sendProfileError(r.Context(), w, err, ERR_UNRECOVERABLE)
+		return
+	}
+
+	utils.SendSuccess(r.Context(), w, "success", false)
+}
+
+//errors of saved profiles carry their own code, anything else gets code
+func sendProfileError(ctx context.Context, w http.ResponseWriter, err error, code string) {
+	switch err.Error() {
+	case ERR_INVALID_PROFILE_ID, ERR_PROFILES_LOCKED, ERR_WRONG_PASSPHRASE,
+		ERR_WEAK_PASSPHRASE, ERR_TUNNEL_HOST_KEY:
+		code = err.Error()
+	}
+
+	utils.SendError(ctx, w, err, code)
+}
+
+func ping(w http.ResponseWriter, r *http.Request) {
+	defer utils.TimeTrack(r.Context(), time.Now())
+
+	//same parameters as login, so that a ping tells whether login would work
+	params, err := getLoginParams(r)
+	if err != nil {
+		sendProfileError(r.Context(), w, err, ERR_INVALID_USER_INPUT)
+		return
+	}
+
 	var pool *sql.DB // Database connection pool.
-	pool, err = sql.Open("mysql", dsn)
+	pool, err = sql.Open("mysql", params.Dsn)
 	if err != nil {
 		utils.SendError(r.Context(), w, err, ERR_DB_ERROR)
 		return
@@ -116,8 +668,16 @@ func ping(w http.ResponseWriter, r *http.Request) {
 	ctx, cancel := context.WithTimeout(context.Background(), 1*time.Second)
 	defer cancel()
 
-	if err := pool.PingContext(ctx); err != nil {
-		utils.SendError(r.Context(), w, err, ERR_DB_ERROR)
+	//a pinned session holds all its connections from the start
+	if params.Pinned {
+		cs, err := newConnSet(ctx, pool, params.ReadConns, "")
+		if err != nil {
+			sendProfileError(r.Context(), w, err, ERR_DB_ERROR)
+			return
+		}
+		cs.close()
+	} else if err := pool.PingContext(ctx); err != nil {
+		sendProfileError(r.Context(), w, err, ERR_DB_ERROR)
 		return
 	}
 
@@ -127,15 +687,21 @@ func ping(w http.ResponseWriter, r *http.Request) {
 func login(w http.ResponseWriter, r *http.Request) {
 	defer utils.TimeTrack(r.Context(), time.Now())
 
-	dsn, err := getDsn(r)
+	params, err := getLoginParams(r)
 	if err != nil {
-		utils.SendError(r.Context(), w, err, ERR_INVALID_USER_INPUT)
+		sendProfileError(r.Context(), w, err, ERR_INVALID_USER_INPUT)
 		return
 	}
 
-	sid, err := NewSession(r.Context(), "mysql", dsn)
+	var sid string
+	if params.Pinned {
+		sid, err = NewPinnedSession(r.Context(), "mysql", params.Dsn, params.ReadConns)
+	} else {
+		sid, err = NewSession(r.Context(), "mysql", params.Dsn)
+	}
+
 	if err != nil {
-		utils.SendError(r.Context(), w, err, ERR_DB_ERROR)
+		sendProfileError(r.Context(), w, err, ERR_DB_ERROR)
 		return
 	}
 
@@ -166,18 +732,120 @@ func cancel(w http.ResponseWriter, r *http.Request) {
 	utils.SendSuccess(r.Context(), w, nil, false)
 }
 
+//switch the default database for the session
+func setDb(w http.ResponseWriter, r *http.Request) {
+	ctx := utils.GetContext(r)
+	defer utils.TimeTrack(ctx, time.Now())
+
+	sid, db, err := getSetDbParams(r)
+
+	if err != nil {
+		utils.SendError(ctx, w, err, ERR_INVALID_USER_INPUT)
+		return
+	}
+
+	current, err := SetDb(ctx, sid, db)
+
+	if err != nil {
+		utils.SendError(ctx, w, err, ERR_DB_ERROR)
+		return
+	}
+
+	utils.SendSuccess(ctx, w, struct {
+		Db string `json:"db"`
+	}{current}, false)
+}
+
+func txBegin(w http.ResponseWriter, r *http.Request) {
+	txCommand(w, r, false, func(ctx context.Context, sid, _ string) error {
+		return TxBegin(ctx, sid)
+	})
+}
+
+func txCommit(w http.ResponseWriter, r *http.Request) {
+	txCommand(w, r, false, func(ctx context.Context, sid, _ string) error {
+		return TxCommit(ctx, sid)
+	})
+}
+
+func txRollback(w http.ResponseWriter, r *http.Request) {
+	txCommand(w, r, false, func(ctx context.Context, sid, _ string) error {
+		return TxRollback(ctx, sid)
+	})
+}
+
+func txSavepoint(w http.ResponseWriter, r *http.Request) {
+	txCommand(w, r, true, TxSavepoint)
+}
+
+func txRollbackTo(w http.ResponseWriter, r *http.Request) {
+	txCommand(w, r, true, TxRollbackTo)
+}
+
+func txRelease(w http.ResponseWriter, r *http.Request) {
+	txCommand(w, r, true, TxRelease)
+}
+
+//common part of all /tx routes which change the transaction. The
+//response carries the transaction status after the change
+func txCommand(w http.ResponseWriter, r *http.Request, needName bool,
+	fn func(ctx context.Context, sid string, name string) error) {
+
+	ctx := utils.GetContext(r)
+	defer utils.TimeTrack(ctx, time.Now())
+
+	sid, name, err := getTxParams(r, needName)
+	if err != nil {
+		utils.SendError(ctx, w, err, ERR_INVALID_USER_INPUT)
+		return
+	}
+
+	err = fn(ctx, sid, name)
+	if err != nil {
+		utils.SendError(ctx, w, err, ERR_DB_ERROR)
+		return
+	}
+
+	status, err := TxGetStatus(ctx, sid)
+	if err != nil {
+		utils.SendError(ctx, w, err, ERR_INVALID_USER_INPUT)
+		return
+	}
+
+	utils.SendSuccess(ctx, w, status, false)
+}
+
+func txStatus(w http.ResponseWriter, r *http.Request) {
+	ctx := utils.GetContext(r)
+	defer utils.TimeTrack(ctx, time.Now())
+
+	sid, _, err := getTxParams(r, false)
+	if err != nil {
+		utils.SendError(ctx, w, err, ERR_INVALID_USER_INPUT)
+		return
+	}
+
+	status, err := TxGetStatus(ctx, sid)
+	if err != nil {
+		utils.SendError(ctx, w, err, ERR_INVALID_USER_INPUT)
+		return
+	}
+
+	utils.SendSuccess(ctx, w, status, false)
+}
+
 //execute query and return its cursor id for later use
 func query(w http.ResponseWriter, r *http.Request) {
 	defer utils.TimeTrack(r.Context(), time.Now())
 
-	sid, query, err := getQueryParams(r)
+	params, err := getQueryParams(r)
 
 	if err != nil {
 		utils.SendError(r.Context(), w, err, ERR_INVALID_USER_INPUT)
 		return
 	}
 
-	cid, err := Query(r.Context(), sid, query)
+	cid, err := Query(r.Context(), params.SessionId, params.Query)
 
 	if err != nil {
 		utils.SendError(r.Context(), w, err, ERR_INVALID_USER_INPUT)
@@ -193,14 +861,14 @@ func query(w http.ResponseWriter, r *http.Request) {
 func execute(w http.ResponseWriter, r *http.Request) {
 	defer utils.TimeTrack(r.Context(), time.Now())
 
-	sid, query, err := getQueryParams(r)
+	params, err := getExecuteParams(r)
 
 	if err != nil {
 		utils.SendError(r.Context(), w, err, ERR_INVALID_USER_INPUT)
 		return
 	}
 
-	cid, err := Execute(r.Context(), sid, query)
+	cid, err := Execute(r.Context(), params.SessionId, params.Query)
 
 	if err != nil {
 		utils.SendError(r.Context(), w, err, ERR_INVALID_USER_INPUT)
@@ -212,24 +880,68 @@ func execute(w http.ResponseWriter, r *http.Request) {
 	}{cid}, false)
 }
 
+//run a script statement by statement. The response is a stream of JSON
+//lines, one per statement as it completes, followed by the usual response
+//carrying a summary
+func script(w http.ResponseWriter, r *http.Request) {
+	ctx := utils.GetContext(r)
+	defer utils.TimeTrack(ctx, time.Now())
+
+	var sr ScriptRequest
+	if err := decodeBody(r, &sr); err != nil {
+		utils.SendError(ctx, w, err, ERR_INVALID_USER_INPUT)
+		return
+	}
+
+	if sr.SessionId == "" {
+		utils.SendError(ctx, w, errors.New("Session ID not provided"), ERR_INVALID_USER_INPUT)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	flusher, _ := w.(http.Flusher)
+	enc := json.NewEncoder(w)
+
+	summary, err := RunScript(ctx, sr.SessionId, sr.Script, sr.OnError, func(st *StatementStatus) error {
+		if err := enc.Encode(st); err != nil {
+			return err
+		}
+
+		if flusher != nil {
+			flusher.Flush()
+		}
+		return nil
+	})
+
+	if err != nil {
+		utils.SendError(ctx, w, err, ERR_INVALID_USER_INPUT)
+		return
+	}
+
+	utils.SendSuccess(ctx, w, summary, true)
+}
+
 func fetch(w http.ResponseWriter, r *http.Request) {
 	defer utils.TimeTrack(r.Context(), time.Now())
 
-	sid, cid, n, err := getFetchParams(r)
+	params, err := getFetchParams(r)
 
 	if err != nil {
 		utils.SendError(r.Context(), w, err, ERR_INVALID_USER_INPUT)
 		return
 	}
 
-	rows, eof, err := Fetch(r.Context(), sid, cid, n)
+	result, err := FetchSet(r.Context(), params.SessionId, params.CursorId, params.NumOfRows, FetchOptions{
+		Typed:  params.Typed,
+		Format: params.Format,
+	})
 
 	if err != nil {
 		utils.SendError(r.Context(), w, err, ERR_DB_ERROR)
 		return
 	}
 
-	utils.SendSuccess(r.Context(), w, rows, eof)
+	utils.SendRows(r.Context(), w, result.Rows, result.Eof, result.ResultSet, result.SetEnd)
 }
 
 func fetch_ws(w http.ResponseWriter, r *http.Request) {
@@ -246,46 +958,244 @@ func fetch_ws(w http.ResponseWriter, r *http.Request) {
 
 	params, err := getFetchParams_ws(r)
 
+	//the connection is a websocket by now
 	if err != nil {
-		utils.SendError(r.Context(), w, err, ERR_INVALID_USER_INPUT)
+		utils.SendError_ws(ctx, ws, err, ERR_INVALID_USER_INPUT)
+		return
+	}
+
+	err = Fetch_ws(ctx, params.SessionId, params.CursorId, ws, params.NumOfRows, params.fetchOptions())
+
+	if err != nil {
+		utils.SendError_ws(ctx, ws, err, ERR_INVALID_USER_INPUT)
+		return
+	}
+}
+
+//start an export job and return its id right away
+func exportStart(w http.ResponseWriter, r *http.Request) {
+	ctx := utils.GetContext(r)
+	defer utils.TimeTrack(ctx, time.Now())
+
+	params, err := getFetchParams_ws(r)
+	if err != nil {
+		utils.SendError(ctx, w, err, ERR_INVALID_USER_INPUT)
+		return
+	}
+
+	jid, err := StartExport(ctx, params.SessionId, params.CursorId, params.NumOfRows, params.fetchOptions())
+	if err != nil {
+		utils.SendError(ctx, w, err, ERR_INVALID_USER_INPUT)
+		return
+	}
+
+	utils.SendSuccess(ctx, w, struct {
+		JobId string `json:"job-id"`
+	}{jid}, false)
+}
+
+func exportList(w http.ResponseWriter, r *http.Request) {
+	ctx := utils.GetContext(r)
+	defer utils.TimeTrack(ctx, time.Now())
+
+	sid, _, err := getJobParams(r, false)
+	if err != nil {
+		utils.SendError(ctx, w, err, ERR_INVALID_USER_INPUT)
+		return
+	}
+
+	jobs, err := ExportJobs(ctx, sid)
+	if err != nil {
+		utils.SendError(ctx, w, err, ERR_INVALID_USER_INPUT)
+		return
+	}
+
+	utils.SendSuccess(ctx, w, jobs, false)
+}
+
+func exportCancel(w http.ResponseWriter, r *http.Request) {
+	ctx := utils.GetContext(r)
+	defer utils.TimeTrack(ctx, time.Now())
+
+	sid, jid, err := getJobParams(r, true)
+	if err != nil {
+		utils.SendError(ctx, w, err, ERR_INVALID_USER_INPUT)
+		return
+	}
+
+	err = CancelExport(ctx, sid, jid)
+	if err != nil {
+		utils.SendError(ctx, w, err, ERR_INVALID_USER_INPUT)
+		return
+	}
+
+	utils.SendSuccess(ctx, w, "success", false)
+}
+
+//follow a running job, or get the final state of a finished one
+func export_ws(w http.ResponseWriter, r *http.Request) {
+	ctx := utils.GetContext(r)
+	defer utils.TimeTrack(ctx, time.Now())
+
+	ws, err := utils.Upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		log.Println(err)
+		utils.Dbg(ctx, fmt.Sprintf("%s", err.Error()))
 		return
 	}
+	defer ws.Close()
 
-	err = Fetch_ws(ctx, params.SessionId, params.CursorId, ws, params.NumOfRows, params.Export)
+	sid, jid, err := getJobParams(r, true)
+	if err != nil {
+		utils.SendError_ws(ctx, ws, err, ERR_INVALID_USER_INPUT)
+		return
+	}
 
+	j, err := AttachExport(ctx, sid, jid, ws)
 	if err != nil {
 		utils.SendError_ws(ctx, ws, err, ERR_INVALID_USER_INPUT)
 		return
 	}
+
+	waitForJob(ws, j)
+	j.detach(ws)
+
+	select {
+	case <-j.done:
+		if err := j.error(); err != nil {
+			ws.WriteMessage(websocket.TextMessage, jobErrorMsg(err))
+		}
+	default:
+	}
+}
+
+func (params *QueryParams) fetchOptions() FetchOptions {
+	return FetchOptions{
+		Export:    params.Export,
+		Typed:     params.Typed,
+		NullToken: params.NullToken,
+
+		Delimiter:      params.Delimiter,
+		QuoteAll:       params.QuoteAll,
+		LineEnding:     params.LineEnding,
+		Bom:            params.Bom,
+		NoHeader:       params.NoHeader,
+		DateFormat:     params.DateFormat,
+		DateTimeFormat: params.DateTimeFormat,
+
+		Format:     params.Format,
+		BatchRows:  params.BatchRows,
+		BatchBytes: params.BatchBytes,
+		Encoding:   params.Encoding,
+
+		ExportFormat: params.ExportFormat,
+		Table:        params.Table,
+		ExportDir:    params.ExportDir,
+		FileName:     params.FileName,
+		OnCollision:  params.OnCollision,
+		Mkdir:        params.Mkdir,
+		Compress:     params.Compress,
+		SplitRows:    params.SplitRows,
+		SplitBytes:   params.SplitBytes,
+		Download:     params.Download,
+	}
 }
 
-func getFetchParams(r *http.Request) (string, string, int, error) {
+func getJobParams(r *http.Request, needJob bool) (string, string, error) {
 	params := r.URL.Query()
 
 	sid, present := params["session-id"]
 	if !present || len(sid) == 0 {
 		e := errors.New("Session ID not provided")
-		return "", "", -1, e
+		return "", "", e
+	}
+
+	if !needJob {
+		return sid[0], "", nil
+	}
+
+	jid, present := params["job-id"]
+	if !present || len(jid) == 0 {
+		e := errors.New("Job ID not provided")
+		return "", "", e
+	}
+
+	return sid[0], jid[0], nil
+}
+
+func getFetchParams(r *http.Request) (*QueryParams, error) {
+	params := r.URL.Query()
+
+	sid, present := params["session-id"]
+	if !present || len(sid) == 0 {
+		e := errors.New("Session ID not provided")
+		return nil, e
 	}
 
 	cid, present := params["cursor-id"]
 	if !present || len(cid) == 0 {
 		e := errors.New("Cursor ID not provided")
-		return "", "", -1, e
+		return nil, e
 	}
 
 	num, present := params["num-of-rows"]
 	if !present || len(num) == 0 {
 		e := errors.New("Number of rows not provided")
-		return "", "", -1, e
+		return nil, e
 	}
 
 	n, err := strconv.Atoi(num[0])
 	if err != nil {
 		e := errors.New("Number of rows must be integer")
-		return "", "", -1, e
+		return nil, e
+	}
+
+	//whether to send column metadata and typed values
+	_, typed := params["typed"]
+
+	fp := &QueryParams{
+		SessionId: sid[0],
+		CursorId:  cid[0],
+		NumOfRows: n,
+		Typed:     typed,
 	}
-	return sid[0], cid[0], n, nil
+
+	if err := getFormatParams(params, fp); err != nil {
+		return nil, err
+	}
+
+	return fp, nil
+}
+
+//format, batch-rows and batch-bytes. Missing values get their defaults
+func getFormatParams(input url.Values, params *QueryParams) error {
+	opts := FetchOptions{Format: input.Get("format")}
+
+	if v := input.Get("batch-rows"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil {
+			return errors.New("Batch rows must be integer")
+		}
+		opts.BatchRows = n
+	}
+
+	if v := input.Get("batch-bytes"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil {
+			return errors.New("Batch bytes must be integer")
+		}
+		opts.BatchBytes = n
+	}
+
+	if err := checkFormat(&opts); err != nil {
+		return err
+	}
+
+	params.Format = opts.Format
+	params.BatchRows = opts.BatchRows
+	params.BatchBytes = opts.BatchBytes
+
+	return nil
 }
 
 func getFetchParams_ws(r *http.Request) (*QueryParams, error) {
@@ -327,6 +1237,62 @@ func getFetchParams_ws(r *http.Request) (*QueryParams, error) {
 		params.Export = true
 	}
 
+	//whether to send column metadata and typed values
+	_, params.Typed = input["typed"]
+
+	//how NULL is written to exported files. May be empty
+	params.NullToken = DEFAULT_NULL_TOKEN
+	null, present := input["null"]
+	if present && len(null) != 0 {
+		params.NullToken = null[0]
+	}
+
+	//csv and tsv dialect
+	params.Delimiter = input.Get("delimiter")
+	_, params.QuoteAll = input["quote-all"]
+	params.LineEnding = input.Get("line-ending")
+	_, params.Bom = input["bom"]
+	_, params.NoHeader = input["no-header"]
+	params.DateFormat = input.Get("date-format")
+	params.DateTimeFormat = input.Get("datetime-format")
+
+	if err := getFormatParams(input, &params); err != nil {
+		return nil, err
+	}
+
+	//json, msgpack or cbor. Checked when the fetch starts
+	params.Encoding = input.Get("encoding")
+
+	//format of the export file and the table for sql exports
+	params.ExportFormat = input.Get("export-format")
+	params.Table = input.Get("table")
+
+	//where the file goes. Checked against the allowed directories
+	params.ExportDir = input.Get("export-dir")
+	params.FileName = input.Get("file-name")
+	params.OnCollision = input.Get("on-collision")
+	_, params.Mkdir = input["mkdir"]
+
+	//gzip or zip, and when to start a new part
+	params.Compress = input.Get("compress")
+
+	if v := input.Get("split-rows"); v != "" {
+		params.SplitRows, err = strconv.Atoi(v)
+		if err != nil {
+			return nil, errors.New("Split rows must be integer")
+		}
+	}
+
+	if v := input.Get("split-bytes"); v != "" {
+		params.SplitBytes, err = strconv.Atoi(v)
+		if err != nil {
+			return nil, errors.New("Split bytes must be integer")
+		}
+	}
+
+	//export to a temporary file served on /download
+	_, params.Download = input["download"]
+
 	return &params, nil
 }
 
@@ -348,7 +1314,24 @@ func getCancelParams(r *http.Request) (string, string, error) {
 	return sid[0], cid[0], nil
 }
 
-func getQueryParams(r *http.Request) (string, string, error) {
+func getSetDbParams(r *http.Request) (string, string, error) {
+	if r.Method == http.MethodPost {
+		var sr SetDbRequest
+		if err := decodeBody(r, &sr); err != nil {
+			return "", "", err
+		}
+
+		if sr.SessionId == "" {
+			return "", "", errors.New("Session ID not provided")
+		}
+
+		if sr.Db == "" {
+			return "", "", errors.New("Database not provided")
+		}
+
+		return sr.SessionId, sr.Db, nil
+	}
+
 	params := r.URL.Query()
 
 	sid, present := params["session-id"]
@@ -357,39 +1340,147 @@ func getQueryParams(r *http.Request) (string, string, error) {
 		return "", "", e
 	}
 
-	query, present := params["query"]
-	if !present || len(query) == 0 {
-		e := errors.New("Query not provided")
+	db, present := params["db"]
+	if !present || len(db) == 0 || db[0] == "" {
+		e := errors.New("Database not provided")
 		return "", "", e
 	}
 
-	q, err := url.QueryUnescape(query[0])
-	if err != nil {
-		return "", "", err
+	return sid[0], db[0], nil
+}
+
+func getTxParams(r *http.Request, needName bool) (string, string, error) {
+	var tr TxRequest
+
+	if r.Method == http.MethodPost {
+		if err := decodeBody(r, &tr); err != nil {
+			return "", "", err
+		}
+	} else {
+		params := r.URL.Query()
+		tr.SessionId = params.Get("session-id")
+		tr.Name = params.Get("name")
+	}
+
+	if tr.SessionId == "" {
+		return "", "", errors.New("Session ID not provided")
+	}
+
+	if needName && tr.Name == "" {
+		return "", "", errors.New("Savepoint name not provided")
 	}
 
-	return sid[0], q, nil
+	return tr.SessionId, tr.Name, nil
 }
 
-func getExecuteParams(r *http.Request) (string, string, error) {
+func getQueryParams(r *http.Request) (*QueryParams, error) {
+	if r.Method == http.MethodPost {
+		var qr QueryRequest
+		if err := decodeBody(r, &qr); err != nil {
+			return nil, err
+		}
+		return qr.params()
+	}
+
 	params := r.URL.Query()
 
 	sid, present := params["session-id"]
 	if !present || len(sid) == 0 {
 		e := errors.New("Session ID not provided")
-		return "", "", e
+		return nil, e
 	}
 
 	query, present := params["query"]
 	if !present || len(query) == 0 {
 		e := errors.New("Query not provided")
-		return "", "", e
+		return nil, e
 	}
 
 	q, err := url.QueryUnescape(query[0])
 	if err != nil {
-		return "", "", err
+		return nil, err
+	}
+
+	return &QueryParams{
+		SessionId: sid[0],
+		Query:     q,
+	}, nil
+}
+
+//execute takes the same parameters as query
+func getExecuteParams(r *http.Request) (*QueryParams, error) {
+	return getQueryParams(r)
+}
+
+func download(w http.ResponseWriter, r *http.Request) {
+	defer utils.TimeTrack(r.Context(), time.Now())
+
+	token := r.URL.Query().Get("token")
+	if token == "" {
+		utils.SendError(r.Context(), w, errors.New("Token not provided"), ERR_INVALID_USER_INPUT)
+		return
+	}
+
+	d, err := downloadStore.get(token)
+	if err != nil {
+		utils.SendError(r.Context(), w, err, err.Error())
+		return
+	}
+
+	f, err := os.Open(d.path)
+	if err != nil {
+		utils.SendError(r.Context(), w, errors.New(ERR_INVALID_DOWNLOAD_TOKEN), ERR_INVALID_DOWNLOAD_TOKEN)
+		return
+	}
+	defer f.Close()
+
+	fi, err := f.Stat()
+	if err != nil {
+		utils.SendError(r.Context(), w, err, ERR_UNRECOVERABLE)
+		return
+	}
+
+	w.Header().Set("Content-Type", d.contentType)
+	w.Header().Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{
+		"filename": d.name,
+	}))
+	w.Header().Set("Vary", "Accept-Encoding")
+
+	//ranges are served as is, compressing them would change the offsets.
+	//Compressed exports gain nothing from another round
+	if r.Header.Get("Range") == "" && r.Method == http.MethodGet && acceptsGzip(r) && !d.compressed() {
+		w.Header().Set("Content-Encoding", "gzip")
+
+		gz := gzip.NewWriter(w)
+		if _, err := io.Copy(gz, f); err != nil {
+			utils.Dbg(r.Context(), fmt.Sprintf("download %s: %s", d.name, err.Error()))
+		}
+		gz.Close()
+		return
+	}
+
+	//takes care of Range, If-Range, HEAD and Last-Modified
+	http.ServeContent(w, r, d.name, fi.ModTime(), f)
+}
+
+func acceptsGzip(r *http.Request) bool {
+	for _, enc := range strings.Split(r.Header.Get("Accept-Encoding"), ",") {
+		parts := strings.Split(enc, ";")
+		if strings.TrimSpace(parts[0]) != "gzip" {
+			continue
+		}
+
+		//gzip;q=0 means not gzip
+		for _, p := range parts[1:] {
+			if q := strings.TrimSpace(p); strings.HasPrefix(q, "q=") {
+				if v, err := strconv.ParseFloat(q[2:], 64); err == nil && v == 0 {
+					return false
+				}
+			}
+		}
+
+		return true
 	}
 
-	return sid[0], q, nil
+	return false
 }
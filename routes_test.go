@@ -0,0 +1,77 @@
+/* Copyright (C) 2021 Pankaj Kargirwar <kargirwar@protonmail.com>
+
+   This file is part of prosql-agent
+
+   prosql-agent is free software: you can redistribute it and/or modify
+   it under the terms of the GNU General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   prosql-agent is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU General Public License for more details.
+
+   You should have received a copy of the GNU General Public License
+   along with prosql-agent.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/go-sql-driver/mysql"
+)
+
+func TestGetLoginParams(t *testing.T) {
+	tests := []struct {
+		name   string
+		method string
+		target string
+		body   string
+		err    string
+	}{
+		{"no password", "GET", "/login?user=u&host=h&port=1", "", ""},
+		{"no user", "GET", "/login?pass=p&host=h&port=1", "", "User not provided"},
+		{"no host", "GET", "/login?user=u&port=1", "", "Host not provided"},
+		{"no port", "GET", "/login?user=u&host=h", "", "Port not provided"},
+		{"read conns unpinned", "GET", "/ping?user=u&host=h&port=1&read-conns=2", "",
+			"Read connections are only available for pinned sessions"},
+		{"no password", "POST", "/login", `{"user": "u", "host": "h", "port": "1"}`, ""},
+		{"read conns unpinned", "POST", "/ping", `{"user": "u", "host": "h", "port": "1", "read-conns": 2}`,
+			"Read connections are only available for pinned sessions"},
+	}
+
+	for _, test := range tests {
+		r := httptest.NewRequest(test.method, test.target, strings.NewReader(test.body))
+		_, err := getLoginParams(r)
+
+		if test.err == "" && err != nil {
+			t.Errorf("%s %s: expected no error got %s\n", test.method, test.name, err)
+		}
+
+		if test.err != "" && (err == nil || err.Error() != test.err) {
+			t.Errorf("%s %s: expected %q got %v\n", test.method, test.name, test.err, err)
+		}
+	}
+
+	//options which go into the dsn
+	r := httptest.NewRequest("POST", "/ping", strings.NewReader(
+		`{"user": "u", "host": "h", "port": "1", "multi-statements": true, "found-rows": true}`))
+	params, err := getLoginParams(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cfg, err := mysql.ParseDSN(params.Dsn)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !cfg.MultiStatements || !cfg.ClientFoundRows {
+		t.Errorf("expected multi statements and found rows in %s\n", params.Dsn)
+	}
+}
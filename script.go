@@ -0,0 +1,256 @@
+/* Copyright (C) 2021 Pankaj Kargirwar <kargirwar@protonmail.com>
+
+   This file is part of prosql-agent
+
+   prosql-agent is free software: you can redistribute it and/or modify
+   it under the terms of the GNU General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   prosql-agent is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU General Public License for more details.
+
+   You should have received a copy of the GNU General Public License
+   along with prosql-agent.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+/* Scripts are split into statements the way the mysql client does it.
+Statements end at the delimiter, ";" unless changed by a DELIMITER line:
+
+DELIMITER $$
+CREATE PROCEDURE p() BEGIN SELECT 1; SELECT 2; END $$
+DELIMITER ;
+
+The delimiter means nothing inside quotes, backticks or comments. Comments
+before a statement are dropped, comments inside it are sent along with it.
+Executable comments, which start with /*!, are statements.
+
+Statements run one after the other, each on its own execute cursor, and
+each is reported as it completes:
+
+{"statement": 1, "line": 1, "query": "...", "cursor-id": "...", "status": "ok", "elapsed": 0.002, "rows-affected": 0, ...}
+{"statement": 2, "line": 4, "query": "...", "status": "error", "error": "...", "db-error": {...}, "elapsed": 0.001}
+
+on-error decides whether the script stops at the first failure, leaving
+the rest skipped, or carries on */
+
+package main
+
+import (
+	"errors"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/kargirwar/prosql-agent/utils"
+)
+
+const SCRIPT_STOP = "stop"
+const SCRIPT_CONTINUE = "continue"
+
+//statement status
+const STATEMENT_OK = "ok"
+const STATEMENT_ERROR = "error"
+
+//statements are reported with this much of their text
+const SCRIPT_PREVIEW_LEN = 200
+
+type scriptStatement struct {
+	query string
+	line  int //where the statement starts, from 1
+}
+
+type StatementStatus struct {
+	Index    int     `json:"statement"`
+	Line     int     `json:"line"`
+	Query    string  `json:"query"`
+	CursorId string  `json:"cursor-id,omitempty"`
+	Status   string  `json:"status"`
+	Elapsed  float64 `json:"elapsed"` //seconds
+	Error    string  `json:"error,omitempty"`
+
+	DbError        *utils.DbError `json:"db-error,omitempty"`
+	*ExecuteResult                //nil unless the statement ran
+}
+
+type ScriptSummary struct {
+	Statements int  `json:"statements"`
+	Succeeded  int  `json:"succeeded"`
+	Failed     int  `json:"failed"`
+	Skipped    int  `json:"skipped"`
+	Stopped    bool `json:"stopped"` //an error ended the script early
+}
+
+func checkOnError(onError string) (string, error) {
+	switch onError {
+	case "":
+		return SCRIPT_STOP, nil
+	case SCRIPT_STOP, SCRIPT_CONTINUE:
+		return onError, nil
+	}
+
+	return "", errors.New(ERR_INVALID_ON_ERROR)
+}
+
+func splitScript(script string) []*scriptStatement {
+	var stmts []*scriptStatement
+
+	delim := ";"
+	line := 1
+	start, startLine := 0, 1
+	empty := true //nothing but whitespace and comments since the last statement
+
+	//the statement begins at i unless it has already begun
+	begin := func(i int) {
+		if empty {
+			start, startLine, empty = i, line, false
+		}
+	}
+
+	emit := func(end int) {
+		if !empty {
+			if q := strings.TrimSpace(script[start:end]); q != "" {
+				stmts = append(stmts, &scriptStatement{query: q, line: startLine})
+			}
+		}
+		empty = true
+	}
+
+	n := len(script)
+	for i := 0; i < n; {
+		c := script[i]
+
+		switch {
+		case c == '\n':
+			line++
+			i++
+
+		case c == ' ' || c == '\t' || c == '\r':
+			i++
+
+		case c == '\'' || c == '"' || c == '`':
+			begin(i)
+			i = skipQuoted(script, i, &line)
+
+		case c == '#' || isDashComment(script[i:]):
+			i = skipLine(script, i)
+
+		//executable comments and optimizer hints belong to the statement,
+		//a delimiter inside them does not end it
+		case strings.HasPrefix(script[i:], "/*!") || strings.HasPrefix(script[i:], "/*+"):
+			begin(i)
+			i = skipBlockComment(script, i, &line)
+
+		case strings.HasPrefix(script[i:], "/*"):
+			i = skipBlockComment(script, i, &line)
+
+		case empty && isDelimiterCommand(script[i:]):
+			end := skipLine(script, i)
+			if fields := strings.Fields(script[i+len("delimiter") : end]); len(fields) > 0 {
+				delim = fields[0]
+			}
+			i = end
+
+		case strings.HasPrefix(script[i:], delim):
+			emit(i)
+			i += len(delim)
+
+		default:
+			begin(i)
+			i++
+		}
+	}
+
+	//the last statement needs no delimiter
+	emit(n)
+
+	return stmts
+}
+
+//index just past the closing quote. Backslash escapes and doubled quotes
+//don't close it. Backticks know no escapes
+func skipQuoted(s string, i int, line *int) int {
+	q := s[i]
+	for j := i + 1; j < len(s); j++ {
+		switch {
+		case s[j] == '\n':
+			*line++
+
+		case s[j] == '\\' && q != '`':
+			if j+1 < len(s) && s[j+1] == '\n' {
+				*line++
+			}
+			j++
+
+		case s[j] == q:
+			if j+1 < len(s) && s[j+1] == q {
+				j++
+				continue
+			}
+			return j + 1
+		}
+	}
+
+	return len(s)
+}
+
+//index of the end of the line, the newline itself is left alone
+func skipLine(s string, i int) int {
+	if end := strings.IndexByte(s[i:], '\n'); end >= 0 {
+		return i + end
+	}
+
+	return len(s)
+}
+
+func skipBlockComment(s string, i int, line *int) int {
+	end := strings.Index(s[i+2:], "*/")
+	if end < 0 {
+		*line += strings.Count(s[i:], "\n")
+		return len(s)
+	}
+
+	end += i + 4
+	*line += strings.Count(s[i:end], "\n")
+	return end
+}
+
+//-- starts a comment only when followed by whitespace or the end
+func isDashComment(s string) bool {
+	if !strings.HasPrefix(s, "--") {
+		return false
+	}
+
+	return len(s) == 2 || s[2] == ' ' || s[2] == '\t' || s[2] == '\r' || s[2] == '\n'
+}
+
+func isDelimiterCommand(s string) bool {
+	const cmd = "delimiter"
+	if len(s) <= len(cmd) || !strings.EqualFold(s[:len(cmd)], cmd) {
+		return false
+	}
+
+	return s[len(cmd)] == ' ' || s[len(cmd)] == '\t'
+}
+
+//start of a statement for status messages
+func previewQuery(q string) string {
+	if len(q) <= SCRIPT_PREVIEW_LEN {
+		return q
+	}
+
+	//don't cut a character in half
+	end := SCRIPT_PREVIEW_LEN
+	for end > 0 && !utf8.RuneStart(q[end]) {
+		end--
+	}
+
+	return q[:end] + "..."
+}
+
+//result of a statement as reported by fetching its execute cursor
+func executeResult(r *FetchResult) *ExecuteResult {
+	result, _ := r.Rows.(*ExecuteResult)
+	return result
+}
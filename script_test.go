@@ -0,0 +1,78 @@
+/* Copyright (C) 2021 Pankaj Kargirwar <kargirwar@protonmail.com>
+
+   This file is part of prosql-agent
+
+   prosql-agent is free software: you can redistribute it and/or modify
+   it under the terms of the GNU General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   prosql-agent is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU General Public License for more details.
+
+   You should have received a copy of the GNU General Public License
+   along with prosql-agent.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestSplitScript(t *testing.T) {
+	type stmt struct {
+		query string
+		line  int
+	}
+
+	tests := []struct {
+		name   string
+		script string
+		want   []stmt
+	}{
+		{"empty", " \n\t", nil},
+		{"no delimiter at the end", "select 1;\nselect 2", []stmt{{"select 1", 1}, {"select 2", 2}}},
+		{"empty statements", ";;select 1;;", []stmt{{"select 1", 1}}},
+		{"single quotes", "select 'a;b';", []stmt{{"select 'a;b'", 1}}},
+		{"double quotes", `select "a;b"; select 2`, []stmt{{`select "a;b"`, 1}, {"select 2", 1}}},
+		{"backticks", "select 1 as `a;b`;", []stmt{{"select 1 as `a;b`", 1}}},
+		{"doubled quotes", "select 'it''s;';select 2", []stmt{{"select 'it''s;'", 1}, {"select 2", 1}}},
+		{"backslash escape", `select 'a\';b';select 2`, []stmt{{`select 'a\';b'`, 1}, {"select 2", 1}}},
+		{"backslash in backticks", "select 1 as `a\\`;select 2", []stmt{{"select 1 as `a\\`", 1}, {"select 2", 1}}},
+		{"newline in quotes", "select 'a\nb';\nselect 2", []stmt{{"select 'a\nb'", 1}, {"select 2", 3}}},
+		{"hash comment", "# drop; this\nselect 1;", []stmt{{"select 1", 2}}},
+		{"dash comment", "-- drop; this\nselect 1;", []stmt{{"select 1", 2}}},
+		{"dash comment at the end", "select 1; --", []stmt{{"select 1", 1}}},
+		{"dashes without space", "select 1--1;", []stmt{{"select 1--1", 1}}},
+		{"comment inside", "select 1 -- one; two\n, 2;", []stmt{{"select 1 -- one; two\n, 2", 1}}},
+		{"block comment before", "/* a;\nb */ select 1;", []stmt{{"select 1", 2}}},
+		{"block comment inside", "select /* ; */ 1;", []stmt{{"select /* ; */ 1", 1}}},
+		{"unterminated block comment", "select 1; /* ;", []stmt{{"select 1", 1}}},
+		{"executable comment", "/*!40101 SET NAMES utf8 */;\nselect 1;",
+			[]stmt{{"/*!40101 SET NAMES utf8 */", 1}, {"select 1", 2}}},
+		{"delimiter in executable comment", "/*!50003 CREATE TRIGGER t BEFORE INSERT ON x FOR EACH ROW SET @a = 1; */;select 2",
+			[]stmt{{"/*!50003 CREATE TRIGGER t BEFORE INSERT ON x FOR EACH ROW SET @a = 1; */", 1}, {"select 2", 1}}},
+		{"optimizer hint", "select /*+ MAX_EXECUTION_TIME(1); */ 1;", []stmt{{"select /*+ MAX_EXECUTION_TIME(1); */ 1", 1}}},
+		{"delimiter", "DELIMITER $$\ncreate procedure p() begin select 1; select 2; end $$\ndelimiter ;\ncall p();",
+			[]stmt{{"create procedure p() begin select 1; select 2; end", 2}, {"call p()", 4}}},
+		{"delimiter in quotes", "delimiter //\nselect '//';//\nselect 2//",
+			[]stmt{{"select '//';", 2}, {"select 2", 3}}},
+		{"delimiter only at the start", "select 1 delimiter;", []stmt{{"select 1 delimiter", 1}}},
+		{"delimiter without argument", "delimiter\nselect 1;", []stmt{{"delimiter\nselect 1", 1}}},
+	}
+
+	for _, tt := range tests {
+		var got []stmt
+		for _, s := range splitScript(tt.script) {
+			got = append(got, stmt{s.query, s.line})
+		}
+
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: expected %q got %q\n", tt.name, tt.want, got)
+		}
+	}
+}
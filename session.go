@@ -35,8 +35,7 @@ import (
 	"time"
 
 	"github.com/dchest/uniuri"
-	_ "github.com/go-sql-driver/mysql"
-	"github.com/gorilla/websocket"
+	"github.com/go-sql-driver/mysql"
 	"github.com/kargirwar/prosql-agent/utils"
 	log "github.com/sirupsen/logrus"
 )
@@ -46,11 +45,19 @@ import (
 //==============================================================//
 type session struct {
 	id          string
-	pool        *sql.DB
+	pool        *sql.DB //replaced by set-db unless pinned, see getPool
+	dbtype      string
+	dsn         string   //of pool
+	conns       *connSet //nil unless the session is pinned
 	in          chan *Req
 	accessTime  time.Time
 	cursorStore *cursors
 	mutex       sync.Mutex
+	tx          *transaction
+	txMutex     sync.Mutex //serializes begin, commit and rollback
+	db          string     //as of login, the last set-db or USE on a pinned session
+	jobs        *exportJobs
+	foundRows   bool //logged in with found-rows, see execresult.go
 }
 
 func (ps *session) String() string {
@@ -58,11 +65,126 @@ func (ps *session) String() string {
 	defer ps.mutex.Unlock()
 
 	stats := ps.pool.Stats()
-	return fmt.Sprintf("max %d open %d inuse %d idle %d wc %d wd %s maxclosed %d",
-		stats.MaxOpenConnections, stats.OpenConnections, stats.InUse, stats.Idle,
+	return fmt.Sprintf("pinned %t max %d open %d inuse %d idle %d wc %d wd %s maxclosed %d",
+		ps.conns != nil, stats.MaxOpenConnections, stats.OpenConnections, stats.InUse, stats.Idle,
 		stats.WaitCount, stats.WaitDuration, stats.MaxIdleClosed)
 }
 
+func (ps *session) getPool() *sql.DB {
+	ps.mutex.Lock()
+	defer ps.mutex.Unlock()
+	return ps.pool
+}
+
+func (ps *session) getDsn() string {
+	ps.mutex.Lock()
+	defer ps.mutex.Unlock()
+	return ps.dsn
+}
+
+//returns the pool replaced
+func (ps *session) setPool(pool *sql.DB, dsn string) *sql.DB {
+	ps.mutex.Lock()
+	defer ps.mutex.Unlock()
+
+	old := ps.pool
+	ps.pool = pool
+	ps.dsn = dsn
+	return old
+}
+
+func (ps *session) getDb() string {
+	ps.mutex.Lock()
+	defer ps.mutex.Unlock()
+	return ps.db
+}
+
+func (ps *session) setDb(db string) {
+	ps.mutex.Lock()
+	defer ps.mutex.Unlock()
+	ps.db = db
+}
+
+func (ps *session) getTx() *transaction {
+	ps.mutex.Lock()
+	defer ps.mutex.Unlock()
+	return ps.tx
+}
+
+func (ps *session) setTx(t *transaction) {
+	ps.mutex.Lock()
+	defer ps.mutex.Unlock()
+	ps.tx = t
+}
+
+func (ps *session) isPinned() bool {
+	return ps.conns != nil
+}
+
+//get something to run cursor c on. The returned function must be called
+//once the cursor is done with it. This is the transaction if one was open
+//when the cursor was created, otherwise the pool itself for pooled sessions
+func (ps *session) acquire(ctx context.Context, c *cursor) (dbConn, func(), error) {
+	if c.conn != nil {
+		return c.conn, func() {}, nil
+	}
+
+	if c.tx != nil {
+		return c.tx.acquire(ctx, c.ctx)
+	}
+
+	if !ps.isPinned() {
+		return ps.getPool(), func() {}, nil
+	}
+
+	//c.mutex is held by the caller, and execute never changes, so read it directly
+	conn, release, err := ps.conns.acquire(ctx, c.ctx, !c.execute && isReadOnly(c.query))
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return conn, release, nil
+}
+
+//err is what the statement of cursor c returned on db. Must be called
+//before db is given back, see connSet.check
+func (ps *session) checkConn(ctx context.Context, c *cursor, db dbConn, err error) error {
+	conn, ok := db.(*sql.Conn)
+	if err == nil || c.tx != nil || !ps.isPinned() || !ok {
+		return err
+	}
+
+	return ps.conns.check(ctx, conn, err)
+}
+
+//note what the statement of cursor c did to the session. Only statements
+//on the primary of a pinned session matter, a transaction runs on it too
+func (ps *session) track(c *cursor, db dbConn) {
+	if !ps.isPinned() {
+		return
+	}
+
+	if conn, ok := db.(*sql.Conn); ok && !ps.conns.isPrimary(conn) {
+		return
+	}
+
+	if name, ok := usedDb(c.query); ok {
+		ps.conns.setDb(name)
+		ps.setDb(name)
+		return
+	}
+
+	if keepsPrivateState(c.query) {
+		ps.conns.setPrivate()
+	}
+}
+
+func (ps *session) closeConns() {
+	if ps.isPinned() {
+		ps.conns.close()
+	}
+}
+
 func (ps *session) getAccessTime() time.Time {
 	ps.mutex.Lock()
 	defer ps.mutex.Unlock()
@@ -128,24 +250,135 @@ func (ps *sessions) clear(k string) {
 //          session structs and methods end
 //==============================================================//
 
+//request to the session handler, passed on to a cursor for fetches. Which
+//of the arguments is set depends on code
 type Req struct {
 	ctx     context.Context
 	code    string
-	data    interface{}
+	query   string    //CMD_QUERY, CMD_EXECUTE
+	conn    *sql.Conn //CMD_EXECUTE, runs there instead of on the session's connections
+	db      string    //CMD_SET_DB
+	name    string    //savepoint of CMD_TX_SAVEPOINT, CMD_TX_ROLLBACK_TO, CMD_TX_RELEASE
+	cid     string    //CMD_CANCEL
+	fetch   FetchReq  //CMD_FETCH, CMD_FETCH_WS
 	resChan chan *Res
 }
 
+//err is set if code is ERROR. Otherwise the result of the command, if it
+//has one
 type Res struct {
-	ctx  context.Context
-	code string
-	data interface{}
+	code   string
+	err    error
+	cid    string       //CMD_QUERY, CMD_EXECUTE
+	db     string       //CMD_SET_DB
+	fetch  *FetchResult //CMD_FETCH
+	status *TxStatus    //CMD_TX_STATUS
+}
+
+func errorRes(err error) *Res {
+	return &Res{
+		code: ERROR,
+		err:  err,
+	}
+}
+
+//the outcome of a request. A response which is neither a success nor an
+//error, or an error without one, means something is broken. Report it
+//rather than take it for a success
+func (res *Res) error() error {
+	if res == nil {
+		return errors.New(ERR_UNEXPECTED_RESPONSE)
+	}
+
+	switch res.code {
+	case SUCCESS, EOF, CLEANUP_DONE:
+		return nil
+
+	case ERROR:
+		if res.err != nil {
+			return res.err
+		}
+	}
+
+	return errors.New(ERR_UNEXPECTED_RESPONSE)
+}
+
+//send req to the session handler and wait for its response
+func (ps *session) request(req *Req) (*Res, error) {
+	req.resChan = make(chan *Res)
+	ps.in <- req
+
+	res := <-req.resChan
+	return res, res.error()
+}
+
+//where fetch_ws streams its messages. A *websocket.Conn or a writer
+//which multiplexes several cursors on one connection
+type wsWriter interface {
+	WriteMessage(messageType int, data []byte) error
+}
+
+//how rows are delivered by fetch and fetch_ws
+type FetchOptions struct {
+	Export bool //write rows to a file instead of sending them
+	Typed  bool //send column metadata and typed values
+
+	//how NULL is written to exported files. Sent rows always use null
+	NullToken string
+
+	//dialect of csv and tsv exports, see csvdialect.go
+	Delimiter      string
+	QuoteAll       bool
+	LineEnding     string
+	Bom            bool
+	NoHeader       bool
+	DateFormat     string
+	DateTimeFormat string
+
+	//FORMAT_PAIRS or FORMAT_COMPACT. Batch limits apply to compact only
+	Format     string
+	BatchRows  int
+	BatchBytes int
+
+	//ENCODING_JSON if not given, fetch_ws only
+	Encoding string
+
+	//EXPORT_CSV if not given. Table is the target of EXPORT_SQL
+	ExportFormat string
+	Table        string
+
+	//where the export file goes, see exportfile.go. Defaults come from
+	//the agent's configuration
+	ExportDir   string
+	FileName    string
+	OnCollision string
+	Mkdir       bool
+
+	//COMPRESS_GZIP, COMPRESS_ZIP or none. Split limits start a new part
+	//file, see exportpart.go
+	Compress   string
+	SplitRows  int
+	SplitBytes int
+
+	//export to a temporary file served on /download
+	Download bool
+}
+
+//rows of one fetch
+type FetchResult struct {
+	Rows      interface{} //*[][]interface{}, *TypedRows, *CompactRows or *ExecuteResult
+	Eof       bool
+	ResultSet int  //index of the result set the rows belong to
+	SetEnd    bool //the rows end their result set and another one follows
 }
 
 type FetchReq struct {
-	cid    string
-	n      int
-	ws     *websocket.Conn
-	export bool
+	FetchOptions
+	cid string
+	n   int
+	ws  wsWriter
+	db  string     //current database, for export file names
+	job *exportJob //set for exports
 }
 
 //==============================================================//
@@ -159,17 +392,20 @@ func init() {
 	sessionStore = &sessions{
 		store: store,
 	}
-	ticker = time.NewTicker(SESSION_CLEANUP_INTERVAL)
+	ticker = time.NewTicker(getConfig().Timeouts.SessionIdle.Duration)
 	go cleanupSessions()
 }
 
-//for all sessions whose accesstime is older than SESSION_CLEANUP_INTERVAL,
+//for all sessions whose accesstime is older than timeouts.session-idle,
 //clean up active cursors if any and then delete the session itself
 func cleanupSessions() {
 	for {
 		select {
 		case <-ticker.C:
 			log.Debug("Starting session cleanup")
+			idle := getConfig().Timeouts.SessionIdle.Duration
+			ticker.Reset(idle)
+
 			keys := sessionStore.getKeys()
 			for _, k := range keys {
 				log.WithFields(log.Fields{
@@ -184,21 +420,23 @@ func cleanupSessions() {
 					continue
 				}
 
+				s.jobs.expire()
+
 				now := time.Now()
-				if now.Sub(s.getAccessTime()) > SESSION_CLEANUP_INTERVAL {
+				if now.Sub(s.getAccessTime()) > idle && s.jobs.running() {
+					//nobody needs to poll an export job, it keeps the session
+					//alive until idle after it ends
+					s.setAccessTime()
+					continue
+				}
+
+				if now.Sub(s.getAccessTime()) > idle {
 
 					log.WithFields(log.Fields{
 						"session-id": k,
 					}).Debug("Cleaning up session")
 
-					ch := make(chan *Res)
-					s.in <- &Req{
-						code:    CMD_CLEANUP,
-						resChan: ch,
-					}
-
-					res := <-ch
-					if res.code == ERROR {
+					if err := closeSession(context.Background(), s); err != nil {
 						//TODO: What are we going to do here?
 						log.WithFields(log.Fields{
 							"session-id": k,
@@ -210,11 +448,6 @@ func cleanupSessions() {
 					log.WithFields(log.Fields{
 						"session-id": k,
 					}).Debug("Cleanup done")
-
-					sessionStore.clear(k)
-					log.WithFields(log.Fields{
-						"session-id": k,
-					}).Debug("Clear done")
 				}
 			}
 
@@ -223,6 +456,21 @@ func cleanupSessions() {
 	}
 }
 
+//ask the session handler to clean up and remove the session from the store
+func closeSession(ctx context.Context, s *session) error {
+	_, err := s.request(&Req{
+		ctx:  ctx,
+		code: CMD_CLEANUP,
+	})
+
+	if err != nil {
+		return err
+	}
+
+	sessionStore.clear(s.id)
+	return nil
+}
+
 //==============================================================//
 //         External Interface
 //==============================================================//
@@ -241,6 +489,28 @@ func NewSession(ctx context.Context, dbtype string, dsn string) (string, error)
 	return s.id, nil
 }
 
+//same as NewSession but all cursors of the session run on one reserved
+//connection, with readConns additional connections for parallel reads
+func NewPinnedSession(ctx context.Context, dbtype string, dsn string, readConns int) (string, error) {
+	defer utils.TimeTrack(ctx, time.Now())
+
+	s, err := createSession(ctx, dbtype, dsn)
+	if err != nil {
+		return "", err
+	}
+
+	s.conns, err = newConnSet(ctx, s.pool, readConns, s.db)
+	if err != nil {
+		s.pool.Close()
+		return "", err
+	}
+
+	sessionStore.set(s.id, s)
+
+	go sessionHandler(ctx, s)
+	return s.id, nil
+}
+
 //execute a query and create a cursor for the results
 //results must be retrieved by calling fetch later with the cursor id
 func Query(ctx context.Context, sid string, query string) (string, error) {
@@ -254,91 +524,288 @@ func Query(ctx context.Context, sid string, query string) (string, error) {
 	utils.Dbg(ctx, fmt.Sprintf("%s", s))
 
 	//we ask the session handler to create a new cursor and return its id
-	ch := make(chan *Res)
-	s.in <- &Req{
-		ctx:     ctx,
-		code:    CMD_QUERY,
-		data:    query,
-		resChan: ch,
-	}
-
 	utils.Dbg(ctx, fmt.Sprintf("%s Send CMD_QUERY for %s", s.id, query))
 
-	res := <-ch
-	if res.code == ERROR {
-		return "", res.data.(error)
+	res, err := s.request(&Req{
+		ctx:   ctx,
+		code:  CMD_QUERY,
+		query: query,
+	})
+
+	if err != nil {
+		return "", err
 	}
 
 	utils.Dbg(ctx, fmt.Sprintf("%s Received Response for %s", s.id, query))
-	return res.data.(string), nil
+	return cursorId(res)
 }
 
 //fetch n rows from session sid using cursor cid. The cursor will directly
 //send data on websocket channel ws
-func Fetch_ws(ctx context.Context, sid string, cid string, ws *websocket.Conn, n int, export bool) error {
+func Fetch_ws(ctx context.Context, sid string, cid string, ws wsWriter, n int, opts FetchOptions) error {
 	defer utils.TimeTrack(ctx, time.Now())
 
+	if err := checkFetchOptions(&opts); err != nil {
+		return err
+	}
+
 	s, err := sessionStore.get(sid)
 	if err != nil {
 		return err
 	}
 
-	ch := make(chan *Res)
-	s.in <- &Req{
+	//exports run as jobs, ws only follows the progress
+	if opts.Export {
+		j := newExportJob(cid, opts)
+		s.jobs.add(j)
+
+		j.attach(ws)
+		defer j.detach(ws)
+
+		j.start(s, n, opts)
+		<-j.done
+
+		return j.error()
+	}
+
+	_, err = s.request(&Req{
 		ctx:  ctx,
 		code: CMD_FETCH_WS,
-		data: FetchReq{
-			cid:    cid,
-			n:      n,
-			ws:     ws,
-			export: export,
+		fetch: FetchReq{
+			FetchOptions: opts,
+			cid:          cid,
+			n:            n,
+			ws:           ws,
 		},
-		resChan: ch,
+	})
+
+	utils.Dbg(ctx, fmt.Sprintf("FETCH s: %s c: %s err %v\n", s.id, cid, err))
+	return err
+}
+
+//start exporting n rows of cursor cid in the background and return the
+//job id. Progress can be followed with AttachExport
+func StartExport(ctx context.Context, sid string, cid string, n int, opts FetchOptions) (string, error) {
+	defer utils.TimeTrack(ctx, time.Now())
+
+	opts.Export = true
+	if err := checkFetchOptions(&opts); err != nil {
+		return "", err
+	}
+
+	s, err := sessionStore.get(sid)
+	if err != nil {
+		return "", err
+	}
+
+	j := newExportJob(cid, opts)
+	s.jobs.add(j)
+	j.start(s, n, opts)
+
+	utils.Dbg(ctx, fmt.Sprintf("EXPORT s: %s c: %s started job %s\n", s.id, cid, j.id))
+	return j.id, nil
+}
+
+//running jobs and jobs finished in the last timeouts.export-job-retention
+func ExportJobs(ctx context.Context, sid string) ([]*ExportJobStatus, error) {
+	defer utils.TimeTrack(ctx, time.Now())
+
+	s, err := sessionStore.get(sid)
+	if err != nil {
+		return nil, err
 	}
 
-	res := <-ch
-	utils.Dbg(ctx, fmt.Sprintf("FETCH s: %s c: %s code %s\n", s.id, cid, res.code))
+	return s.jobs.list(), nil
+}
 
-	if res.code == ERROR {
-		return res.data.(error)
+//stop a running job, its partial file is removed
+func CancelExport(ctx context.Context, sid string, jid string) error {
+	defer utils.TimeTrack(ctx, time.Now())
+
+	s, err := sessionStore.get(sid)
+	if err != nil {
+		return err
 	}
 
-	return nil
+	j, err := s.jobs.get(jid)
+	if err != nil {
+		return err
+	}
+
+	return j.stop()
 }
 
-//fetch n rows from session sid using cursor cid
-func Fetch(ctx context.Context, sid string, cid string, n int) (*[][]string, bool, error) {
+//send the job's progress to ws from now on. The caller waits on the job's
+//done channel and detaches when it is no longer interested
+func AttachExport(ctx context.Context, sid string, jid string, ws wsWriter) (*exportJob, error) {
 	defer utils.TimeTrack(ctx, time.Now())
 
 	s, err := sessionStore.get(sid)
+	if err != nil {
+		return nil, err
+	}
+
+	j, err := s.jobs.get(jid)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := j.attach(ws); err != nil {
+		return nil, err
+	}
+
+	return j, nil
+}
+
+//run the statements of script one by one, see script.go. progress gets the
+//outcome of each statement as soon as it is known. An error from progress,
+//or the end of ctx, stops the script
+func RunScript(ctx context.Context, sid string, script string, onError string,
+	progress func(*StatementStatus) error) (*ScriptSummary, error) {
+
+	defer utils.TimeTrack(ctx, time.Now())
+
+	onError, err := checkOnError(onError)
+	if err != nil {
+		return nil, err
+	}
+
+	s, err := sessionStore.get(sid)
+	if err != nil {
+		return nil, err
+	}
+
+	//a pooled session would spread the statements over its connections,
+	//and what one of them sets up (USE, SET, temporary tables ...) would
+	//be missing for the next. The script gets a connection of its own,
+	//which is not given back to the pool with that state
+	var conn *sql.Conn
+	if !s.isPinned() && s.getTx() == nil {
+		conn, err = s.getPool().Conn(ctx)
+		if err != nil {
+			return nil, err
+		}
+		defer discardConn(conn)
+	}
+
+	stmts := splitScript(script)
+	summary := &ScriptSummary{Statements: len(stmts)}
+
+	for i, stmt := range stmts {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+
+		if summary.Stopped {
+			summary.Skipped++
+			continue
+		}
+
+		st := &StatementStatus{
+			Index: i + 1,
+			Line:  stmt.line,
+			Query: previewQuery(stmt.query),
+		}
+
+		start := time.Now()
+		st.CursorId, err = executeOn(ctx, s, stmt.query, conn)
+
+		var r *FetchResult
+		if err == nil {
+			r, err = FetchSet(ctx, sid, st.CursorId, 1, FetchOptions{})
+		}
+		st.Elapsed = time.Since(start).Seconds()
+
+		if err != nil {
+			utils.Dbg(ctx, fmt.Sprintf("%s: statement %d failed: %s", sid, st.Index, err.Error()))
+			st.Status = STATEMENT_ERROR
+			st.Error = err.Error()
+			st.DbError = utils.DbErrorOf(err)
+			summary.Failed++
+			summary.Stopped = onError == SCRIPT_STOP
+		} else {
+			st.Status = STATEMENT_OK
+			st.ExecuteResult = executeResult(r)
+			summary.Succeeded++
+		}
+
+		if err := progress(st); err != nil {
+			return nil, err
+		}
+	}
+
+	return summary, nil
+}
+
+//fetch n rows from session sid using cursor cid. NULL values are nil
+func Fetch(ctx context.Context, sid string, cid string, n int) (*[][]interface{}, bool, error) {
+	r, err := FetchSet(ctx, sid, cid, n, FetchOptions{})
+	if err != nil {
+		return nil, false, err
+	}
+
+	//nil for execute cursors, whose result is an *ExecuteResult
+	rows, _ := r.Rows.(*[][]interface{})
+	return rows, r.Eof, nil
+}
+
+//same as Fetch but values keep their types and the first batch carries
+//column metadata
+func FetchTyped(ctx context.Context, sid string, cid string, n int) (*TypedRows, bool, error) {
+	r, err := FetchSet(ctx, sid, cid, n, FetchOptions{Typed: true})
 	if err != nil {
 		return nil, false, err
 	}
 
-	ch := make(chan *Res)
-	s.in <- &Req{
+	//nil for execute cursors, whose result is an *ExecuteResult
+	rows, _ := r.Rows.(*TypedRows)
+	return rows, r.Eof, nil
+}
+
+//same as Fetch but rows are value arrays and the first batch carries
+//column names
+func FetchCompact(ctx context.Context, sid string, cid string, n int) (*CompactRows, bool, error) {
+	r, err := FetchSet(ctx, sid, cid, n, FetchOptions{Format: FORMAT_COMPACT})
+	if err != nil {
+		return nil, false, err
+	}
+
+	//nil for execute cursors, whose result is an *ExecuteResult
+	rows, _ := r.Rows.(*CompactRows)
+	return rows, r.Eof, nil
+}
+
+//fetch n rows in the format asked for by opts, along with where they stand
+//among the cursor's result sets. A batch never spans two result sets
+func FetchSet(ctx context.Context, sid string, cid string, n int, opts FetchOptions) (*FetchResult, error) {
+	defer utils.TimeTrack(ctx, time.Now())
+
+	s, err := sessionStore.get(sid)
+	if err != nil {
+		return nil, err
+	}
+
+	res, err := s.request(&Req{
 		ctx:  ctx,
 		code: CMD_FETCH,
-		data: FetchReq{
-			cid: cid,
-			n:   n,
+		fetch: FetchReq{
+			FetchOptions: opts,
+			cid:          cid,
+			n:            n,
 		},
-		resChan: ch,
-	}
+	})
 
-	res := <-ch
-	utils.Dbg(ctx, fmt.Sprintf("FETCH s: %s c: %s code %s\n", s.id, cid, res.code))
+	utils.Dbg(ctx, fmt.Sprintf("FETCH s: %s c: %s err %v\n", s.id, cid, err))
 
-	if res.code == ERROR {
-		return nil, false, res.data.(error)
+	if err != nil {
+		return nil, err
 	}
 
-	var eof bool
-	if res.code == EOF {
-		eof = true
+	if res.fetch == nil {
+		return nil, errors.New(ERR_UNEXPECTED_RESPONSE)
 	}
 
-	return res.data.(*[][]string), eof, nil
+	return res.fetch, nil
 }
 
 func Execute(ctx context.Context, sid string, query string) (string, error) {
@@ -349,22 +816,151 @@ func Execute(ctx context.Context, sid string, query string) (string, error) {
 		return "", err
 	}
 
+	return executeOn(ctx, s, query, nil)
+}
+
+//create an execute cursor, running on conn if that is set
+func executeOn(ctx context.Context, s *session, query string, conn *sql.Conn) (string, error) {
 	utils.Dbg(ctx, fmt.Sprintf("%s", s))
 
 	//we ask the session handler to create a new cursor and return its id
-	ch := make(chan *Res)
-	s.in <- &Req{
-		ctx:     ctx,
-		code:    CMD_EXECUTE,
-		data:    query,
-		resChan: ch,
-	}
-
 	utils.Dbg(ctx, fmt.Sprintf("%s Send CMD_EXECUTE for %s", s.id, query))
 
-	res := <-ch
+	res, err := s.request(&Req{
+		ctx:   ctx,
+		code:  CMD_EXECUTE,
+		query: query,
+		conn:  conn,
+	})
+
+	if err != nil {
+		return "", err
+	}
+
 	utils.Dbg(ctx, fmt.Sprintf("%s Received Response for %s", s.id, query))
-	return res.data.(string), nil
+	return cursorId(res)
+}
+
+//id of the cursor created by CMD_QUERY or CMD_EXECUTE
+func cursorId(res *Res) (string, error) {
+	if res.cid == "" {
+		return "", errors.New(ERR_UNEXPECTED_RESPONSE)
+	}
+
+	return res.cid, nil
+}
+
+//switch the default database of session sid. Returns the database which
+//is active after the switch. Open cursors are closed, except those of
+//running exports. Fails with ERR_TX_OPEN inside a transaction
+func SetDb(ctx context.Context, sid string, db string) (string, error) {
+	defer utils.TimeTrack(ctx, time.Now())
+
+	s, err := sessionStore.get(sid)
+	if err != nil {
+		return "", err
+	}
+
+	utils.Dbg(ctx, fmt.Sprintf("%s Send CMD_SET_DB for %s", s.id, db))
+
+	res, err := s.request(&Req{
+		ctx:  ctx,
+		code: CMD_SET_DB,
+		db:   db,
+	})
+
+	if err != nil {
+		return "", err
+	}
+
+	utils.Dbg(ctx, fmt.Sprintf("%s Received Response for %s", s.id, db))
+
+	//may well be empty, set-db to a database which goes away leaves none
+	return res.db, nil
+}
+
+//start a transaction. Cursors created until commit or rollback run inside it
+func TxBegin(ctx context.Context, sid string) error {
+	_, err := txRequest(ctx, sid, CMD_TX_BEGIN, "")
+	return err
+}
+
+//commit the open transaction. Result sets still open in it are closed
+func TxCommit(ctx context.Context, sid string) error {
+	_, err := txRequest(ctx, sid, CMD_TX_COMMIT, "")
+	return err
+}
+
+//rollback the open transaction. Result sets still open in it are closed
+func TxRollback(ctx context.Context, sid string) error {
+	_, err := txRequest(ctx, sid, CMD_TX_ROLLBACK, "")
+	return err
+}
+
+func TxSavepoint(ctx context.Context, sid string, name string) error {
+	_, err := txRequest(ctx, sid, CMD_TX_SAVEPOINT, name)
+	return err
+}
+
+func TxRollbackTo(ctx context.Context, sid string, name string) error {
+	_, err := txRequest(ctx, sid, CMD_TX_ROLLBACK_TO, name)
+	return err
+}
+
+func TxRelease(ctx context.Context, sid string, name string) error {
+	_, err := txRequest(ctx, sid, CMD_TX_RELEASE, name)
+	return err
+}
+
+func TxGetStatus(ctx context.Context, sid string) (*TxStatus, error) {
+	res, err := txRequest(ctx, sid, CMD_TX_STATUS, "")
+	if err != nil {
+		return nil, err
+	}
+
+	if res.status == nil {
+		return nil, errors.New(ERR_UNEXPECTED_RESPONSE)
+	}
+
+	return res.status, nil
+}
+
+//name is the savepoint for commands which need one
+func txRequest(ctx context.Context, sid string, code string, name string) (*Res, error) {
+	defer utils.TimeTrack(ctx, time.Now())
+
+	s, err := sessionStore.get(sid)
+	if err != nil {
+		return nil, err
+	}
+
+	utils.Dbg(ctx, fmt.Sprintf("%s Send %s", s.id, code))
+
+	res, err := s.request(&Req{
+		ctx:  ctx,
+		code: code,
+		name: name,
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	utils.Dbg(ctx, fmt.Sprintf("%s Received Response for %s", s.id, code))
+	return res, nil
+}
+
+//close all cursors of session sid, rollback its transaction if any and
+//remove the session. The session id can not be used afterwards
+func Cleanup(ctx context.Context, sid string) error {
+	defer utils.TimeTrack(ctx, time.Now())
+
+	s, err := sessionStore.get(sid)
+	if err != nil {
+		return err
+	}
+
+	return closeSession(ctx, s)
 }
 
 //cancel a running query
@@ -393,32 +989,55 @@ func Cancel(ctx context.Context, sid string, cid string) error {
 func createSession(ctx context.Context, dbtype string, dsn string) (*session, error) {
 	defer utils.TimeTrack(ctx, time.Now())
 
-	pool, err := sql.Open(dbtype, dsn)
-
+	cfg, err := mysql.ParseDSN(dsn)
 	if err != nil {
 		return nil, err
 	}
 
-	pool.SetMaxOpenConns(MAX_OPEN_CONNS)
-	pool.SetMaxIdleConns(MAX_IDLE_CONNS)
-
-	ctx1, cancel := context.WithTimeout(ctx, 20*time.Second)
-	defer cancel()
-
-	if err := pool.PingContext(ctx1); err != nil {
+	pool, err := openPool(ctx, dbtype, dsn)
+	if err != nil {
 		return nil, err
 	}
 
 	var s session
 	s.pool = pool
+	s.dbtype = dbtype
+	s.dsn = dsn
 	s.accessTime = time.Now()
 	s.in = make(chan *Req, 100)
 	s.id = uniuri.New()
 	s.cursorStore = NewCursorStore()
+	s.jobs = newExportJobs()
+
+	s.db = cfg.DBName
+	s.foundRows = cfg.ClientFoundRows
 
 	return &s, nil
 }
 
+func openPool(ctx context.Context, dbtype string, dsn string) (*sql.DB, error) {
+	pool, err := sql.Open(dbtype, dsn)
+
+	if err != nil {
+		return nil, err
+	}
+
+	//running sessions keep the limits they were created with
+	limits := getConfig().Pool
+	pool.SetMaxOpenConns(limits.MaxOpenConns)
+	pool.SetMaxIdleConns(limits.MaxIdleConns)
+
+	ctx1, cancel := context.WithTimeout(ctx, 20*time.Second)
+	defer cancel()
+
+	if err := pool.PingContext(ctx1); err != nil {
+		pool.Close()
+		return nil, err
+	}
+
+	return pool, nil
+}
+
 func sessionDumper(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		keys := sessionStore.getKeys()
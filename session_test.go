@@ -1,3 +1,6 @@
+//go:build integration
+// +build integration
+
 /* Copyright (C) 2021 Pankaj Kargirwar <kargirwar@protonmail.com>
 
    This file is part of prosql-agent
@@ -50,11 +53,16 @@ func TestExecute(t *testing.T) {
 
 	//_, err = Execute(sid, "select * from users")
 	//_, err = Execute(ctx, sid, "select sleep (10)")
-	n, err := Execute(ctx, sid, "update users set name = 'PK' where id = 1")
+	cid, err := Execute(ctx, sid, "update users set name = 'PK' where id = 1")
+	if err != nil {
+		t.Fatalf("%s\n", err.Error())
+	}
+
+	rows, _, err := Fetch(ctx, sid, cid, N)
 	if err != nil {
 		t.Errorf("%s\n", err.Error())
 	}
-	t.Logf("%d rows affected", n)
+	t.Log(rows)
 }
 
 func TestFetch(t *testing.T) {
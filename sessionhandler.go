@@ -20,10 +20,14 @@ package main
 
 import (
 	"context"
+	"database/sql"
+	"errors"
 	"fmt"
+	"strings"
+	"sync"
 	"time"
 
-	_ "github.com/go-sql-driver/mysql"
+	"github.com/go-sql-driver/mysql"
 	"github.com/kargirwar/prosql-agent/accesstimer"
 	"github.com/kargirwar/prosql-agent/utils"
 )
@@ -31,9 +35,12 @@ import (
 //goroutine to deal with one session
 func sessionHandler(ctx context.Context, s *session) {
 	utils.Dbg(ctx, fmt.Sprintf("Starting session handler for %s\n", s.id))
-	defer s.pool.Close()
+	defer func() {
+		s.getPool().Close()
+	}()
+	defer s.closeConns()
 
-	ticker := time.NewTicker(CURSOR_CLEANUP_INTERVAL)
+	ticker := time.NewTicker(getConfig().Timeouts.CursorIdle.Duration)
 
 loop:
 	for {
@@ -47,13 +54,15 @@ loop:
 			go handleSessionRequest(ctx, s, req)
 
 		case <-ticker.C:
+			ticker.Reset(getConfig().Timeouts.CursorIdle.Duration)
 			cleanupCursors(ctx, s)
 		}
 	}
 }
 
-//cleanup cursors which have not been accessed for CURSOR_CLEANUP_INTERVAL
+//cleanup cursors which have not been accessed for timeouts.cursor-idle
 func cleanupCursors(ctx context.Context, s *session) {
+	idle := getConfig().Timeouts.CursorIdle.Duration
 	utils.Dbg(ctx, fmt.Sprintf("%s: Starting cleanup", s.id))
 	keys := s.cursorStore.getKeys()
 	for _, k := range keys {
@@ -65,21 +74,32 @@ func cleanupCursors(ctx context.Context, s *session) {
 		}
 
 		now := time.Now()
-		if now.Sub(accesstimer.GetAccessTime(c.id)) > CURSOR_CLEANUP_INTERVAL {
+		if now.Sub(accesstimer.GetAccessTime(c.id)) > idle {
 			utils.Dbg(ctx, fmt.Sprintf("%s: Cleaning up cursor: %s\n", s.id, k))
-			//This will handle both cases: either the cursor is in the middle of a query
-			//or waiting for a command from session handler
-			c.cancel()
-
-			utils.Dbg(ctx, fmt.Sprintf("%s: Cleanup done for cursor: %s\n", s.id, k))
-			s.cursorStore.clear(k)
-			utils.Dbg(ctx, fmt.Sprintf("%s: Clear done for cursor: %s\n", s.id, k))
+			//cancelling a cursor with open rows kills its connection. That
+			//is fine for the pool, but the connection of a pinned session
+			//or a transaction closes its rows first, see discard. Which may
+			//read the rest of them, so not here on the session handler
+			go s.cursorStore.clear(k)
 		}
 	}
 
 	utils.Dbg(ctx, fmt.Sprintf("%s: Done cleanup", s.id))
 }
 
+//cursors would go on reading the database they started on. Those of
+//running exports are left alone, they finish there
+func clearAllCursors(ctx context.Context, s *session) {
+	for _, k := range s.cursorStore.getKeys() {
+		if s.jobs.exporting(k) {
+			continue
+		}
+
+		utils.Dbg(ctx, fmt.Sprintf("%s: Clearing cursor: %s\n", s.id, k))
+		s.cursorStore.clear(k)
+	}
+}
+
 func handleSessionRequest(ctx context.Context, s *session, req *Req) {
 	defer utils.TimeTrack(req.ctx, time.Now())
 
@@ -103,6 +123,26 @@ func handleSessionRequest(ctx context.Context, s *session, req *Req) {
 
 	case CMD_CANCEL:
 		handleCancel(s, req)
+
+	case CMD_TX_BEGIN:
+		handleTxBegin(s, req)
+
+	case CMD_TX_COMMIT:
+		handleTxEnd(s, req, true)
+
+	case CMD_TX_ROLLBACK:
+		handleTxEnd(s, req, false)
+
+	case CMD_TX_SAVEPOINT, CMD_TX_ROLLBACK_TO, CMD_TX_RELEASE:
+		handleSavepoint(s, req)
+
+	case CMD_TX_STATUS:
+		handleTxStatus(s, req)
+
+	default:
+		//the caller waits for a response whatever the command
+		utils.Dbg(req.ctx, fmt.Sprintf("%s: Invalid Command %s\n", s.id, req.code))
+		req.resChan <- errorRes(errors.New(ERR_INVALID_CMD))
 	}
 }
 
@@ -110,6 +150,10 @@ func handleSessionRequest(ctx context.Context, s *session, req *Req) {
 func handleCleanup(ctx context.Context, s *session, req *Req) {
 	utils.Dbg(ctx, fmt.Sprintf("%s: Handling CMD_CLEANUP\n", s.id))
 
+	//before the cursors go, so that jobs end as cancelled and not as
+	//complete exports of whatever was read so far
+	s.jobs.stopAll()
+
 	keys := s.cursorStore.getKeys()
 	for _, k := range keys {
 		c, err := s.cursorStore.get(k)
@@ -128,6 +172,22 @@ func handleCleanup(ctx context.Context, s *session, req *Req) {
 		utils.Dbg(ctx, fmt.Sprintf("%s: Clear done for cursor: %s\n", s.id, k))
 	}
 
+	//an abandoned transaction must not keep its locks. Its cursors are
+	//cancelled above, wait for them to let go of it
+	if t := s.getTx(); t != nil {
+		_, unlock, err := t.acquire(ctx, context.Background())
+		if err == nil {
+			err = t.finish(false)
+			unlock()
+		}
+
+		if err != nil {
+			utils.Dbg(ctx, fmt.Sprintf("%s: Rollback failed: %s\n", s.id, err.Error()))
+		}
+		s.setTx(nil)
+		utils.Dbg(ctx, fmt.Sprintf("%s: Rolled back open transaction\n", s.id))
+	}
+
 	req.resChan <- &Res{
 		code: CLEANUP_DONE,
 	}
@@ -136,44 +196,121 @@ func handleCleanup(ctx context.Context, s *session, req *Req) {
 }
 
 func handleSetDb(s *session, req *Req) {
-	db, _ := req.data.(string)
+	db := req.db
 	utils.Dbg(req.ctx, fmt.Sprintf("%s: Handling CMD_SET_DB for: %s\n", s.id, db))
-	//clear all existing cursors
-	cleanupCursors(req.ctx, s)
 
-	rows, err := s.pool.QueryContext(context.Background(), "use `"+db+"`")
+	//the transaction would stay on the database it started on. Holding
+	//txMutex keeps one from starting while the database changes
+	s.txMutex.Lock()
+	defer s.txMutex.Unlock()
+
+	if s.getTx() != nil {
+		req.resChan <- errorRes(errors.New(ERR_TX_OPEN))
+		return
+	}
+
+	clearAllCursors(req.ctx, s)
+
+	current, err := switchDb(req.ctx, s, db)
 	if err != nil {
-		req.resChan <- &Res{
-			code: ERROR,
-			data: err,
-		}
+		req.resChan <- errorRes(err)
 
 		return
 	}
 
-	rows.Close()
+	s.setDb(current)
 
 	req.resChan <- &Res{
 		code: SUCCESS,
+		db:   current,
 	}
 
 	utils.Dbg(req.ctx, fmt.Sprintf("%s: Done CMD_SET_DB for: %s\n", s.id, db))
 }
 
+//switch database on every connection which belongs to the session and
+//return the database which is active afterwards
+func switchDb(ctx context.Context, s *session, db string) (string, error) {
+	if !s.isPinned() {
+		return switchPoolDb(ctx, s, db)
+	}
+
+	conns, release, err := s.conns.acquireAll(ctx)
+	if err != nil {
+		return "", err
+	}
+	defer release()
+
+	for _, conn := range conns {
+		_, err := conn.ExecContext(ctx, "use "+quoteIdentifier(db))
+		if err != nil {
+			return "", s.conns.check(ctx, conn, err)
+		}
+	}
+
+	var current sql.NullString
+	err = conns[0].QueryRowContext(ctx, "select database()").Scan(&current)
+	if err != nil {
+		return "", err
+	}
+
+	s.conns.setAllDb(current.String)
+	return current.String, nil
+}
+
+//USE would only switch whichever pooled connection it ran on, so a pooled
+//session gets a new pool opened on db instead. Statements still running
+//on the old pool finish there before it is closed
+func switchPoolDb(ctx context.Context, s *session, db string) (string, error) {
+	if err := checkDbName(db); err != nil {
+		return "", err
+	}
+
+	cfg, err := mysql.ParseDSN(s.getDsn())
+	if err != nil {
+		return "", err
+	}
+	cfg.DBName = db
+	dsn := cfg.FormatDSN()
+
+	pool, err := openPool(ctx, s.dbtype, dsn)
+	if err != nil {
+		return "", err
+	}
+
+	var current sql.NullString
+	if err := pool.QueryRowContext(ctx, "select database()").Scan(&current); err != nil {
+		pool.Close()
+		return "", err
+	}
+
+	old := s.setPool(pool, dsn)
+	go old.Close()
+
+	return current.String, nil
+}
+
+//quote a name for use as an identifier. Backticks inside the name are
+//escaped by doubling them
+func quoteIdentifier(name string) string {
+	return "`" + strings.ReplaceAll(name, "`", "``") + "`"
+}
+
 func handleQuery(s *session, req *Req) {
 	defer utils.TimeTrack(req.ctx, time.Now())
 
-	query, _ := req.data.(string)
+	query := req.query
 	utils.Dbg(req.ctx, fmt.Sprintf("%s: Handling CMD_QUERY for: %s\n", s.id, query))
 
 	c := NewQueryCursor(req.ctx, query)
+	c.tx = s.getTx()
 	s.cursorStore.set(c.id, c)
 
 	utils.Dbg(req.ctx, fmt.Sprintf("%s: Done CMD_QUERY for: %s\n", s.id, query))
 
 	req.resChan <- &Res{
 		code: SUCCESS,
-		data: c.id,
+		cid:  c.id,
 	}
 
 	utils.Dbg(req.ctx, fmt.Sprintf("%s: Sent Response CMD_QUERY for: %s\n", s.id, query))
@@ -182,17 +319,19 @@ func handleQuery(s *session, req *Req) {
 func handleExecute(s *session, req *Req) {
 	defer utils.TimeTrack(req.ctx, time.Now())
 
-	query, _ := req.data.(string)
+	query := req.query
 	utils.Dbg(req.ctx, fmt.Sprintf("%s: Handling CMD_EXECUTE for: %s\n", s.id, query))
 
 	c := NewExecuteCursor(req.ctx, query)
+	c.tx = s.getTx()
+	c.conn = req.conn
 	s.cursorStore.set(c.id, c)
 
 	utils.Dbg(req.ctx, fmt.Sprintf("%s: Done CMD_EXECUTE for: %s\n", s.id, query))
 
 	req.resChan <- &Res{
 		code: SUCCESS,
-		data: c.id,
+		cid:  c.id,
 	}
 
 	utils.Dbg(req.ctx, fmt.Sprintf("%s: Sent Response CMD_EXECUTE for: %s\n", s.id, query))
@@ -200,32 +339,39 @@ func handleExecute(s *session, req *Req) {
 
 func handleFetch_ws(s *session, req *Req) {
 	//just pass on to appropriate cursor
-	fetchReq, _ := req.data.(FetchReq)
+	fetchReq := req.fetch
 	c, err := s.cursorStore.get(fetchReq.cid)
 
 	if err != nil {
-		req.resChan <- &Res{
-			code: ERROR,
-			data: err,
-		}
+		req.resChan <- errorRes(err)
 		return
 	}
 
 	accesstimer.Start(c.id)
 	defer accesstimer.Cancel(c.id)
 
-	err = c.start(req.ctx, s.pool)
+	//the query runs on the cursor's context. That of an export job must
+	//stop when the job is cancelled, even before the first row
+	stop := func() {}
+	if fetchReq.job != nil {
+		stop = cancelWith(req.ctx, c)
+	}
+
+	err = c.start(req.ctx, s)
+	stop()
 
 	if err != nil {
-		req.resChan <- &Res{
-			code: ERROR,
-			data: err,
+		if c.ctx.Err() != nil {
+			s.cursorStore.clear(c.id)
 		}
+		req.resChan <- errorRes(err)
 		return
 	}
 
 	utils.Dbg(req.ctx, fmt.Sprintf("%s: Handling CMD_FETCH_WS for: %s\n", s.id, c.id))
 
+	req.fetch.db = s.getDb()
+
 	//send fetch request to cursor
 	c.in <- req
 	res := <-c.out
@@ -238,16 +384,39 @@ func handleFetch_ws(s *session, req *Req) {
 	req.resChan <- res
 }
 
+//cancel cursor c if ctx ends before the returned stop is called
+func cancelWith(ctx context.Context, c *cursor) (stop func()) {
+	var mutex sync.Mutex
+	stopped := false
+	done := make(chan struct{})
+
+	go func() {
+		select {
+		case <-ctx.Done():
+			mutex.Lock()
+			if !stopped {
+				c.cancel()
+			}
+			mutex.Unlock()
+		case <-done:
+		}
+	}()
+
+	return func() {
+		mutex.Lock()
+		stopped = true
+		mutex.Unlock()
+		close(done)
+	}
+}
+
 func handleFetch(s *session, req *Req) {
 	//just pass on to appropriate cursor and wait for results
-	fetchReq, _ := req.data.(FetchReq)
+	fetchReq := req.fetch
 	c, err := s.cursorStore.get(fetchReq.cid)
 
 	if err != nil {
-		req.resChan <- &Res{
-			code: ERROR,
-			data: err,
-		}
+		req.resChan <- errorRes(err)
 		return
 	}
 
@@ -256,31 +425,24 @@ func handleFetch(s *session, req *Req) {
 		accesstimer.Start(c.id)
 		defer accesstimer.Cancel(c.id)
 
-		n, err := c.exec(req.ctx, s.pool)
+		result, err := c.exec(req.ctx, s)
 
 		if err != nil {
-			req.resChan <- &Res{
-				code: ERROR,
-				data: err,
-			}
+			req.resChan <- errorRes(err)
 			s.cursorStore.clear(c.id)
 			return
 		}
 
-		utils.Dbg(req.ctx, fmt.Sprintf("%s: Done CMD_FETCH for: %s\n", c.id))
-
-		var results [][]string
-		r := []string{"rows-affected", fmt.Sprintf("%d", n)}
-		results = append(results, r)
+		utils.Dbg(req.ctx, fmt.Sprintf("%s: Done CMD_FETCH for: %s\n", s.id, c.id))
 
 		req.resChan <- &Res{
-			code: SUCCESS,
-			data: &results,
+			code:  SUCCESS,
+			fetch: &FetchResult{Rows: result},
 		}
 
 		s.cursorStore.clear(c.id)
 
-		utils.Dbg(req.ctx, fmt.Sprintf("%s: Sent Response CMD_FETCH for: %s\n", c.id))
+		utils.Dbg(req.ctx, fmt.Sprintf("%s: Sent Response CMD_FETCH for: %s\n", s.id, c.id))
 		return
 	}
 
@@ -288,13 +450,10 @@ func handleFetch(s *session, req *Req) {
 	accesstimer.Start(c.id)
 	defer accesstimer.Cancel(c.id)
 
-	err = c.start(req.ctx, s.pool)
+	err = c.start(req.ctx, s)
 
 	if err != nil {
-		req.resChan <- &Res{
-			code: ERROR,
-			data: err,
-		}
+		req.resChan <- errorRes(err)
 		return
 	}
 
@@ -313,16 +472,12 @@ func handleFetch(s *session, req *Req) {
 }
 
 func handleCancel(s *session, req *Req) {
-	cid := req.data.(string)
-	c, err := s.cursorStore.get(cid)
-
-	utils.Dbg(req.ctx, fmt.Sprintf("%s: Handling CMD_CANCEL for: %s\n", s.id, c.id))
+	cid := req.cid
+	utils.Dbg(req.ctx, fmt.Sprintf("%s: Handling CMD_CANCEL for: %s\n", s.id, cid))
 
+	c, err := s.cursorStore.get(cid)
 	if err != nil {
-		req.resChan <- &Res{
-			code: ERROR,
-			data: err,
-		}
+		req.resChan <- errorRes(err)
 		return
 	}
 
@@ -334,3 +489,172 @@ func handleCancel(s *session, req *Req) {
 	}
 	utils.Dbg(req.ctx, fmt.Sprintf("%s: Done CMD_CANCEL for: %s\n", s.id, c.id))
 }
+
+func handleTxBegin(s *session, req *Req) {
+	defer utils.TimeTrack(req.ctx, time.Now())
+	utils.Dbg(req.ctx, fmt.Sprintf("%s: Handling CMD_TX_BEGIN\n", s.id))
+
+	s.txMutex.Lock()
+	defer s.txMutex.Unlock()
+
+	if s.getTx() != nil {
+		req.resChan <- errorRes(errors.New(ERR_TX_OPEN))
+		return
+	}
+
+	var tx *sql.Tx
+	var release func()
+	var err error
+
+	//the transaction must not be tied to the request context, it outlives
+	//the request
+	if s.isPinned() {
+		var conn *sql.Conn
+		conn, release, err = s.conns.acquire(req.ctx, context.Background(), false)
+		if err == nil {
+			tx, err = conn.BeginTx(context.Background(), nil)
+			if err != nil {
+				err = s.conns.check(req.ctx, conn, err)
+				release()
+			}
+		}
+	} else {
+		tx, err = s.getPool().BeginTx(context.Background(), nil)
+	}
+
+	if err != nil {
+		req.resChan <- errorRes(err)
+		return
+	}
+
+	s.setTx(newTransaction(tx, release))
+
+	req.resChan <- &Res{
+		code: SUCCESS,
+	}
+
+	utils.Dbg(req.ctx, fmt.Sprintf("%s: Done CMD_TX_BEGIN\n", s.id))
+}
+
+//commit or rollback the open transaction
+func handleTxEnd(s *session, req *Req, commit bool) {
+	defer utils.TimeTrack(req.ctx, time.Now())
+	utils.Dbg(req.ctx, fmt.Sprintf("%s: Handling %s\n", s.id, req.code))
+
+	s.txMutex.Lock()
+	defer s.txMutex.Unlock()
+
+	t := s.getTx()
+	if t == nil {
+		req.resChan <- errorRes(errors.New(ERR_NO_TX))
+		return
+	}
+
+	//result sets which are still open hold the transaction's connection.
+	//Close them, then wait for any statement which is still running
+	clearTxCursors(req.ctx, s, t)
+
+	_, unlock, err := t.acquire(req.ctx, context.Background())
+	if err != nil {
+		req.resChan <- errorRes(err)
+		return
+	}
+
+	err = t.finish(commit)
+	unlock()
+	s.setTx(nil)
+
+	if err != nil {
+		req.resChan <- errorRes(err)
+		return
+	}
+
+	req.resChan <- &Res{
+		code: SUCCESS,
+	}
+
+	utils.Dbg(req.ctx, fmt.Sprintf("%s: Done %s\n", s.id, req.code))
+}
+
+func clearTxCursors(ctx context.Context, s *session, t *transaction) {
+	keys := s.cursorStore.getKeys()
+	for _, k := range keys {
+		c, err := s.cursorStore.get(k)
+		if err != nil || c.tx != t {
+			continue
+		}
+
+		utils.Dbg(ctx, fmt.Sprintf("%s: Closing cursor %s of transaction\n", s.id, k))
+		s.cursorStore.clear(k)
+	}
+}
+
+//handles CMD_TX_SAVEPOINT, CMD_TX_ROLLBACK_TO and CMD_TX_RELEASE
+func handleSavepoint(s *session, req *Req) {
+	defer utils.TimeTrack(req.ctx, time.Now())
+
+	name := req.name
+	utils.Dbg(req.ctx, fmt.Sprintf("%s: Handling %s for: %s\n", s.id, req.code, name))
+
+	t := s.getTx()
+	if t == nil {
+		req.resChan <- errorRes(errors.New(ERR_NO_TX))
+		return
+	}
+
+	if name == "" || (req.code != CMD_TX_SAVEPOINT && !t.hasSavepoint(name)) {
+		req.resChan <- errorRes(errors.New(ERR_INVALID_SAVEPOINT))
+		return
+	}
+
+	tx, unlock, err := t.acquire(req.ctx, context.Background())
+	if err != nil {
+		req.resChan <- errorRes(err)
+		return
+	}
+	defer unlock()
+
+	var stmt string
+	switch req.code {
+	case CMD_TX_SAVEPOINT:
+		stmt = "savepoint "
+	case CMD_TX_ROLLBACK_TO:
+		stmt = "rollback to savepoint "
+	case CMD_TX_RELEASE:
+		stmt = "release savepoint "
+	}
+
+	_, err = tx.ExecContext(req.ctx, stmt+quoteIdentifier(name))
+	if err != nil {
+		req.resChan <- errorRes(err)
+		return
+	}
+
+	switch req.code {
+	case CMD_TX_SAVEPOINT:
+		t.addSavepoint(name)
+	case CMD_TX_ROLLBACK_TO:
+		t.truncateSavepoints(name, true)
+	case CMD_TX_RELEASE:
+		t.truncateSavepoints(name, false)
+	}
+
+	req.resChan <- &Res{
+		code: SUCCESS,
+	}
+
+	utils.Dbg(req.ctx, fmt.Sprintf("%s: Done %s for: %s\n", s.id, req.code, name))
+}
+
+func handleTxStatus(s *session, req *Req) {
+	status := &TxStatus{Savepoints: []string{}}
+
+	if t := s.getTx(); t != nil {
+		status = t.status()
+	}
+
+	req.resChan <- &Res{
+		code:   SUCCESS,
+		status: status,
+	}
+}
@@ -0,0 +1,448 @@
+/* Copyright (C) 2021 Pankaj Kargirwar <kargirwar@protonmail.com>
+
+   This file is part of prosql-agent
+
+   prosql-agent is free software: you can redistribute it and/or modify
+   it under the terms of the GNU General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   prosql-agent is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU General Public License for more details.
+
+   You should have received a copy of the GNU General Public License
+   along with prosql-agent.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+/* One websocket per session carrying every command of the session. Each
+request has an id chosen by the client and everything sent back for that
+request carries the same id. Requests are handled concurrently so rows of
+several cursors may arrive interleaved. Example:
+
+-> {"id": "1", "cmd": "query", "query": "select * from users"}
+<- {"id": "1", "type": "result", "status": "ok", "data": {"cursor-id": "abc"}}
+-> {"id": "2", "cmd": "fetch", "cursor-id": "abc", "num-of-rows": 1000}
+<- {"id": "2", "type": "data", "cursor-id": "abc", "data": {"k": [...]}}
+<- {"id": "2", "type": "result", "status": "ok", "cursor-id": "abc"}
+*/
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/kargirwar/prosql-agent/utils"
+)
+
+//message types sent to the client
+const WS_RESULT = "result"
+const WS_DATA = "data"
+const WS_ERROR = "error"
+
+type WsRequest struct {
+	Id        string `json:"id"`
+	Cmd       string `json:"cmd"`
+	CursorId  string `json:"cursor-id,omitempty"`
+	Query     string `json:"query,omitempty"`
+	Db        string `json:"db,omitempty"`
+	Name      string `json:"name,omitempty"`
+	JobId     string `json:"job-id,omitempty"`
+	Script    string `json:"script,omitempty"`
+	OnError   string `json:"on-error,omitempty"`
+	NumOfRows int    `json:"num-of-rows,omitempty"`
+	Export    bool   `json:"export,omitempty"`
+	Typed     bool   `json:"typed,omitempty"`
+
+	//FORMAT_PAIRS if not given. Batch limits apply to compact only
+	Format     string `json:"format,omitempty"`
+	BatchRows  int    `json:"batch-rows,omitempty"`
+	BatchBytes int    `json:"batch-bytes,omitempty"`
+
+	//NULL in exported files, DEFAULT_NULL_TOKEN if not given
+	Null *string `json:"null,omitempty"`
+
+	//dialect of csv and tsv exports
+	Delimiter      string `json:"delimiter,omitempty"`
+	QuoteAll       bool   `json:"quote-all,omitempty"`
+	LineEnding     string `json:"line-ending,omitempty"`
+	Bom            bool   `json:"bom,omitempty"`
+	NoHeader       bool   `json:"no-header,omitempty"`
+	DateFormat     string `json:"date-format,omitempty"`
+	DateTimeFormat string `json:"datetime-format,omitempty"`
+
+	//EXPORT_CSV if not given. Table is the target of EXPORT_SQL
+	ExportFormat string `json:"export-format,omitempty"`
+	Table        string `json:"table,omitempty"`
+
+	//where the file goes. Checked against the allowed directories
+	ExportDir   string `json:"export-dir,omitempty"`
+	FileName    string `json:"file-name,omitempty"`
+	OnCollision string `json:"on-collision,omitempty"`
+	Mkdir       bool   `json:"mkdir,omitempty"`
+
+	//gzip or zip, and when to start a new part
+	Compress   string `json:"compress,omitempty"`
+	SplitRows  int    `json:"split-rows,omitempty"`
+	SplitBytes int    `json:"split-bytes,omitempty"`
+
+	//export to a temporary file served on /download
+	Download bool `json:"download,omitempty"`
+}
+
+type WsResponse struct {
+	Id        string      `json:"id"`
+	Type      string      `json:"type"`
+	CursorId  string      `json:"cursor-id,omitempty"`
+	Status    string      `json:"status,omitempty"`
+	Msg       string      `json:"msg,omitempty"`
+	ErrorCode string      `json:"error-code,omitempty"`
+	Data      interface{} `json:"data,omitempty"`
+
+	DbError *utils.DbError `json:"db-error,omitempty"`
+}
+
+//websocket connection shared by all requests of a session. gorilla
+//allows only one writer at a time
+type muxConn struct {
+	ws    *websocket.Conn
+	mutex sync.Mutex
+
+	//export jobs followed on this socket, by job id. Attaching to a job
+	//again replaces the earlier attachment
+	attached map[string]*muxWriter
+	jobMutex sync.Mutex
+	closed   chan struct{} //once the socket is gone
+}
+
+//the earlier attachment to job jid, if any
+func (mc *muxConn) attachJob(jid string, mw *muxWriter) *muxWriter {
+	mc.jobMutex.Lock()
+	defer mc.jobMutex.Unlock()
+
+	old := mc.attached[jid]
+	mc.attached[jid] = mw
+	return old
+}
+
+func (mc *muxConn) releaseJob(jid string, mw *muxWriter) {
+	mc.jobMutex.Lock()
+	defer mc.jobMutex.Unlock()
+
+	if mc.attached[jid] == mw {
+		delete(mc.attached, jid)
+	}
+}
+
+func (mc *muxConn) send(res *WsResponse) error {
+	str, err := json.Marshal(res)
+	if err != nil {
+		return err
+	}
+
+	mc.mutex.Lock()
+	defer mc.mutex.Unlock()
+
+	return mc.ws.WriteMessage(websocket.TextMessage, str)
+}
+
+func (mc *muxConn) sendResult(id string, cid string, data interface{}) error {
+	return mc.send(&WsResponse{
+		Id:       id,
+		Type:     WS_RESULT,
+		CursorId: cid,
+		Status:   "ok",
+		Data:     data,
+	})
+}
+
+func (mc *muxConn) sendError(id string, cid string, err error, code string) error {
+	res := utils.ErrorResponse(err, code)
+
+	return mc.send(&WsResponse{
+		Id:        id,
+		Type:      WS_ERROR,
+		CursorId:  cid,
+		Status:    res.Status,
+		Msg:       res.Msg,
+		ErrorCode: res.ErrorCode,
+		DbError:   res.DbError,
+	})
+}
+
+//wsWriter for one fetch request. Wraps every message the cursor streams
+//in an envelope carrying the request id
+type muxWriter struct {
+	mc  *muxConn
+	id  string
+	cid string
+
+	replaced chan struct{} //export attachments only, see attachJob
+}
+
+func (mw *muxWriter) WriteMessage(messageType int, data []byte) error {
+	var payload interface{}
+	if messageType == websocket.TextMessage {
+		payload = json.RawMessage(data)
+	} else {
+		//binary payloads travel base64 encoded inside the JSON envelope
+		payload = data
+	}
+
+	return mw.mc.send(&WsResponse{
+		Id:       mw.id,
+		Type:     WS_DATA,
+		CursorId: mw.cid,
+		Data:     payload,
+	})
+}
+
+func session_ws(w http.ResponseWriter, r *http.Request) {
+	ctx := utils.GetContext(r)
+	defer utils.TimeTrack(ctx, time.Now())
+
+	ws, err := utils.Upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		utils.Dbg(ctx, fmt.Sprintf("%s", err.Error()))
+		return
+	}
+	defer ws.Close()
+
+	sid := r.URL.Query().Get("session-id")
+	if sid == "" {
+		utils.SendError_ws(ctx, ws, errors.New("Session ID not provided"), ERR_INVALID_USER_INPUT)
+		return
+	}
+
+	if _, err := sessionStore.get(sid); err != nil {
+		utils.SendError_ws(ctx, ws, err, ERR_INVALID_SESSION_ID)
+		return
+	}
+
+	mc := &muxConn{
+		ws:       ws,
+		attached: make(map[string]*muxWriter),
+		closed:   make(chan struct{}),
+	}
+	defer close(mc.closed)
+
+	for {
+		_, msg, err := ws.ReadMessage()
+		if err != nil {
+			utils.Dbg(ctx, fmt.Sprintf("%s: session_ws closed: %s", sid, err.Error()))
+			return
+		}
+
+		req, err := decodeWsRequest(msg)
+		if err != nil {
+			mc.sendError(req.Id, req.CursorId, err, ERR_INVALID_USER_INPUT)
+			continue
+		}
+
+		reqCtx := utils.WithRequestId(ctx, sid+":"+req.Id)
+
+		//once the session is gone there is nothing more to do on this socket
+		if req.Cmd == CMD_CLEANUP {
+			if err := Cleanup(reqCtx, sid); err != nil {
+				mc.sendError(req.Id, "", err, ERR_INVALID_SESSION_ID)
+				continue
+			}
+
+			mc.sendResult(req.Id, "", nil)
+			return
+		}
+
+		go handleWsRequest(reqCtx, mc, sid, req)
+	}
+}
+
+func decodeWsRequest(msg []byte) (*WsRequest, error) {
+	var req WsRequest
+
+	dec := json.NewDecoder(bytes.NewReader(msg))
+	dec.DisallowUnknownFields()
+
+	if err := dec.Decode(&req); err != nil {
+		return &req, errors.New("Invalid request: " + err.Error())
+	}
+
+	if req.Id == "" {
+		return &req, errors.New("Request ID not provided")
+	}
+
+	if req.Cmd == "" {
+		return &req, errors.New("Command not provided")
+	}
+
+	return &req, nil
+}
+
+func handleWsRequest(ctx context.Context, mc *muxConn, sid string, req *WsRequest) {
+	defer utils.TimeTrack(ctx, time.Now())
+
+	var data interface{}
+	var err error
+	code := ERR_DB_ERROR
+
+	switch req.Cmd {
+	case CMD_QUERY, CMD_EXECUTE:
+		if req.Query == "" {
+			err, code = errors.New("Query not provided"), ERR_INVALID_USER_INPUT
+			break
+		}
+
+		var cid string
+		if req.Cmd == CMD_QUERY {
+			cid, err = Query(ctx, sid, req.Query)
+		} else {
+			cid, err = Execute(ctx, sid, req.Query)
+		}
+		code = ERR_INVALID_USER_INPUT
+
+		data = struct {
+			CursorId string `json:"cursor-id"`
+		}{cid}
+
+	case CMD_SCRIPT:
+		//every statement is a data message, the summary is the result
+		data, err = RunScript(ctx, sid, req.Script, req.OnError, func(st *StatementStatus) error {
+			return mc.send(&WsResponse{
+				Id:       req.Id,
+				Type:     WS_DATA,
+				CursorId: st.CursorId,
+				Data:     st,
+			})
+		})
+		code = ERR_INVALID_USER_INPUT
+
+	case CMD_FETCH:
+		if req.CursorId == "" || req.NumOfRows <= 0 {
+			err, code = errors.New("Cursor ID and number of rows must be provided"), ERR_INVALID_USER_INPUT
+			break
+		}
+
+		opts := FetchOptions{
+			Export:     req.Export,
+			Typed:      req.Typed,
+			NullToken:  DEFAULT_NULL_TOKEN,
+			Format:     req.Format,
+			BatchRows:  req.BatchRows,
+			BatchBytes: req.BatchBytes,
+
+			Delimiter:      req.Delimiter,
+			QuoteAll:       req.QuoteAll,
+			LineEnding:     req.LineEnding,
+			Bom:            req.Bom,
+			NoHeader:       req.NoHeader,
+			DateFormat:     req.DateFormat,
+			DateTimeFormat: req.DateTimeFormat,
+
+			ExportFormat: req.ExportFormat,
+			Table:        req.Table,
+			ExportDir:    req.ExportDir,
+			FileName:     req.FileName,
+			OnCollision:  req.OnCollision,
+			Mkdir:        req.Mkdir,
+			Compress:     req.Compress,
+			SplitRows:    req.SplitRows,
+			SplitBytes:   req.SplitBytes,
+			Download:     req.Download,
+		}
+
+		if req.Null != nil {
+			opts.NullToken = *req.Null
+		}
+
+		err = Fetch_ws(ctx, sid, req.CursorId, &muxWriter{mc: mc, id: req.Id, cid: req.CursorId},
+			req.NumOfRows, opts)
+		code = ERR_INVALID_USER_INPUT
+
+	case CMD_CANCEL:
+		err = Cancel(ctx, sid, req.CursorId)
+		code = ERR_INVALID_USER_INPUT
+
+	case CMD_EXPORT_JOBS:
+		data, err = ExportJobs(ctx, sid)
+		code = ERR_INVALID_USER_INPUT
+
+	case CMD_EXPORT_CANCEL:
+		err = CancelExport(ctx, sid, req.JobId)
+		code = ERR_INVALID_USER_INPUT
+
+	case CMD_EXPORT_ATTACH:
+		//progress arrives as data messages, the result once the job ends.
+		//Attaching to the job again ends this request with ERR_JOB_DETACHED
+		var j *exportJob
+		mw := &muxWriter{mc: mc, id: req.Id, replaced: make(chan struct{})}
+		j, err = AttachExport(ctx, sid, req.JobId, mw)
+		code = ERR_INVALID_USER_INPUT
+		if err != nil {
+			break
+		}
+
+		if old := mc.attachJob(j.id, mw); old != nil {
+			j.detach(old)
+			close(old.replaced)
+		}
+
+		gone := false
+		select {
+		case <-j.done:
+			err, code = j.error(), ERR_DB_ERROR
+		case <-mw.replaced:
+			err, code = errors.New(ERR_JOB_DETACHED), ERR_JOB_DETACHED
+		case <-mc.closed:
+			gone = true
+		}
+
+		j.detach(mw)
+		mc.releaseJob(j.id, mw)
+
+		if gone {
+			utils.Dbg(ctx, fmt.Sprintf("%s: socket closed, detached from job %s", sid, j.id))
+			return
+		}
+
+	case CMD_SET_DB:
+		if req.Db == "" {
+			err, code = errors.New("Database not provided"), ERR_INVALID_USER_INPUT
+			break
+		}
+
+		var current string
+		current, err = SetDb(ctx, sid, req.Db)
+		data = struct {
+			Db string `json:"db"`
+		}{current}
+
+	case CMD_TX_BEGIN, CMD_TX_COMMIT, CMD_TX_ROLLBACK,
+		CMD_TX_SAVEPOINT, CMD_TX_ROLLBACK_TO, CMD_TX_RELEASE, CMD_TX_STATUS:
+		var res *Res
+		res, err = txRequest(ctx, sid, req.Cmd, req.Name)
+		if err == nil && res.status != nil {
+			data = res.status
+		}
+
+	default:
+		err, code = errors.New(ERR_INVALID_CMD), ERR_INVALID_CMD
+	}
+
+	if err != nil {
+		utils.Dbg(ctx, fmt.Sprintf("%s: %s failed: %s", sid, req.Cmd, err.Error()))
+		mc.sendError(req.Id, req.CursorId, err, code)
+		return
+	}
+
+	if err := mc.sendResult(req.Id, req.CursorId, data); err != nil {
+		utils.Dbg(ctx, fmt.Sprintf("%s: unable to send result: %s", sid, err.Error()))
+	}
+}
@@ -1,3 +1,6 @@
+//go:build integration
+// +build integration
+
 /* Copyright (C) 2021 Pankaj Kargirwar <kargirwar@protonmail.com>
 
    This file is part of prosql-agent
@@ -19,15 +22,15 @@
 package main
 
 import (
+	"context"
 	"log"
 	"os"
 	"testing"
 )
 
-const N = 1000
-
 func TestSetDb(t *testing.T) {
-	sid, err := NewSession("mysql", os.Getenv("DSN"))
+	ctx := context.Background()
+	sid, err := NewSession(ctx, "mysql", os.Getenv("DSN"))
 	if err != nil {
 		t.Errorf("%s\n", err.Error())
 	}
@@ -37,25 +40,29 @@ func TestSetDb(t *testing.T) {
 	//get some data from first db
 	dbs := []string{"test-generico", "dev3-generico", "pankaj-02-24-generico"}
 	for _, db := range dbs {
-		err := SetDb(sid, db)
+		current, err := SetDb(ctx, sid, db)
 		if err != nil {
 			t.Errorf("%s\n", err.Error())
 		}
 
-		testQuery(t, sid, "show databases")
-		testQuery(t, sid, "show tables")
-		testQuery(t, sid, "select * from users limit 1")
+		if current != db {
+			t.Errorf("expected %s got %s\n", db, current)
+		}
+
+		testQuery(t, ctx, sid, "show databases")
+		testQuery(t, ctx, sid, "show tables")
+		testQuery(t, ctx, sid, "select * from users limit 1")
 	}
 }
 
-func testQuery(t *testing.T, sid, query string) {
-	cid, err := Execute(sid, query)
+func testQuery(t *testing.T, ctx context.Context, sid, query string) {
+	cid, err := Query(ctx, sid, query)
 	if err != nil {
 		t.Errorf("%s\n", err.Error())
 	}
 
 	for {
-		rows, _, err := Fetch(sid, cid, N)
+		rows, _, err := Fetch(ctx, sid, cid, N)
 		if err != nil {
 			t.Errorf("%s\n", err.Error())
 			break
@@ -65,3 +72,55 @@ func testQuery(t *testing.T, sid, query string) {
 		break
 	}
 }
+
+func TestSetDbClosesCursors(t *testing.T) {
+	ctx := context.Background()
+	sid, err := NewSession(ctx, "mysql", os.Getenv("DSN"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cid, err := Query(ctx, sid, "select 1 union all select 2")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, _, err := Fetch(ctx, sid, cid, 1); err != nil {
+		t.Fatal(err)
+	}
+
+	db := queryValue(t, ctx, sid, "select database()")
+	if _, err := SetDb(ctx, sid, db); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, _, err := Fetch(ctx, sid, cid, 1); err == nil || err.Error() != ERR_INVALID_CURSOR_ID {
+		t.Errorf("expected %s got %v\n", ERR_INVALID_CURSOR_ID, err)
+	}
+}
+
+func TestSetDbInTransaction(t *testing.T) {
+	ctx := context.Background()
+	sid, err := NewSession(ctx, "mysql", os.Getenv("DSN"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	db := queryValue(t, ctx, sid, "select database()")
+
+	if err := TxBegin(ctx, sid); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := SetDb(ctx, sid, db); err == nil || err.Error() != ERR_TX_OPEN {
+		t.Errorf("expected %s got %v\n", ERR_TX_OPEN, err)
+	}
+
+	if err := TxCommit(ctx, sid); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := SetDb(ctx, sid, db); err != nil {
+		t.Errorf("expected set-db to work after commit got %s\n", err)
+	}
+}
@@ -0,0 +1,335 @@
+/* Copyright (C) 2021 Pankaj Kargirwar <kargirwar@protonmail.com>
+
+   This file is part of prosql-agent
+
+   prosql-agent is free software: you can redistribute it and/or modify
+   it under the terms of the GNU General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   prosql-agent is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU General Public License for more details.
+
+   You should have received a copy of the GNU General Public License
+   along with prosql-agent.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+/* HTTPS for browsers which won't call an http agent from an https page.
+The agent makes its own CA and uses it to sign a certificate for
+localhost, 127.0.0.1, ::1 and the listen address. Both live in the
+agent's directory:
+
+prosql-ca.pem          CA certificate, to be trusted by the OS or browser
+prosql-ca-key.pem
+prosql-localhost.pem   what the agent serves
+prosql-localhost-key.pem
+
+The CA is name constrained to localhost, the loopback addresses and the
+listen address, so even with its key it can't vouch for anything else. It
+stays, so it has to be trusted only once, unless the listen address moves
+outside of what it allows. The certificate is made again when it is about
+to expire or doesn't cover the listen address */
+
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/kargirwar/prosql-agent/utils"
+	log "github.com/sirupsen/logrus"
+)
+
+const CA_CERT_FILE = "prosql-ca.pem"
+const CA_KEY_FILE = "prosql-ca-key.pem"
+const CERT_FILE = "prosql-localhost.pem"
+const CERT_KEY_FILE = "prosql-localhost-key.pem"
+
+const CA_VALIDITY = 10 * 365 * 24 * time.Hour
+const CERT_VALIDITY = 365 * 24 * time.Hour
+
+//certificates expiring sooner than this are made again
+const CERT_RENEW_BEFORE = 30 * 24 * time.Hour
+
+type localCA struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+}
+
+//paths of the certificate and key to serve for address, made as needed
+func localCert(dir string, address string) (string, string, error) {
+	hosts := certHosts(address)
+	ca, err := loadCA(dir, hosts)
+	if err != nil {
+		return "", "", err
+	}
+
+	certFile := filepath.Join(dir, CERT_FILE)
+	keyFile := filepath.Join(dir, CERT_KEY_FILE)
+
+	if certUsable(certFile, ca, hosts) {
+		return certFile, keyFile, nil
+	}
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return "", "", err
+	}
+
+	serial, err := newSerial()
+	if err != nil {
+		return "", "", err
+	}
+
+	now := time.Now()
+	tmpl := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: "localhost"},
+		NotBefore:    now.Add(-time.Hour),
+		NotAfter:     now.Add(CERT_VALIDITY),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+
+	for _, h := range hosts {
+		if ip := net.ParseIP(h); ip != nil {
+			tmpl.IPAddresses = append(tmpl.IPAddresses, ip)
+		} else {
+			tmpl.DNSNames = append(tmpl.DNSNames, h)
+		}
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, ca.cert, &key.PublicKey, ca.key)
+	if err != nil {
+		return "", "", err
+	}
+
+	if err := writeKeyPair(certFile, keyFile, der, key); err != nil {
+		return "", "", err
+	}
+
+	log.WithFields(log.Fields{
+		"cert":    certFile,
+		"expires": tmpl.NotAfter,
+	}).Info("Created certificate")
+
+	return certFile, keyFile, nil
+}
+
+//names the certificate must cover
+func certHosts(address string) []string {
+	hosts := []string{"localhost", "127.0.0.1", "::1"}
+
+	ip := net.ParseIP(address)
+	if ip != nil && !ip.IsUnspecified() && !ip.IsLoopback() {
+		hosts = append(hosts, ip.String())
+	}
+
+	return hosts
+}
+
+func certUsable(path string, ca *localCA, hosts []string) bool {
+	cert, err := readCert(path)
+	if err != nil {
+		return false
+	}
+
+	if time.Until(cert.NotAfter) < CERT_RENEW_BEFORE || cert.CheckSignatureFrom(ca.cert) != nil {
+		return false
+	}
+
+	for _, h := range hosts {
+		if cert.VerifyHostname(h) != nil {
+			return false
+		}
+	}
+
+	return true
+}
+
+//the agent's CA, made on first use and again when it does not allow all
+//of hosts. CAs of earlier versions had no constraints at all
+func loadCA(dir string, hosts []string) (*localCA, error) {
+	certFile := filepath.Join(dir, CA_CERT_FILE)
+	keyFile := filepath.Join(dir, CA_KEY_FILE)
+
+	cert, err := readCert(certFile)
+	if err == nil && caPermits(cert, hosts) {
+		key, err := readKey(keyFile)
+		if err != nil {
+			return nil, err
+		}
+		return &localCA{cert: cert, key: key}, nil
+	}
+
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	if err == nil {
+		log.WithFields(log.Fields{
+			"cert": certFile,
+		}).Info("Replacing CA which does not limit itself to the listen address, remove it from the trusted certificates")
+	}
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+
+	serial, err := newSerial()
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	tmpl := &x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{CommonName: "prosql-agent local CA", Organization: []string{APP_NAME}},
+		NotBefore:             now.Add(-time.Hour),
+		NotAfter:              now.Add(CA_VALIDITY),
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+		MaxPathLenZero:        true,
+
+		PermittedDNSDomainsCritical: true,
+		PermittedDNSDomains:         []string{"localhost"},
+	}
+
+	for _, h := range hosts {
+		if ip := net.ParseIP(h); ip != nil {
+			tmpl.PermittedIPRanges = append(tmpl.PermittedIPRanges, hostRange(ip))
+		}
+	}
+
+	//the whole loopback network, not only 127.0.0.1
+	tmpl.PermittedIPRanges = append(tmpl.PermittedIPRanges, &net.IPNet{
+		IP:   net.IPv4(127, 0, 0, 0).To4(),
+		Mask: net.CIDRMask(8, 32),
+	})
+
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := writeKeyPair(certFile, keyFile, der, key); err != nil {
+		return nil, err
+	}
+
+	cert, err = x509.ParseCertificate(der)
+	if err != nil {
+		return nil, err
+	}
+
+	log.WithFields(log.Fields{
+		"cert": certFile,
+	}).Info("Created CA, it must be trusted for HTTPS to work")
+
+	return &localCA{cert: cert, key: key}, nil
+}
+
+//whether certificates of ca may name all of hosts
+func caPermits(ca *x509.Certificate, hosts []string) bool {
+	if !ca.PermittedDNSDomainsCritical || len(ca.PermittedDNSDomains) == 0 {
+		return false
+	}
+
+	for _, h := range hosts {
+		if !caPermitsHost(ca, h) {
+			return false
+		}
+	}
+
+	return true
+}
+
+func caPermitsHost(ca *x509.Certificate, host string) bool {
+	if ip := net.ParseIP(host); ip != nil {
+		for _, r := range ca.PermittedIPRanges {
+			if r.Contains(ip) {
+				return true
+			}
+		}
+		return false
+	}
+
+	for _, d := range ca.PermittedDNSDomains {
+		if host == d || strings.HasSuffix(host, "."+d) {
+			return true
+		}
+	}
+
+	return false
+}
+
+//ip and nothing else
+func hostRange(ip net.IP) *net.IPNet {
+	if ip4 := ip.To4(); ip4 != nil {
+		return &net.IPNet{IP: ip4, Mask: net.CIDRMask(32, 32)}
+	}
+
+	return &net.IPNet{IP: ip, Mask: net.CIDRMask(128, 128)}
+}
+
+func readCert(path string) (*x509.Certificate, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	block, _ := pem.Decode(data)
+	if block == nil || block.Type != "CERTIFICATE" {
+		return nil, errors.New(path + ": no certificate")
+	}
+
+	return x509.ParseCertificate(block.Bytes)
+}
+
+func readKey(path string) (*ecdsa.PrivateKey, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	block, _ := pem.Decode(data)
+	if block == nil || block.Type != "EC PRIVATE KEY" {
+		return nil, errors.New(path + ": no key")
+	}
+
+	return x509.ParseECPrivateKey(block.Bytes)
+}
+
+//the key first, a certificate without its key is of no use
+func writeKeyPair(certFile string, keyFile string, der []byte, key *ecdsa.PrivateKey) error {
+	k, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return err
+	}
+
+	keyPem := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: k})
+	if err := utils.WriteFileAtomic(keyFile, keyPem, 0600); err != nil {
+		return err
+	}
+
+	certPem := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	return utils.WriteFileAtomic(certFile, certPem, 0644)
+}
+
+func newSerial() (*big.Int, error) {
+	return rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+}
@@ -0,0 +1,189 @@
+/* Copyright (C) 2021 Pankaj Kargirwar <kargirwar@protonmail.com>
+
+   This file is part of prosql-agent
+
+   prosql-agent is free software: you can redistribute it and/or modify
+   it under the terms of the GNU General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   prosql-agent is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU General Public License for more details.
+
+   You should have received a copy of the GNU General Public License
+   along with prosql-agent.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"math/big"
+	"net"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func verifyHost(t *testing.T, ca *x509.Certificate, cert *x509.Certificate, host string) error {
+	roots := x509.NewCertPool()
+	roots.AddCert(ca)
+
+	_, err := cert.Verify(x509.VerifyOptions{DNSName: host, Roots: roots})
+	return err
+}
+
+func readTestCA(t *testing.T, dir string) *localCA {
+	cert, err := readCert(filepath.Join(dir, CA_CERT_FILE))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	key, err := readKey(filepath.Join(dir, CA_KEY_FILE))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return &localCA{cert: cert, key: key}
+}
+
+//what someone holding the CA key could make
+func signWithCA(t *testing.T, ca *localCA, dnsNames []string, ips []net.IP) *x509.Certificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	serial, err := newSerial()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tmpl := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: "rogue"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		DNSNames:     dnsNames,
+		IPAddresses:  ips,
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, ca.cert, &key.PublicKey, ca.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return cert
+}
+
+func TestLocalCertConstraints(t *testing.T) {
+	dir := t.TempDir()
+
+	certFile, _, err := localCert(dir, "127.0.0.1")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ca := readTestCA(t, dir)
+	cert, err := readCert(certFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, h := range []string{"localhost", "127.0.0.1", "::1"} {
+		if err := verifyHost(t, ca.cert, cert, h); err != nil {
+			t.Errorf("%s: expected the certificate to verify got %s\n", h, err)
+		}
+	}
+
+	rogue := []struct {
+		name string
+		dns  []string
+		ips  []net.IP
+	}{
+		{"example.com", []string{"example.com"}, nil},
+		{"localhost.example.com", []string{"localhost.example.com"}, nil},
+		{"10.0.0.1", nil, []net.IP{net.ParseIP("10.0.0.1")}},
+	}
+
+	for _, r := range rogue {
+		cert := signWithCA(t, ca, r.dns, r.ips)
+		if err := verifyHost(t, ca.cert, cert, r.name); err == nil {
+			t.Errorf("%s: expected the CA to refuse it\n", r.name)
+		}
+	}
+
+	//a listen address the CA does not cover gets a new one
+	certFile, _, err = localCert(dir, "10.1.2.3")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	moved := readTestCA(t, dir)
+	if moved.cert.Equal(ca.cert) {
+		t.Errorf("expected a new CA for a new listen address\n")
+	}
+
+	cert, err = readCert(certFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := verifyHost(t, moved.cert, cert, "10.1.2.3"); err != nil {
+		t.Errorf("expected the certificate to verify for the listen address got %s\n", err)
+	}
+
+	if err := verifyHost(t, moved.cert, signWithCA(t, moved, nil, []net.IP{net.ParseIP("10.1.2.4")}), "10.1.2.4"); err == nil {
+		t.Errorf("expected the CA to refuse a neighbour of the listen address\n")
+	}
+}
+
+func TestUnconstrainedCAReplaced(t *testing.T) {
+	dir := t.TempDir()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "old CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := writeKeyPair(filepath.Join(dir, CA_CERT_FILE), filepath.Join(dir, CA_KEY_FILE), der, key); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, _, err := localCert(dir, "127.0.0.1"); err != nil {
+		t.Fatal(err)
+	}
+
+	ca := readTestCA(t, dir)
+	if !ca.cert.PermittedDNSDomainsCritical || ca.cert.Subject.CommonName == "old CA" {
+		t.Errorf("expected the unconstrained CA to be replaced\n")
+	}
+}
@@ -0,0 +1,232 @@
+/* Copyright (C) 2021 Pankaj Kargirwar <kargirwar@protonmail.com>
+
+   This file is part of prosql-agent
+
+   prosql-agent is free software: you can redistribute it and/or modify
+   it under the terms of the GNU General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   prosql-agent is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU General Public License for more details.
+
+   You should have received a copy of the GNU General Public License
+   along with prosql-agent.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+/* SSH tunnels of connection profiles. Each connection of a session goes
+through its own SSH connection to the tunnel host, closed along with it.
+The key file, if any, is tried first, then the password.
+
+The tunnel host's key is recorded the first time the profile is used and
+must match from then on. A mismatch fails the login with
+tunnel-host-key-mismatch; updating the profile with another host or port
+forgets the recorded key */
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/go-sql-driver/mysql"
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/crypto/ssh"
+)
+
+const DEFAULT_SSH_PORT = "22"
+
+//network of tunnelled connections in the dsn. The address is the profile id
+const TUNNEL_NET = "prosql-tunnel"
+
+const SSH_TIMEOUT = 20 * time.Second
+
+type tunnel struct {
+	profileId string
+	addr      string //of the database, as seen from the tunnel host
+	sshAddr   string
+	config    *ssh.ClientConfig
+	hostKey   string
+	mutex     sync.Mutex
+}
+
+//by profile id, the latest login's credentials
+var tunnels = struct {
+	sync.Mutex
+	store map[string]*tunnel
+}{store: make(map[string]*tunnel)}
+
+func init() {
+	mysql.RegisterDialContext(TUNNEL_NET, dialTunnel)
+}
+
+func newTunnel(p *Profile, key []byte) (*tunnel, error) {
+	t := p.Tunnel
+
+	var password string
+	if t.Password != "" {
+		var err error
+		password, err = unseal(key, t.Password, p.Id+"/tunnel-password")
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	var auth []ssh.AuthMethod
+	if t.KeyFile != "" {
+		signer, err := readSshKey(t.KeyFile, password)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %s", t.KeyFile, err.Error())
+		}
+		auth = append(auth, ssh.PublicKeys(signer))
+	}
+
+	if password != "" {
+		auth = append(auth, ssh.Password(password))
+	}
+
+	tn := &tunnel{
+		profileId: p.Id,
+		addr:      net.JoinHostPort(p.Host, p.Port),
+		sshAddr:   net.JoinHostPort(t.Host, t.Port),
+		hostKey:   t.HostKey,
+	}
+
+	tn.config = &ssh.ClientConfig{
+		User:    t.User,
+		Auth:    auth,
+		Timeout: SSH_TIMEOUT,
+	}
+
+	return tn, nil
+}
+
+//the password doubles as the passphrase of an encrypted key
+func readSshKey(path string, password string) (ssh.Signer, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	signer, err := ssh.ParsePrivateKey(data)
+
+	var missing *ssh.PassphraseMissingError
+	if errors.As(err, &missing) {
+		signer, err = ssh.ParsePrivateKeyWithPassphrase(data, []byte(password))
+	}
+
+	return signer, err
+}
+
+//network and address for the dsn
+func (tn *tunnel) register() (string, string) {
+	tunnels.Lock()
+	defer tunnels.Unlock()
+
+	tunnels.store[tn.profileId] = tn
+	return TUNNEL_NET, tn.profileId
+}
+
+func dialTunnel(ctx context.Context, addr string) (net.Conn, error) {
+	tunnels.Lock()
+	tn, present := tunnels.store[addr]
+	tunnels.Unlock()
+
+	if !present {
+		return nil, errors.New(ERR_INVALID_PROFILE_ID)
+	}
+
+	return tn.dial(ctx)
+}
+
+func (tn *tunnel) dial(ctx context.Context) (net.Conn, error) {
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, "tcp", tn.sshAddr)
+	if err != nil {
+		return nil, err
+	}
+
+	//the handshake knows nothing of ctx
+	deadline := time.Now().Add(SSH_TIMEOUT)
+	if dl, ok := ctx.Deadline(); ok && dl.Before(deadline) {
+		deadline = dl
+	}
+	conn.SetDeadline(deadline)
+
+	mismatch := false
+	config := *tn.config
+	config.HostKeyCallback = func(hostname string, remote net.Addr, key ssh.PublicKey) error {
+		err := tn.checkHostKey(key)
+		mismatch = err != nil
+		return err
+	}
+
+	c, chans, reqs, err := ssh.NewClientConn(conn, tn.sshAddr, &config)
+	if err != nil {
+		conn.Close()
+		if mismatch {
+			return nil, errors.New(ERR_TUNNEL_HOST_KEY)
+		}
+		return nil, err
+	}
+	conn.SetDeadline(time.Time{})
+
+	client := ssh.NewClient(c, chans, reqs)
+	db, err := client.Dial("tcp", tn.addr)
+	if err != nil {
+		client.Close()
+		return nil, err
+	}
+
+	return &tunnelConn{Conn: db, client: client}, nil
+}
+
+//trust on first use
+func (tn *tunnel) checkHostKey(key ssh.PublicKey) error {
+	tn.mutex.Lock()
+	defer tn.mutex.Unlock()
+
+	fingerprint := ssh.FingerprintSHA256(key)
+	if tn.hostKey == "" {
+		tn.hostKey = fingerprint
+
+		log.WithFields(log.Fields{
+			"host":        tn.sshAddr,
+			"fingerprint": fingerprint,
+		}).Info("Recording tunnel host key")
+
+		if err := profileStore.setHostKey(tn.profileId, fingerprint); err != nil {
+			log.Info("Unable to save tunnel host key: " + err.Error())
+		}
+		return nil
+	}
+
+	if fingerprint != tn.hostKey {
+		log.WithFields(log.Fields{
+			"host":        tn.sshAddr,
+			"fingerprint": fingerprint,
+		}).Info("Tunnel host key mismatch")
+		return errors.New(ERR_TUNNEL_HOST_KEY)
+	}
+
+	return nil
+}
+
+//the database connection, which takes the SSH connection down with it
+type tunnelConn struct {
+	net.Conn
+	client *ssh.Client
+}
+
+func (c *tunnelConn) Close() error {
+	err := c.Conn.Close()
+	c.client.Close()
+	return err
+}
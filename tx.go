@@ -0,0 +1,168 @@
+/* Copyright (C) 2021 Pankaj Kargirwar <kargirwar@protonmail.com>
+
+   This file is part of prosql-agent
+
+   prosql-agent is free software: you can redistribute it and/or modify
+   it under the terms of the GNU General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   prosql-agent is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU General Public License for more details.
+
+   You should have received a copy of the GNU General Public License
+   along with prosql-agent.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+/* A session has at most one open transaction. Cursors created while it is
+open run inside it. A transaction lives on a single connection, so like a
+pinned connection it serves one cursor at a time */
+
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"strings"
+	"sync"
+	"time"
+)
+
+type transaction struct {
+	tx         *sql.Tx
+	lock       chan struct{}
+	release    func() //gives back the pinned connection, if any
+	started    time.Time
+	savepoints []string
+	done       bool
+	mutex      sync.Mutex
+}
+
+type TxStatus struct {
+	Open       bool     `json:"open"`
+	Started    string   `json:"started,omitempty"`
+	Savepoints []string `json:"savepoints"`
+}
+
+func newTransaction(tx *sql.Tx, release func()) *transaction {
+	return &transaction{
+		tx:         tx,
+		lock:       make(chan struct{}, 1),
+		release:    release,
+		started:    time.Now(),
+		savepoints: []string{},
+	}
+}
+
+//wait until no other cursor is using the transaction
+func (t *transaction) acquire(ctx context.Context, cctx context.Context) (*sql.Tx, func(), error) {
+	select {
+	case t.lock <- struct{}{}:
+	case <-ctx.Done():
+		return nil, nil, ctx.Err()
+	case <-cctx.Done():
+		return nil, nil, cctx.Err()
+	}
+
+	unlock := func() { <-t.lock }
+
+	if t.isDone() {
+		unlock()
+		return nil, nil, errors.New(ERR_TX_CLOSED)
+	}
+
+	return t.tx, unlock, nil
+}
+
+func (t *transaction) isDone() bool {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	return t.done
+}
+
+//commit or rollback and give back the connection. The caller must hold the lock
+func (t *transaction) finish(commit bool) error {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	if t.done {
+		return errors.New(ERR_TX_CLOSED)
+	}
+
+	var err error
+	if commit {
+		err = t.tx.Commit()
+	} else {
+		err = t.tx.Rollback()
+	}
+
+	t.done = true
+	if t.release != nil {
+		t.release()
+	}
+
+	return err
+}
+
+//as in MySQL, a savepoint with an existing name replaces the old one.
+//Savepoint names are not case sensitive
+func (t *transaction) addSavepoint(name string) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	for i, sp := range t.savepoints {
+		if strings.EqualFold(sp, name) {
+			t.savepoints = append(t.savepoints[:i], t.savepoints[i+1:]...)
+			break
+		}
+	}
+
+	t.savepoints = append(t.savepoints, name)
+}
+
+//forget savepoints set after name. Rolling back to a savepoint keeps it,
+//releasing it does not
+func (t *transaction) truncateSavepoints(name string, keep bool) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	for i, sp := range t.savepoints {
+		if strings.EqualFold(sp, name) {
+			if keep {
+				i++
+			}
+			t.savepoints = t.savepoints[:i]
+			return
+		}
+	}
+}
+
+func (t *transaction) hasSavepoint(name string) bool {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	for _, sp := range t.savepoints {
+		if strings.EqualFold(sp, name) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (t *transaction) status() *TxStatus {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	sps := make([]string, len(t.savepoints))
+	copy(sps, t.savepoints)
+
+	return &TxStatus{
+		Open:       !t.done,
+		Started:    t.started.Format(time.RFC3339),
+		Savepoints: sps,
+	}
+}
@@ -0,0 +1,51 @@
+/* Copyright (C) 2021 Pankaj Kargirwar <kargirwar@protonmail.com>
+
+   This file is part of prosql-agent
+
+   prosql-agent is free software: you can redistribute it and/or modify
+   it under the terms of the GNU General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   prosql-agent is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU General Public License for more details.
+
+   You should have received a copy of the GNU General Public License
+   along with prosql-agent.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestSavepointNames(t *testing.T) {
+	tx := newTransaction(nil, nil)
+	tx.addSavepoint("a")
+	tx.addSavepoint("SP1")
+	tx.addSavepoint("b")
+
+	if !tx.hasSavepoint("sp1") || !tx.hasSavepoint("Sp1") {
+		t.Errorf("savepoint names must not be case sensitive\n")
+	}
+
+	//same name in another case replaces the old one
+	tx.addSavepoint("sp1")
+	if want := []string{"a", "b", "sp1"}; !reflect.DeepEqual(tx.status().Savepoints, want) {
+		t.Errorf("expected %v got %v\n", want, tx.status().Savepoints)
+	}
+
+	tx.truncateSavepoints("B", true)
+	if want := []string{"a", "b"}; !reflect.DeepEqual(tx.status().Savepoints, want) {
+		t.Errorf("expected %v got %v\n", want, tx.status().Savepoints)
+	}
+
+	tx.truncateSavepoints("A", false)
+	if len(tx.status().Savepoints) != 0 {
+		t.Errorf("expected no savepoints got %v\n", tx.status().Savepoints)
+	}
+}
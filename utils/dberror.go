@@ -0,0 +1,173 @@
+/* Copyright (C) 2021 Pankaj Kargirwar <kargirwar@protonmail.com>
+
+   This file is part of prosql-agent
+
+   prosql-agent is free software: you can redistribute it and/or modify
+   it under the terms of the GNU General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   prosql-agent is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU General Public License for more details.
+
+   You should have received a copy of the GNU General Public License
+   along with prosql-agent.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+/* Errors from the database go out with the details the UI needs to react:
+
+{"status": "error", "msg": "Error 1213 (40001): Deadlock found ...", "error-code": "db-error",
+ "db-error": {"number": 1213, "sqlstate": "40001", "message": "Deadlock found ...",
+              "category": "deadlock", "retry": true}}
+
+The SQLSTATE is the one the server sent. The category is looked up from the
+error number, numbers not known here are "other". Errors which never reached
+the server, like a lost connection or a cancelled query, have neither a
+number nor a SQLSTATE */
+
+package utils
+
+import (
+	"context"
+	"database/sql/driver"
+	"errors"
+	"net"
+
+	"github.com/go-sql-driver/mysql"
+)
+
+const ERR_DB_ERROR = "db-error"
+
+//error categories
+const DB_ERR_SYNTAX = "syntax"
+const DB_ERR_PERMISSION = "permission"
+const DB_ERR_NOT_FOUND = "not-found"
+const DB_ERR_DUPLICATE = "duplicate"
+const DB_ERR_CONSTRAINT = "constraint"
+const DB_ERR_DATA = "data"
+const DB_ERR_LOCK_TIMEOUT = "lock-timeout"
+const DB_ERR_DEADLOCK = "deadlock"
+const DB_ERR_TIMEOUT = "timeout"
+const DB_ERR_CONNECTION_LOST = "connection-lost"
+const DB_ERR_CANCELLED = "cancelled"
+const DB_ERR_OTHER = "other"
+
+const defaultSqlState = "HY000"
+
+type DbError struct {
+	Number   uint16 `json:"number,omitempty"`
+	SqlState string `json:"sqlstate,omitempty"`
+	Message  string `json:"message"`
+	Category string `json:"category"`
+	Retry    bool   `json:"retry"` //the same statement may well succeed if run again
+}
+
+//category of the errors the UI can do something about
+var mysqlErrors = map[uint16]string{
+	1064: DB_ERR_SYNTAX, //ER_PARSE_ERROR
+	1149: DB_ERR_SYNTAX, //ER_SYNTAX_ERROR
+	1110: DB_ERR_SYNTAX, //ER_FIELD_SPECIFIED_TWICE
+	1060: DB_ERR_SYNTAX, //ER_DUP_FIELDNAME
+
+	1044: DB_ERR_PERMISSION, //ER_DBACCESS_DENIED_ERROR
+	1045: DB_ERR_PERMISSION, //ER_ACCESS_DENIED_ERROR
+	1142: DB_ERR_PERMISSION, //ER_TABLEACCESS_DENIED_ERROR
+	1143: DB_ERR_PERMISSION, //ER_COLUMNACCESS_DENIED_ERROR
+	1227: DB_ERR_PERMISSION, //ER_SPECIFIC_ACCESS_DENIED_ERROR
+	1370: DB_ERR_PERMISSION, //ER_PROCACCESS_DENIED_ERROR
+	1290: DB_ERR_PERMISSION, //ER_OPTION_PREVENTS_STATEMENT, e.g. read only
+
+	1049: DB_ERR_NOT_FOUND, //ER_BAD_DB_ERROR
+	1054: DB_ERR_NOT_FOUND, //ER_BAD_FIELD_ERROR
+	1146: DB_ERR_NOT_FOUND, //ER_NO_SUCH_TABLE
+	1051: DB_ERR_NOT_FOUND, //ER_BAD_TABLE_ERROR
+	1305: DB_ERR_NOT_FOUND, //ER_SP_DOES_NOT_EXIST
+	1050: DB_ERR_DUPLICATE, //ER_TABLE_EXISTS_ERROR
+	1007: DB_ERR_DUPLICATE, //ER_DB_CREATE_EXISTS
+
+	1062: DB_ERR_DUPLICATE, //ER_DUP_ENTRY
+	1022: DB_ERR_DUPLICATE, //ER_DUP_KEY
+	1586: DB_ERR_DUPLICATE, //ER_DUP_ENTRY_WITH_KEY_NAME
+
+	1048: DB_ERR_CONSTRAINT, //ER_BAD_NULL_ERROR
+	1216: DB_ERR_CONSTRAINT, //ER_NO_REFERENCED_ROW
+	1217: DB_ERR_CONSTRAINT, //ER_ROW_IS_REFERENCED
+	1451: DB_ERR_CONSTRAINT, //ER_ROW_IS_REFERENCED_2
+	1452: DB_ERR_CONSTRAINT, //ER_NO_REFERENCED_ROW_2
+	3819: DB_ERR_CONSTRAINT, //ER_CHECK_CONSTRAINT_VIOLATED
+
+	1264: DB_ERR_DATA, //ER_WARN_DATA_OUT_OF_RANGE
+	1265: DB_ERR_DATA, //WARN_DATA_TRUNCATED
+	1292: DB_ERR_DATA, //ER_TRUNCATED_WRONG_VALUE
+	1366: DB_ERR_DATA, //ER_TRUNCATED_WRONG_VALUE_FOR_FIELD
+	1406: DB_ERR_DATA, //ER_DATA_TOO_LONG
+	1365: DB_ERR_DATA, //ER_DIVISION_BY_ZERO
+
+	1205: DB_ERR_LOCK_TIMEOUT, //ER_LOCK_WAIT_TIMEOUT
+	3572: DB_ERR_LOCK_TIMEOUT, //ER_LOCK_NOWAIT
+	1213: DB_ERR_DEADLOCK,     //ER_LOCK_DEADLOCK
+
+	3024: DB_ERR_TIMEOUT,   //ER_QUERY_TIMEOUT, max_execution_time
+	1317: DB_ERR_CANCELLED, //ER_QUERY_INTERRUPTED, KILL QUERY
+
+	1053: DB_ERR_CONNECTION_LOST, //ER_SERVER_SHUTDOWN
+	1927: DB_ERR_CONNECTION_LOST, //ER_CONNECTION_KILLED (MariaDB)
+	1152: DB_ERR_CONNECTION_LOST, //ER_ABORTING_CONNECTION
+}
+
+//details of err if it came from the database or the connection to it,
+//nil otherwise
+func DbErrorOf(err error) *DbError {
+	if err == nil {
+		return nil
+	}
+
+	var me *mysql.MySQLError
+	if errors.As(err, &me) {
+		category, ok := mysqlErrors[me.Number]
+		if !ok {
+			category = DB_ERR_OTHER
+		}
+
+		//errors sent before the handshake completes have no SQLSTATE
+		sqlState := defaultSqlState
+		if me.SQLState != [5]byte{} {
+			sqlState = string(me.SQLState[:])
+		}
+
+		return newDbError(me.Number, sqlState, me.Message, category)
+	}
+
+	category := ""
+	switch {
+	case errors.Is(err, context.Canceled):
+		category = DB_ERR_CANCELLED
+
+	case errors.Is(err, context.DeadlineExceeded):
+		category = DB_ERR_TIMEOUT
+
+	case errors.Is(err, mysql.ErrInvalidConn), errors.Is(err, driver.ErrBadConn):
+		category = DB_ERR_CONNECTION_LOST
+
+	default:
+		var ne net.Error
+		if !errors.As(err, &ne) {
+			return nil
+		}
+		category = DB_ERR_CONNECTION_LOST
+	}
+
+	return newDbError(0, "", err.Error(), category)
+}
+
+func newDbError(number uint16, sqlState string, msg string, category string) *DbError {
+	return &DbError{
+		Number:   number,
+		SqlState: sqlState,
+		Message:  msg,
+		Category: category,
+		Retry:    category == DB_ERR_DEADLOCK || category == DB_ERR_LOCK_TIMEOUT,
+	}
+}
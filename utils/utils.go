@@ -24,6 +24,7 @@ import (
 	"errors"
 	"fmt"
 	"net/http"
+	"os"
 	"regexp"
 	"runtime"
 	"strconv"
@@ -41,12 +42,19 @@ type Response struct {
 	ErrorCode string      `json:"error-code"`
 	Data      interface{} `json:"data"`
 	Eof       bool        `json:"eof"`
+
+	//rows of cursors with several result sets, see SendRows
+	ResultSet int  `json:"result-set,omitempty"`
+	SetEnd    bool `json:"set-end,omitempty"`
+
+	//details of errors from the database, see DbErrorOf
+	DbError *DbError `json:"db-error,omitempty"`
 }
 
 var Upgrader = websocket.Upgrader{
+	//the agent installs its allow-list, until then nobody gets in
 	CheckOrigin: func(r *http.Request) bool {
-		//todo: enforce some rules here
-		return true
+		return false
 	},
 }
 
@@ -116,35 +124,59 @@ func echo(w http.ResponseWriter, r *http.Request) {
 func SendError_ws(ctx context.Context, c *websocket.Conn, err error, code string) {
 	defer TimeTrack(ctx, time.Now())
 
-	res := &Response{
-		Status:    "error",
-		Msg:       err.Error(),
-		ErrorCode: code,
-	}
-	str, _ := json.Marshal(res)
+	str, _ := json.Marshal(ErrorResponse(err, code))
 	c.WriteMessage(websocket.TextMessage, str)
 }
 
 func SendError(ctx context.Context, w http.ResponseWriter, err error, code string) {
 	defer TimeTrack(ctx, time.Now())
 
+	str, _ := json.Marshal(ErrorResponse(err, code))
+	fmt.Fprintf(w, string(str))
+}
+
+//errors from the database are sent as such whatever code the caller
+//picked, along with their details
+func ErrorResponse(err error, code string) *Response {
 	res := &Response{
 		Status:    "error",
 		Msg:       err.Error(),
 		ErrorCode: code,
+		DbError:   DbErrorOf(err),
 	}
-	str, _ := json.Marshal(res)
-	fmt.Fprintf(w, string(str))
+
+	if res.DbError != nil {
+		res.ErrorCode = ERR_DB_ERROR
+	}
+
+	return res
 }
 
 func SendSuccess(ctx context.Context, w http.ResponseWriter, data interface{}, eof bool) {
 	defer TimeTrack(ctx, time.Now())
 
-	res := &Response{
+	send(ctx, w, &Response{
 		Status: "ok",
 		Data:   data,
 		Eof:    eof,
-	}
+	})
+}
+
+//a batch of rows from result set resultSet. setEnd means the set is done
+//and the next fetch reads the one after it
+func SendRows(ctx context.Context, w http.ResponseWriter, data interface{}, eof bool, resultSet int, setEnd bool) {
+	defer TimeTrack(ctx, time.Now())
+
+	send(ctx, w, &Response{
+		Status:    "ok",
+		Data:      data,
+		Eof:       eof,
+		ResultSet: resultSet,
+		SetEnd:    setEnd,
+	})
+}
+
+func send(ctx context.Context, w http.ResponseWriter, res *Response) {
 	str, err := json.Marshal(res)
 	if err != nil {
 		e := errors.New("Unrecoverable error")
@@ -154,6 +186,17 @@ func SendSuccess(ctx context.Context, w http.ResponseWriter, data interface{}, e
 	fmt.Fprint(w, string(str))
 }
 
+//write data to a temporary file next to path and rename it into place, so
+//that a crash never leaves a half written file behind
+func WriteFileAtomic(path string, data []byte, perm os.FileMode) error {
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, data, perm); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp, path)
+}
+
 type requestIDKey struct{}
 
 //https://stackoverflow.com/a/67388007/1926351
@@ -175,6 +218,12 @@ func reqId(ctx context.Context) string {
 	return "req-id"
 }
 
+//tag ctx with a request id for logging. Used where one connection carries
+//many requests
+func WithRequestId(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, requestIDKey{}, id)
+}
+
 func GetContext(r *http.Request) context.Context {
 	params := r.URL.Query()
 
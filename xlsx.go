@@ -0,0 +1,166 @@
+/* Copyright (C) 2021 Pankaj Kargirwar <kargirwar@protonmail.com>
+
+   This file is part of prosql-agent
+
+   prosql-agent is free software: you can redistribute it and/or modify
+   it under the terms of the GNU General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   prosql-agent is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU General Public License for more details.
+
+   You should have received a copy of the GNU General Public License
+   along with prosql-agent.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+/* Minimal XLSX writer. A workbook with a single sheet whose rows are
+streamed straight into the zip, so large exports don't sit in memory.
+Strings are inline, numbers are numeric cells and NULL is an empty cell */
+
+package main
+
+import (
+	"archive/zip"
+	"bufio"
+	"encoding/xml"
+	"io"
+	"strconv"
+)
+
+const xlsxContentTypes = `<?xml version="1.0" encoding="UTF-8" standalone="yes"?>
+<Types xmlns="http://schemas.openxmlformats.org/package/2006/content-types">
+<Default Extension="rels" ContentType="application/vnd.openxmlformats-package.relationships+xml"/>
+<Default Extension="xml" ContentType="application/xml"/>
+<Override PartName="/xl/workbook.xml" ContentType="application/vnd.openxmlformats-officedocument.spreadsheetml.sheet.main+xml"/>
+<Override PartName="/xl/worksheets/sheet1.xml" ContentType="application/vnd.openxmlformats-officedocument.spreadsheetml.worksheet+xml"/>
+</Types>`
+
+const xlsxRels = `<?xml version="1.0" encoding="UTF-8" standalone="yes"?>
+<Relationships xmlns="http://schemas.openxmlformats.org/package/2006/relationships">
+<Relationship Id="rId1" Type="http://schemas.openxmlformats.org/officeDocument/2006/relationships/officeDocument" Target="xl/workbook.xml"/>
+</Relationships>`
+
+const xlsxWorkbook = `<?xml version="1.0" encoding="UTF-8" standalone="yes"?>
+<workbook xmlns="http://schemas.openxmlformats.org/spreadsheetml/2006/main" xmlns:r="http://schemas.openxmlformats.org/officeDocument/2006/relationships">
+<sheets><sheet name="Results" sheetId="1" r:id="rId1"/></sheets>
+</workbook>`
+
+const xlsxWorkbookRels = `<?xml version="1.0" encoding="UTF-8" standalone="yes"?>
+<Relationships xmlns="http://schemas.openxmlformats.org/package/2006/relationships">
+<Relationship Id="rId1" Type="http://schemas.openxmlformats.org/officeDocument/2006/relationships/worksheet" Target="worksheets/sheet1.xml"/>
+</Relationships>`
+
+const xlsxSheetStart = `<?xml version="1.0" encoding="UTF-8" standalone="yes"?>
+<worksheet xmlns="http://schemas.openxmlformats.org/spreadsheetml/2006/main"><sheetData>`
+
+const xlsxSheetEnd = `</sheetData></worksheet>`
+
+type xlsxExporter struct {
+	zw    *zip.Writer
+	w     *bufio.Writer
+	metas []*ColumnMeta
+	err   error
+}
+
+func newXlsxExporter(w io.Writer, opts FetchOptions) exporter {
+	e := &xlsxExporter{zw: zip.NewWriter(w)}
+
+	parts := []struct{ name, body string }{
+		{"[Content_Types].xml", xlsxContentTypes},
+		{"_rels/.rels", xlsxRels},
+		{"xl/workbook.xml", xlsxWorkbook},
+		{"xl/_rels/workbook.xml.rels", xlsxWorkbookRels},
+	}
+
+	for _, p := range parts {
+		f, err := e.zw.Create(p.name)
+		if err != nil {
+			e.err = err
+			return e
+		}
+
+		if _, err := io.WriteString(f, p.body); err != nil {
+			e.err = err
+			return e
+		}
+	}
+
+	//the sheet is the last entry so rows can be streamed into it
+	f, err := e.zw.Create("xl/worksheets/sheet1.xml")
+	if err != nil {
+		e.err = err
+		return e
+	}
+
+	e.w = bufio.NewWriter(f)
+	e.w.WriteString(xlsxSheetStart)
+
+	return e
+}
+
+func (e *xlsxExporter) header(metas []*ColumnMeta) error {
+	if e.err != nil {
+		return e.err
+	}
+
+	e.metas = metas
+
+	e.w.WriteString("<row>")
+	for _, m := range metas {
+		e.writeString(m.Name)
+	}
+	_, err := e.w.WriteString("</row>")
+
+	return err
+}
+
+func (e *xlsxExporter) row(vals []interface{}) error {
+	if e.err != nil {
+		return e.err
+	}
+
+	e.w.WriteString("<row>")
+	for i, v := range vals {
+		if v == nil {
+			e.w.WriteString("<c/>")
+			continue
+		}
+
+		s := textValue(v).(string)
+		if isNumeric(e.metas[i]) {
+			if _, err := strconv.ParseFloat(s, 64); err == nil {
+				e.w.WriteString(`<c t="n"><v>` + s + `</v></c>`)
+				continue
+			}
+		}
+
+		e.writeString(s)
+	}
+	_, err := e.w.WriteString("</row>")
+
+	return err
+}
+
+func (e *xlsxExporter) writeString(s string) {
+	e.w.WriteString(`<c t="inlineStr"><is><t xml:space="preserve">`)
+	//invalid XML characters are replaced by EscapeText
+	xml.EscapeText(e.w, []byte(s))
+	e.w.WriteString(`</t></is></c>`)
+}
+
+func (e *xlsxExporter) close() error {
+	if e.err != nil {
+		e.zw.Close()
+		return e.err
+	}
+
+	e.w.WriteString(xlsxSheetEnd)
+	if err := e.w.Flush(); err != nil {
+		return err
+	}
+
+	return e.zw.Close()
+}